@@ -0,0 +1,531 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Aggregation queries ====
+//
+// countCoins and holdingsSummary group coins by owner and/or denomination. They walk
+// the amount~name and owner~amount~name indexes, whose keys are sorted by the grouped
+// attributes, so every group is a contiguous run of keys. Only the current group and
+// the top N groups are kept in memory, however many coins and owners there are.
+//
+// countCoins groups by owner, denomination or ownerDenomination and can be restricted
+// to one denomination. holdingsSummary ranks owners by the value of their coins in
+// minor units and totals coins, owners and value per denomination.
+//
+// Both read the index a page at a time and stop after aggregatePages pages, at the end
+// of a group (for holdingsSummary, of an owner). The result then covers the groups read
+// so far and carries a bookmark; called again with it, they go on with the next group.
+// No group is split between two calls, so the client adds up the totals and takes the
+// top N of the top lists. The bookmark is empty once the whole index has been read.
+//
+// peer chaincode query -C myc1 -n coins -c '{"Args":["countCoins","owner","10","adollar"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["countCoins","denomination","10"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["countCoins","owner","10","","<bookmark>"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["holdingsSummary","10"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["holdingsSummary","10","acent"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["holdingsSummary","10","","<bookmark>"]}'
+
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// aggregatePages is the number of index pages countCoins and holdingsSummary read
+// before they stop at the next group.
+const aggregatePages = 100
+
+// ===================================================================================
+// ranking keeps the limit entries with the highest score. Ties go to the smaller key,
+// so the result does not depend on the order the entries are offered in.
+// ===================================================================================
+type rankEntry struct {
+	key   string
+	score int64
+	value interface{}
+}
+
+type ranking struct {
+	limit   int
+	entries []rankEntry //min-heap, the entry to evict first is at the top
+}
+
+func (r *ranking) Len() int { return len(r.entries) }
+func (r *ranking) Less(i, j int) bool {
+	return worseRank(r.entries[i], r.entries[j])
+}
+func (r *ranking) Swap(i, j int)      { r.entries[i], r.entries[j] = r.entries[j], r.entries[i] }
+func (r *ranking) Push(x interface{}) { r.entries = append(r.entries, x.(rankEntry)) }
+func (r *ranking) Pop() interface{} {
+	last := r.entries[len(r.entries)-1]
+	r.entries = r.entries[:len(r.entries)-1]
+	return last
+}
+
+// worseRank reports whether a ranks below b.
+func worseRank(a, b rankEntry) bool {
+	if a.score != b.score {
+		return a.score < b.score
+	}
+	return a.key > b.key
+}
+
+// offer adds the entry if it ranks among the top limit entries seen so far.
+func (r *ranking) offer(entry rankEntry) {
+	if len(r.entries) < r.limit {
+		heap.Push(r, entry)
+	} else if len(r.entries) > 0 && worseRank(r.entries[0], entry) {
+		r.entries[0] = entry
+		heap.Fix(r, 0)
+	}
+}
+
+// sorted returns the kept entries, best first.
+func (r *ranking) sorted() []rankEntry {
+	entries := append([]rankEntry{}, r.entries...)
+	sort.Slice(entries, func(i, j int) bool { return worseRank(entries[j], entries[i]) })
+	return entries
+}
+
+func sameGroup(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ===================================================================================
+// groupScanner walks an index in key order and calls emit once for every run of keys
+// that share their first width attributes, with those attributes and the number of
+// keys in the run. Keys for which keep returns false are skipped. A paged scan only
+// stops between runs of keys that share their first boundary attributes, so that no
+// group, or owner, is split between two calls.
+// ===================================================================================
+type groupScanner struct {
+	indexName string
+	prefix    []string
+	width     int
+	boundary  int
+	keep      func([]string) bool
+	emit      func([]string, int64) error
+
+	last  []string //boundary attributes of the last key, kept or not
+	group []string //group being counted
+	count int64
+}
+
+// add counts one key, emitting the previous group if the key starts a new one.
+func (g *groupScanner) add(stub shim.ChaincodeStubInterface, key string) error {
+	_, compositeKeyParts, err := stub.SplitCompositeKey(key)
+	if err != nil {
+		return err
+	}
+	if len(compositeKeyParts) <= g.width || len(compositeKeyParts) <= g.boundary {
+		return fmt.Errorf("malformed %s index entry: %s", g.indexName, key)
+	}
+	g.last = append(g.last[:0], compositeKeyParts[:g.boundary]...)
+	if g.keep != nil && !g.keep(compositeKeyParts) {
+		return nil
+	}
+	if g.count > 0 && !sameGroup(g.group, compositeKeyParts[:g.width]) {
+		err = g.flush()
+		if err != nil {
+			return err
+		}
+	}
+	if g.count == 0 {
+		g.group = append([]string{}, compositeKeyParts[:g.width]...)
+	}
+	g.count++
+	return nil
+}
+
+// atBoundary reports whether key starts a new run of boundary attributes.
+func (g *groupScanner) atBoundary(stub shim.ChaincodeStubInterface, key string) (bool, error) {
+	_, compositeKeyParts, err := stub.SplitCompositeKey(key)
+	if err != nil {
+		return false, err
+	}
+	if len(compositeKeyParts) <= g.boundary {
+		return false, fmt.Errorf("malformed %s index entry: %s", g.indexName, key)
+	}
+	return g.last == nil || !sameGroup(g.last, compositeKeyParts[:g.boundary]), nil
+}
+
+// flush emits the group being counted, if any.
+func (g *groupScanner) flush() error {
+	if g.count == 0 {
+		return nil
+	}
+	count := g.count
+	g.count = 0
+	return g.emit(g.group, count)
+}
+
+// scan walks the whole index in one range query. The peer cuts such a query off at
+// its totalQueryLimit, so it is meant for ranges that stay small, like the keys of
+// one account.
+func (g *groupScanner) scan(stub shim.ChaincodeStubInterface) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(g.indexName, g.prefix)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		err = g.add(stub, responseRange.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return g.flush()
+}
+
+// ===================================================================================
+// scanPages walks the index a page at a time from bookmark, a continuation as in
+// results.go, so that no query reaches the totalQueryLimit of the peer. After pages
+// pages, 0 for no limit, it stops at the next boundary and returns the bookmark to go
+// on from there, empty once the whole index has been read. Paginated queries cannot
+// be combined with writes, so this only works in queries.
+// ===================================================================================
+func (g *groupScanner) scanPages(stub shim.ChaincodeStubInterface, pageSize int32, pages int, bookmark string) (string, error) {
+	next, err := parseContinuation(bookmark)
+	if err != nil {
+		return "", err
+	}
+	for page := 1; ; page++ {
+		resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(g.indexName, g.prefix, pageSize, next.Bookmark)
+		if err != nil {
+			return "", err
+		}
+		stop, err := g.addPage(stub, resultsIterator, next.Skip, pages > 0 && page > pages)
+		resultsIterator.Close()
+		if err != nil {
+			return "", err
+		}
+		if stop >= 0 {
+			next.Skip = stop
+			return next.String(), g.flush()
+		}
+		if metadata.FetchedRecordsCount < pageSize || len(metadata.Bookmark) <= 0 {
+			return "", g.flush()
+		}
+		next = &continuation{Bookmark: metadata.Bookmark}
+	}
+}
+
+// addPage adds the keys of one page, leaving out the first skip. With stop set, it
+// returns the position of the first key at a boundary instead of adding it, or -1 if
+// there is none.
+func (g *groupScanner) addPage(stub shim.ChaincodeStubInterface, resultsIterator shim.StateQueryIteratorInterface, skip int, stop bool) (int, error) {
+	for position := 0; resultsIterator.HasNext(); position++ {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		if position < skip {
+			continue
+		}
+		if stop {
+			boundary, err := g.atBoundary(stub, responseRange.Key)
+			if err != nil {
+				return 0, err
+			} else if boundary {
+				return position, nil
+			}
+		}
+		err = g.add(stub, responseRange.Key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return -1, nil
+}
+
+// ===================================================================================
+// scanGroups walks an index with one range query, see groupScanner
+// ===================================================================================
+func scanGroups(stub shim.ChaincodeStubInterface, indexName string, prefix []string, width int, keep func([]string) bool, emit func([]string, int64) error) error {
+	scanner := &groupScanner{indexName: indexName, prefix: prefix, width: width, boundary: width, keep: keep, emit: emit}
+	return scanner.scan(stub)
+}
+
+type groupCount struct {
+	Owner        string `json:"owner,omitempty"`
+	Denomination string `json:"denomination,omitempty"`
+	Coins        int64  `json:"coins"`
+}
+
+type coinCounts struct {
+	GroupBy      string       `json:"groupBy"`
+	Denomination string       `json:"denomination,omitempty"` //only coins of this denomination were counted
+	Groups       int64        `json:"groups"`
+	Coins        int64        `json:"coins"`
+	Top          []groupCount `json:"top"`
+	Bookmark     string       `json:"bookmark"` //empty once all coins were counted
+}
+
+// ============================================================
+// countCoins - number of coins per owner, denomination or both, top N groups first
+// ============================================================
+func (t *SimpleChaincode) countCoins(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0         1       2            3
+	// "owner",    "10",  "adollar",  "<bookmark>"
+	if len(args) < 2 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting groupBy, topN and optionally denomination and bookmark")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	topN, err := config.pageSize(args[1])
+	if err != nil {
+		return shim.Error(fmt.Sprintf("2nd argument must be a number between 1 and %d", config.MaxPageSize))
+	}
+	result := coinCounts{GroupBy: args[0], Top: []groupCount{}}
+	// an empty denomination counts all of them
+	if len(args) >= 3 {
+		result.Denomination = strings.ToLower(args[2])
+	}
+	bookmark := ""
+	if len(args) == 4 {
+		bookmark = args[3]
+	}
+
+	// the position of the denomination in the keys of the index that is walked
+	var indexName string
+	var width, amountAttr int
+	switch result.GroupBy {
+	case "owner":
+		indexName, width, amountAttr = ownerAmountNameIndex, 1, 1
+	case "denomination":
+		indexName, width, amountAttr = amountNameIndex, 1, 0
+	case "ownerDenomination":
+		indexName, width, amountAttr = ownerAmountNameIndex, 2, 1
+	default:
+		return shim.Error("1st argument must be owner, denomination or ownerDenomination")
+	}
+	prefix := []string{}
+	var keep func([]string) bool
+	if len(result.Denomination) > 0 {
+		if amountAttr == 0 {
+			prefix = []string{result.Denomination}
+		} else {
+			keep = func(attrs []string) bool { return attrs[amountAttr] == result.Denomination }
+		}
+	}
+
+	top := &ranking{limit: int(topN)}
+	scanner := &groupScanner{indexName: indexName, prefix: prefix, width: width, boundary: width, keep: keep}
+	scanner.emit = func(attrs []string, count int64) error {
+		group := groupCount{Coins: count}
+		switch result.GroupBy {
+		case "owner":
+			group.Owner = attrs[0]
+		case "denomination":
+			group.Denomination = attrs[0]
+		case "ownerDenomination":
+			group.Owner, group.Denomination = attrs[0], attrs[1]
+		}
+		result.Groups++
+		result.Coins += count
+		top.offer(rankEntry{key: strings.Join(attrs, "/"), score: count, value: group})
+		return nil
+	}
+	result.Bookmark, err = scanner.scanPages(stub, config.MaxPageSize, aggregatePages, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, entry := range top.sorted() {
+		result.Top = append(result.Top, entry.value.(groupCount))
+	}
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- countCoins counted %d coins in %d groups\n", result.Coins, result.Groups)
+	return shim.Success(resultJSONasBytes)
+}
+
+type ownerHoldings struct {
+	Owner    string           `json:"owner"`
+	Coins    int64            `json:"coins"`
+	Value    int64            `json:"value"`    //in minor units, of the priced coins
+	Holdings map[string]int64 `json:"holdings"` //number of coins per denomination
+}
+
+type denominationTotal struct {
+	Coins  int64 `json:"coins"`
+	Owners int64 `json:"owners"`
+	Value  int64 `json:"value"` //in minor units, 0 if the denomination is not registered
+}
+
+type holdingsSummary struct {
+	Denomination  string                        `json:"denomination,omitempty"` //only coins of this denomination were summed
+	Owners        int64                         `json:"owners"`
+	Coins         int64                         `json:"coins"`
+	Value         int64                         `json:"value"`    //in minor units
+	Unpriced      int64                         `json:"unpriced"` //coins whose amount is not in the registry
+	Denominations map[string]*denominationTotal `json:"denominations"`
+	Top           []ownerHoldings               `json:"top"`
+	Bookmark      string                        `json:"bookmark"` //empty once all owners were summed
+}
+
+// addValue adds value to total, failing instead of overflowing.
+func addValue(total *int64, value int64) error {
+	if *total > math.MaxInt64-value {
+		return fmt.Errorf("value of holdings overflows")
+	}
+	*total += value
+	return nil
+}
+
+// ============================================================
+// holdingsSummary - owners ranked by the value of their coins, with totals per denomination
+// ============================================================
+func (t *SimpleChaincode) holdingsSummary(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0       1            2
+	// "10",  "acent",  "<bookmark>"
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting topN and optionally denomination and bookmark")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	topN, err := config.pageSize(args[0])
+	if err != nil {
+		return shim.Error(fmt.Sprintf("1st argument must be a number between 1 and %d", config.MaxPageSize))
+	}
+	result := holdingsSummary{Denominations: map[string]*denominationTotal{}, Top: []ownerHoldings{}}
+	var keep func([]string) bool
+	// an empty denomination sums all of them
+	if len(args) >= 2 {
+		result.Denomination = strings.ToLower(args[1])
+	}
+	if len(result.Denomination) > 0 {
+		keep = func(attrs []string) bool { return attrs[1] == result.Denomination }
+	}
+	bookmark := ""
+	if len(args) == 3 {
+		bookmark = args[2]
+	}
+
+	// one entry per denomination, so these stay small
+	denoms := map[string]*denomination{}
+	top := &ranking{limit: int(topN)}
+	var current *ownerHoldings
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		result.Owners++
+		err := addValue(&result.Value, current.Value)
+		if err != nil {
+			return err
+		}
+		top.offer(rankEntry{key: current.Owner, score: current.Value, value: *current})
+		current = nil
+		return nil
+	}
+
+	// groups of owner and denomination, the scan stops only between owners
+	scanner := &groupScanner{indexName: ownerAmountNameIndex, prefix: []string{}, width: 2, boundary: 1, keep: keep}
+	scanner.emit = func(attrs []string, count int64) error {
+		owner, amount := attrs[0], attrs[1]
+		if current != nil && current.Owner != owner {
+			err := flush()
+			if err != nil {
+				return err
+			}
+		}
+		if current == nil {
+			current = &ownerHoldings{Owner: owner, Holdings: map[string]int64{}}
+		}
+		current.Coins += count
+		current.Holdings[amount] = count
+		result.Coins += count
+
+		denom, ok := denoms[amount]
+		if !ok {
+			var err error
+			denom, err = getDenomination(stub, amount)
+			if err != nil {
+				return err
+			}
+			denoms[amount] = denom
+		}
+		total, ok := result.Denominations[amount]
+		if !ok {
+			total = &denominationTotal{}
+			result.Denominations[amount] = total
+		}
+		total.Coins += count
+		total.Owners++
+		if denom == nil {
+			result.Unpriced += count
+			return nil
+		}
+		value, err := toMinorUnits(count, denom)
+		if err != nil {
+			return err
+		}
+		err = addValue(&total.Value, value)
+		if err != nil {
+			return err
+		}
+		return addValue(&current.Value, value)
+	}
+	result.Bookmark, err = scanner.scanPages(stub, config.MaxPageSize, aggregatePages, bookmark)
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, entry := range top.sorted() {
+		result.Top = append(result.Top, entry.value.(ownerHoldings))
+	}
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- holdingsSummary summed %d coins of %d owners\n", result.Coins, result.Owners)
+	return shim.Success(resultJSONasBytes)
+}
@@ -0,0 +1,164 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// seedHoldings creates, for every owner, the given number of coins per denomination,
+// one transaction per owner.
+func seedHoldings(t *testing.T, ledger *fakeLedger, holdings map[string]map[string]int) {
+	t.Helper()
+	for owner, coins := range holdings {
+		stub := ledger.newStub("org1msp/admin", "seed")
+		for amount, count := range coins {
+			names := make([]string, count)
+			for i := range names {
+				names[i] = fmt.Sprintf("%s-%s-%d", owner, amount, i)
+			}
+			_, err := createCoins(stub, names, amount, owner)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !ledger.commit(stub)[0] {
+			t.Fatal("seeding transaction was invalidated")
+		}
+	}
+}
+
+func countTestCoins(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, args ...string) *coinCounts {
+	t.Helper()
+	result := &coinCounts{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "countCoins", args...), result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestCountCoinsGroupsAndRanks(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"]}`)
+	seedHoldings(t, ledger, map[string]map[string]int{
+		"org1msp/tom":   {"adollar": 3, "acent": 1},
+		"org2msp/jerry": {"adollar": 2, "acent": 2},
+		"org1msp/bob":   {"acent": 4},
+		"org1msp/amy":   {"adollar": 1},
+	})
+
+	counts := countTestCoins(t, ledger, cc, "owner", "2")
+	if counts.Groups != 4 || counts.Coins != 13 || len(counts.Top) != 2 || len(counts.Bookmark) != 0 {
+		t.Fatalf("counts by owner are %+v", counts)
+	}
+	// tom, jerry and bob all hold 4 coins, ties go to the smaller owner
+	if counts.Top[0].Owner != "org1msp/bob" || counts.Top[1].Owner != "org1msp/tom" || counts.Top[1].Coins != 4 {
+		t.Errorf("top owners are %+v", counts.Top)
+	}
+
+	counts = countTestCoins(t, ledger, cc, "denomination", "10")
+	if counts.Groups != 2 || counts.Top[0].Denomination != "acent" || counts.Top[0].Coins != 7 || counts.Top[1].Coins != 6 {
+		t.Errorf("counts by denomination are %+v", counts)
+	}
+
+	counts = countTestCoins(t, ledger, cc, "ownerDenomination", "1", "adollar")
+	if counts.Groups != 3 || counts.Coins != 6 || len(counts.Top) != 1 ||
+		counts.Top[0].Owner != "org1msp/tom" || counts.Top[0].Denomination != "adollar" || counts.Top[0].Coins != 3 {
+		t.Errorf("counts of adollar coins by owner and denomination are %+v", counts)
+	}
+
+	if ledger.invoke(cc, "org1msp/tom", "countCoins", "colour", "10").Status == shim.OK {
+		t.Errorf("countCoins accepted an unknown grouping")
+	}
+}
+
+func TestHoldingsSummaryRanksByValue(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"]}`)
+	seedHoldings(t, ledger, map[string]map[string]int{
+		"org1msp/tom":   {"adollar": 1, "acent": 50},
+		"org2msp/jerry": {"acent": 120},
+		"org1msp/bob":   {"adollar": 2},
+	})
+
+	summary := &holdingsSummary{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "holdingsSummary", "2"), summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Owners != 3 || summary.Coins != 173 || summary.Value != 470 || len(summary.Top) != 2 {
+		t.Fatalf("summary is %+v", summary)
+	}
+	if summary.Top[0].Owner != "org1msp/bob" || summary.Top[0].Value != 200 ||
+		summary.Top[1].Owner != "org1msp/tom" || summary.Top[1].Value != 150 || summary.Top[1].Holdings["acent"] != 50 {
+		t.Errorf("top owners are %+v", summary.Top)
+	}
+	if cents := summary.Denominations["acent"]; cents.Coins != 170 || cents.Owners != 2 || cents.Value != 170 {
+		t.Errorf("acent totals are %+v", cents)
+	}
+}
+
+func TestAggregatesContinueBetweenGroups(t *testing.T) {
+	// two keys a page, so a call reads 2*aggregatePages keys
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"],"maxPageSize":2}`)
+	holdings := map[string]map[string]int{}
+	for i := 0; i < 50; i++ {
+		holdings[fmt.Sprintf("org1msp/owner%02d", i)] = map[string]int{"adollar": 3, "acent": 4}
+	}
+	seedHoldings(t, ledger, holdings)
+
+	calls := 0
+	var owners, total int64
+	for bookmark := ""; calls == 0 || len(bookmark) > 0; calls++ {
+		summary := &holdingsSummary{}
+		err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "holdingsSummary", "2", "", bookmark), summary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// an owner split between two calls would be counted twice
+		owners += summary.Owners
+		total += summary.Value
+		bookmark = summary.Bookmark
+		if calls > 10 {
+			t.Fatal("still going after 10 calls")
+		}
+	}
+	if calls < 2 || owners != 50 || total != 50*304 {
+		t.Errorf("%d calls summed a value of %d of %d owners", calls, total, owners)
+	}
+
+	var groups, coins int64
+	calls = 0
+	for bookmark := ""; calls == 0 || len(bookmark) > 0; calls++ {
+		counts := countTestCoins(t, ledger, cc, "owner", "1", "", bookmark)
+		groups += counts.Groups
+		coins += counts.Coins
+		bookmark = counts.Bookmark
+		if calls > 10 {
+			t.Fatal("still going after 10 calls")
+		}
+	}
+	if calls < 2 || groups != 50 || coins != 350 {
+		t.Errorf("%d calls counted %d coins in %d groups", calls, coins, groups)
+	}
+}
@@ -0,0 +1,393 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Allowances and delegated transfers ====
+//
+// An owner can approve a spender for one coin, or make an operator who may move
+// all of the owner's coins, e.g. a custodian or payment processor. The spender or
+// operator then moves the coin with transferFrom. The approval of a coin is cleared
+// whenever the coin changes owner. Identities are "<mspid>/<common name>".
+//
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["approve","coin1","org1msp/processor"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["approve","coin1",""]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["setOperator","org1msp/tom","org2msp/custodian","true"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["transferFrom","coin1","org1msp/tom","org1msp/jerry"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["getApprovalsGrantedBy","org1msp/tom"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["getApprovalsGrantedTo","org2msp/custodian"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	approvalObjectType    = "approval"
+	approvalOwnerIndex    = "approval~owner~coin"
+	approvalSpenderIndex  = "approval~spender~coin"
+	operatorOwnerIndex    = "operator~owner~operator"
+	operatorOperatorIndex = "operator~operator~owner"
+)
+
+type approval struct {
+	ObjectType string `json:"docType"`
+	Coin       string `json:"coin"`
+	Owner      string `json:"owner"`
+	Spender    string `json:"spender"`
+}
+
+// ===================================================================================
+// getApproval returns the approval of a coin, or nil if there is none
+// ===================================================================================
+func getApproval(stub shim.ChaincodeStubInterface, coinName string) (*approval, error) {
+	approvalKey, err := stub.CreateCompositeKey(approvalObjectType, []string{coinName})
+	if err != nil {
+		return nil, err
+	}
+	approvalAsBytes, err := stub.GetState(approvalKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get approval of %s: %s", coinName, err)
+	} else if approvalAsBytes == nil {
+		return nil, nil
+	}
+
+	a := &approval{}
+	err = json.Unmarshal(approvalAsBytes, a)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode approval of %s: %s", coinName, err)
+	}
+	return a, nil
+}
+
+// ===================================================================================
+// clearApproval removes the approval of a coin and its index entries, if any
+// ===================================================================================
+func clearApproval(stub shim.ChaincodeStubInterface, coinName string) error {
+	a, err := getApproval(stub, coinName)
+	if err != nil || a == nil {
+		return err
+	}
+
+	keys := [][]string{
+		{approvalObjectType, coinName},
+		{approvalOwnerIndex, a.Owner, coinName},
+		{approvalSpenderIndex, a.Spender, coinName},
+	}
+	for _, parts := range keys {
+		key, err := stub.CreateCompositeKey(parts[0], parts[1:])
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ===================================================================================
+// isOperator reports whether operator may move all coins of owner
+// ===================================================================================
+func isOperator(stub shim.ChaincodeStubInterface, owner string, operator string) (bool, error) {
+	operatorKey, err := stub.CreateCompositeKey(operatorOwnerIndex, []string{owner, operator})
+	if err != nil {
+		return false, err
+	}
+	operatorAsBytes, err := stub.GetState(operatorKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to get operator: %s", err)
+	}
+	return operatorAsBytes != nil, nil
+}
+
+// ============================================================
+// approve - owner only, allow spender to transfer one coin.
+// An empty spender revokes the approval.
+// ============================================================
+func (t *SimpleChaincode) approve(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1
+	// "coin1", "org1msp/processor"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	coinName := args[0]
+	spender := normalizeIdentity(args[1])
+
+	c, err := getCoin(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != c.Owner {
+		return shim.Error("Only the owner can approve a spender for " + coinName)
+	}
+
+	if spender == caller {
+		return shim.Error("The owner cannot approve itself")
+	}
+
+	err = clearApproval(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(spender) <= 0 {
+		fmt.Println("- approve revoked approval of " + coinName)
+		return shim.Success(nil)
+	}
+
+	a := &approval{ObjectType: approvalObjectType, Coin: coinName, Owner: c.Owner, Spender: spender}
+	approvalJSONasBytes, err := json.Marshal(a)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	approvalKey, err := stub.CreateCompositeKey(approvalObjectType, []string{coinName})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(approvalKey, approvalJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//  Index the approval by owner and by spender, only the key is needed
+	ownerIndexKey, err := stub.CreateCompositeKey(approvalOwnerIndex, []string{a.Owner, coinName})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	spenderIndexKey, err := stub.CreateCompositeKey(approvalSpenderIndex, []string{spender, coinName})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, key := range []string{ownerIndexKey, spenderIndexKey} {
+		err = stub.PutState(key, []byte{0x00})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	fmt.Println("- end approve (success)")
+	return shim.Success(nil)
+}
+
+// ============================================================
+// setOperator - owner only, allow or disallow an operator to
+// transfer all coins of the owner
+// ============================================================
+func (t *SimpleChaincode) setOperator(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0                1                 2
+	// "org1msp/tom", "org2msp/custodian", "true"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	owner := normalizeIdentity(args[0])
+	operator := normalizeIdentity(args[1])
+	if len(operator) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	approved, err := strconv.ParseBool(args[2])
+	if err != nil {
+		return shim.Error("3rd argument must be true or false")
+	}
+
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != owner {
+		return shim.Error("Only the owner can set its operators")
+	}
+	if operator == owner {
+		return shim.Error("The owner cannot be its own operator")
+	}
+
+	ownerIndexKey, err := stub.CreateCompositeKey(operatorOwnerIndex, []string{owner, operator})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	operatorIndexKey, err := stub.CreateCompositeKey(operatorOperatorIndex, []string{operator, owner})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, key := range []string{ownerIndexKey, operatorIndexKey} {
+		if approved {
+			err = stub.PutState(key, []byte{0x00})
+		} else {
+			err = stub.DelState(key)
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	fmt.Printf("- end setOperator %s %s %t\n", owner, operator, approved)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// transferFrom - transfer a coin on behalf of its owner. The
+// caller must be the approved spender of the coin or an
+// operator of the owner.
+// ============================================================
+func (t *SimpleChaincode) transferFrom(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1              2                         3
+	// "coin1", "org1msp/tom", "org1msp/jerry", "{\"reference\":\"INV-2024-0042\"}"
+	if len(args) < 3 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting coin, from, to and optional memo")
+	}
+
+	coinName := args[0]
+	from := normalizeIdentity(args[1])
+	to := normalizeIdentity(args[2])
+	fmt.Println("- start transferFrom ", coinName, from, to)
+
+	c, err := getCoin(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if c.Owner != from {
+		return shim.Error(coinName + " is not owned by " + from)
+	}
+
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	authorised := caller == from
+	if !authorised {
+		a, err := getApproval(stub, coinName)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		authorised = a != nil && a.Owner == from && a.Spender == caller
+	}
+	if !authorised {
+		authorised, err = isOperator(stub, from, caller)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if !authorised {
+		return shim.Error(caller + " is not approved to transfer " + coinName)
+	}
+	// moveCoin checks the owner and the recipient, a spender or operator acting for
+	// the owner is checked here
+	err = checkCompliance(stub, caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	opts := transferOptions{}
+	if len(args) == 4 {
+		opts.Memo, err = parseMemo(args[3])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	err = moveCoin(stub, c, to, opts)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end transferFrom (success)")
+	return shim.Success(nil)
+}
+
+type grantedApprovals struct {
+	Identity  string   `json:"identity"`
+	Coins     []string `json:"coins"`     //coins with a single-coin approval
+	Operators []string `json:"operators"` //operators of the identity, or owners it operates for
+}
+
+// listIndex returns the last attribute of every key in a composite key index
+// that starts with prefix.
+func listIndex(stub shim.ChaincodeStubInterface, indexName string, prefix string) ([]string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{prefix})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	result := []string{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, compositeKeyParts[len(compositeKeyParts)-1])
+	}
+	return result, nil
+}
+
+// ============================================================
+// getApprovalsGrantedBy - coins approved and operators made by an owner
+// ============================================================
+func (t *SimpleChaincode) getApprovalsGrantedBy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return getApprovals(stub, args, approvalOwnerIndex, operatorOwnerIndex)
+}
+
+// ============================================================
+// getApprovalsGrantedTo - coins a spender is approved for and
+// owners it is an operator of
+// ============================================================
+func (t *SimpleChaincode) getApprovalsGrantedTo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return getApprovals(stub, args, approvalSpenderIndex, operatorOperatorIndex)
+}
+
+func getApprovals(stub shim.ChaincodeStubInterface, args []string, approvalIndex string, operatorIndex string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting identity")
+	}
+	identity := normalizeIdentity(args[0])
+	if len(identity) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	coins, err := listIndex(stub, approvalIndex, identity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	operators, err := listIndex(stub, operatorIndex, identity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultJSONasBytes, err := json.Marshal(grantedApprovals{Identity: identity, Coins: coins, Operators: operators})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultJSONasBytes)
+}
@@ -0,0 +1,117 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// newAllowanceLedger returns a ledger where tom holds coin1 and coin2.
+func newAllowanceLedger(t *testing.T) (*fakeLedger, *SimpleChaincode) {
+	t.Helper()
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"]}`)
+	for _, name := range []string{"coin1", "coin2"} {
+		ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", name, "adollar", "org1msp/tom")
+	}
+	return ledger, cc
+}
+
+func readTestApprovals(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, function string, identity string) *grantedApprovals {
+	t.Helper()
+	granted := &grantedApprovals{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, identity, function, identity), granted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return granted
+}
+
+func TestSeededCoinsCanBeTransferred(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, `{}`)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initLedger")
+	ledger.mustInvoke(t, cc, "org1msp/miriam", "transferCoin", "coin1", "org2msp/jerry")
+	if c := readTestCoin(t, ledger, cc, "coin1"); c.Owner != "org2msp/jerry" {
+		t.Errorf("coin1 is owned by %s after its transfer", c.Owner)
+	}
+}
+
+func TestApprovalClearedOnTransfer(t *testing.T) {
+	ledger, cc := newAllowanceLedger(t)
+	if ledger.invoke(cc, "org1msp/processor", "approve", "coin1", "org1msp/processor").Status == shim.OK {
+		t.Errorf("an identity approved itself for a coin of tom")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/tom", "approve", "coin1", " Org1MSP/Processor ")
+
+	by := readTestApprovals(t, ledger, cc, "getApprovalsGrantedBy", "org1msp/tom")
+	to := readTestApprovals(t, ledger, cc, "getApprovalsGrantedTo", "org1msp/processor")
+	if !reflect.DeepEqual(by.Coins, []string{"coin1"}) || !reflect.DeepEqual(to.Coins, []string{"coin1"}) {
+		t.Errorf("approvals granted by tom are %+v and to the processor %+v", by, to)
+	}
+
+	// the approval covers one coin and does not survive a change of owner
+	if ledger.invoke(cc, "org1msp/processor", "transferFrom", "coin2", "org1msp/tom", "org2msp/jerry").Status == shim.OK {
+		t.Errorf("the processor moved coin2 without an approval")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/processor", "transferFrom", "coin1", "org1msp/tom", "org2msp/jerry")
+	if c := readTestCoin(t, ledger, cc, "coin1"); c.Owner != "org2msp/jerry" {
+		t.Errorf("coin1 is owned by %s after transferFrom", c.Owner)
+	}
+	if to := readTestApprovals(t, ledger, cc, "getApprovalsGrantedTo", "org1msp/processor"); len(to.Coins) != 0 {
+		t.Errorf("approvals granted to the processor after the transfer are %+v", to)
+	}
+	if ledger.invoke(cc, "org1msp/processor", "transferFrom", "coin1", "org2msp/jerry", "org1msp/tom").Status == shim.OK {
+		t.Errorf("the processor moved coin1 again with an approval of its previous owner")
+	}
+
+	ledger.mustInvoke(t, cc, "org1msp/tom", "approve", "coin2", "org1msp/processor")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "approve", "coin2", "")
+	if ledger.invoke(cc, "org1msp/processor", "transferFrom", "coin2", "org1msp/tom", "org2msp/jerry").Status == shim.OK {
+		t.Errorf("the processor moved coin2 after the approval was revoked")
+	}
+}
+
+func TestOperatorRevoked(t *testing.T) {
+	ledger, cc := newAllowanceLedger(t)
+	if ledger.invoke(cc, "org2msp/custodian", "setOperator", "org1msp/tom", "org2msp/custodian", "true").Status == shim.OK {
+		t.Errorf("the custodian made itself an operator of tom")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/tom", "setOperator", "org1msp/tom", "org2msp/custodian", "true")
+	if to := readTestApprovals(t, ledger, cc, "getApprovalsGrantedTo", "org2msp/custodian"); !reflect.DeepEqual(to.Operators, []string{"org1msp/tom"}) {
+		t.Errorf("approvals granted to the custodian are %+v", to)
+	}
+
+	// an operator may move the coins of the owner, not those the owner gave away
+	ledger.mustInvoke(t, cc, "org2msp/custodian", "transferFrom", "coin1", "org1msp/tom", "org2msp/jerry")
+	if ledger.invoke(cc, "org2msp/custodian", "transferFrom", "coin1", "org2msp/jerry", "org1msp/tom").Status == shim.OK {
+		t.Errorf("the operator of tom moved a coin of jerry")
+	}
+
+	ledger.mustInvoke(t, cc, "org1msp/tom", "setOperator", "org1msp/tom", "org2msp/custodian", "false")
+	if by := readTestApprovals(t, ledger, cc, "getApprovalsGrantedBy", "org1msp/tom"); len(by.Operators) != 0 {
+		t.Errorf("approvals granted by tom after revoking the operator are %+v", by)
+	}
+	if ledger.invoke(cc, "org2msp/custodian", "transferFrom", "coin2", "org1msp/tom", "org2msp/jerry").Status == shim.OK {
+		t.Errorf("the custodian moved coin2 after being revoked as operator")
+	}
+}
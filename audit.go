@@ -0,0 +1,118 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Audit trail ====
+//
+// Privileged operations write an audit record under the composite key
+// audit~action~txid~subject, so the trail of one action can be read with a
+// partial composite key query, optionally narrowed to a subject.
+//
+// peer chaincode query -C myc1 -n coins -c '{"Args":["getAuditTrail","mint"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["getAuditTrail","mint","<txid>"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const auditObjectType = "audit"
+
+type auditRecord struct {
+	ObjectType string            `json:"docType"`
+	Action     string            `json:"action"`
+	Subject    string            `json:"subject"` //coin or identity the action applied to
+	Actor      string            `json:"actor"`
+	TxID       string            `json:"txId"`
+	Timestamp  string            `json:"timestamp"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// ===================================================================================
+// writeAudit stores an audit record for action on subject, performed by actor
+// ===================================================================================
+func writeAudit(stub shim.ChaincodeStubInterface, action string, subject string, actor string, details map[string]string) error {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	record := &auditRecord{
+		ObjectType: auditObjectType,
+		Action:     action,
+		Subject:    subject,
+		Actor:      actor,
+		TxID:       stub.GetTxID(),
+		Timestamp:  txTime.Format(time.RFC3339),
+		Details:    details,
+	}
+	recordJSONasBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	auditKey, err := stub.CreateCompositeKey(auditObjectType, []string{action, record.TxID, subject})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(auditKey, recordJSONasBytes)
+}
+
+// ============================================================
+// getAuditTrail - return the audit records of an action,
+// optionally only those of one transaction
+// ============================================================
+func (t *SimpleChaincode) getAuditTrail(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "mint", "txid"
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting action and optional transaction ID")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(auditObjectType, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	records := []json.RawMessage{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		records = append(records, json.RawMessage(queryResponse.Value))
+	}
+
+	recordsJSONasBytes, err := json.Marshal(records)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- getAuditTrail returning %d records\n", len(records))
+	return shim.Success(recordsJSONasBytes)
+}
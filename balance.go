@@ -0,0 +1,233 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Account balances ====
+//
+// The balance of an account is the number of coins it holds per denomination. It is
+// not kept under one key per account: every payment to a busy account would read and
+// rewrite that key, and all but the first of them in a block would fail validation
+// with an MVCC read conflict. Instead every coin that is created, moved or destroyed
+// writes a delta under its own key, balance~account~txid~coin, which no other
+// transaction reads or writes. readBalance and valueOfOwner sum the deltas.
+//
+// compactBalances folds the deltas of an account into a single record, so that reads
+// stay short. It reads the whole balance range of the account, so it fails with a
+// phantom read conflict when a payment to the account commits in the same block, and
+// can simply be retried. It takes the coin counts from the owner~amount~name index,
+// which also brings in coins created before balances were kept. Until it has run for
+// an account, such coins are missing from its balance, or count as negative once they
+// have been moved away.
+//
+// peer chaincode query -C myc1 -n coins -c '{"Args":["readBalance","org1msp/tom"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["compactBalances","org1msp/tom"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	balanceIndex = "balance~account~txid~coin"
+
+	// compactedRef takes the place of the coin name in the key of a folded balance.
+	compactedRef = "compacted"
+)
+
+// balanceDelta is stored under balance~account~txid~coin.
+type balanceDelta struct {
+	Coins map[string]int64 `json:"coins"` //change of the number of coins per denomination
+}
+
+type accountBalance struct {
+	Account string           `json:"account"`
+	Coins   map[string]int64 `json:"coins"`  //number of coins per denomination
+	Deltas  int              `json:"deltas"` //balance records read, compactBalances folds them into one
+}
+
+// ===================================================================================
+// putBalanceDelta records that account gained (or with a negative count, lost) coins
+// like c in this transaction
+// ===================================================================================
+func putBalanceDelta(stub shim.ChaincodeStubInterface, account string, c *coin, count int64) error {
+	deltaKey, err := stub.CreateCompositeKey(balanceIndex, []string{account, stub.GetTxID(), c.Name})
+	if err != nil {
+		return err
+	}
+	deltaJSONasBytes, err := json.Marshal(&balanceDelta{Coins: map[string]int64{c.Amount: count}})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(deltaKey, deltaJSONasBytes)
+}
+
+// ===================================================================================
+// getBalance sums the balance records of an account
+// ===================================================================================
+func getBalance(stub shim.ChaincodeStubInterface, account string) (*accountBalance, []string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(balanceIndex, []string{account})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultsIterator.Close()
+
+	balance := &accountBalance{Account: account, Coins: map[string]int64{}}
+	keys := []string{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		delta := &balanceDelta{}
+		err = json.Unmarshal(responseRange.Value, delta)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode balance record %q: %s", responseRange.Key, err)
+		}
+		for amount, count := range delta.Coins {
+			balance.Coins[amount] += count
+		}
+		keys = append(keys, responseRange.Key)
+	}
+	for amount, count := range balance.Coins {
+		if count == 0 {
+			delete(balance.Coins, amount)
+		}
+	}
+	balance.Deltas = len(keys)
+	return balance, keys, nil
+}
+
+// ============================================================
+// readBalance - number of coins an account holds per denomination
+// ============================================================
+func (t *SimpleChaincode) readBalance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "tom"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting account")
+	}
+	account := normalizeIdentity(args[0])
+	if len(account) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	balance, _, err := getBalance(stub, account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	balanceJSONasBytes, err := json.Marshal(balance)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(balanceJSONasBytes)
+}
+
+// ============================================================
+// compactBalances - admin only, fold the balance records of an account into one
+// ============================================================
+func (t *SimpleChaincode) compactBalances(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "tom"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting account")
+	}
+	account := normalizeIdentity(args[0])
+	if len(account) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	admin, err := requireAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- start compactBalances " + account)
+
+	balance, keys, err := getBalance(stub, account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the owner index is authoritative, it also holds coins older than the balances
+	held := map[string]int64{}
+	err = scanGroups(stub, ownerAmountNameIndex, []string{account}, 2, nil, func(attrs []string, count int64) error {
+		held[attrs[1]] = count
+		return nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	details := map[string]string{"deltas": strconv.Itoa(len(keys))}
+	for amount := range balance.Coins {
+		if _, ok := held[amount]; !ok {
+			held[amount] = 0
+		}
+	}
+	for amount, count := range held {
+		if count != balance.Coins[amount] {
+			details["corrected."+amount] = strconv.FormatInt(count-balance.Coins[amount], 10)
+		}
+		if count == 0 {
+			delete(held, amount)
+		}
+	}
+
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if len(held) > 0 {
+		compactedKey, err := stub.CreateCompositeKey(balanceIndex, []string{account, stub.GetTxID(), compactedRef})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		compactedJSONasBytes, err := json.Marshal(&balanceDelta{Coins: held})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(compactedKey, compactedJSONasBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = writeAudit(stub, "compactBalances", account, admin, details)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := &accountBalance{Account: account, Coins: held, Deltas: 1}
+	if len(held) == 0 {
+		result.Deltas = 0
+	}
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- end compactBalances %s (folded %d records)\n", account, len(keys))
+	return shim.Success(resultJSONasBytes)
+}
@@ -0,0 +1,241 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const balanceTestConfig = `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"]}}`
+
+func readTestBalance(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, account string) *accountBalance {
+	t.Helper()
+	balance := &accountBalance{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/admin", "readBalance", account), balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+func TestBalanceDeltas(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, balanceTestConfig)
+	for i := 0; i < 3; i++ {
+		ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", fmt.Sprintf("coin%d", i), "adollar", "org1msp/tom")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin3", "acent", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin0", "jerry")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoinsBasedOnAmount", "acent", "jerry")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "delete", "coin3")
+
+	tom := readTestBalance(t, ledger, cc, "org1msp/tom")
+	if len(tom.Coins) != 1 || tom.Coins["adollar"] != 2 || tom.Deltas != 6 {
+		t.Errorf("balance of tom is %+v", tom)
+	}
+	jerry := readTestBalance(t, ledger, cc, "jerry")
+	if len(jerry.Coins) != 1 || jerry.Coins["adollar"] != 1 || jerry.Deltas != 3 {
+		t.Errorf("balance of jerry is %+v", jerry)
+	}
+
+	if ledger.invoke(cc, "org1msp/tom", "compactBalances", "org1msp/tom").Status == shim.OK {
+		t.Errorf("compactBalances is admin only")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "compactBalances", "org1msp/tom")
+	tom = readTestBalance(t, ledger, cc, "org1msp/tom")
+	if len(tom.Coins) != 1 || tom.Coins["adollar"] != 2 || tom.Deltas != 1 {
+		t.Errorf("balance of tom after compaction is %+v", tom)
+	}
+}
+
+func TestSelfTransferKeepsBalance(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, balanceTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+
+	// both deltas of a move to the same owner would be written to one key
+	if ledger.invoke(cc, "org1msp/tom", "transferCoin", "coin1", "Org1MSP/tom").Status == shim.OK {
+		t.Errorf("transferCoin to the owner succeeded")
+	}
+	if ledger.invoke(cc, "org1msp/tom", "transferCoinsBasedOnAmount", "adollar", "org1msp/tom").Status == shim.OK {
+		t.Errorf("transferCoinsBasedOnAmount to the owner succeeded")
+	}
+	if tom := readTestBalance(t, ledger, cc, "org1msp/tom"); len(tom.Coins) != 1 || tom.Coins["adollar"] != 1 {
+		t.Errorf("balance of tom after transfers to the owner is %+v", tom)
+	}
+}
+
+func TestIdentitiesNormalized(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, balanceTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", " Org1MSP/Tom ")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin2", "acent", "org1msp/tom")
+
+	// a padded or capitalised owner is the same account as its normal form
+	if ledger.invoke(cc, "org1msp/tom", "transferCoin", "coin1", " org1msp/tom ").Status == shim.OK {
+		t.Errorf("transferCoin to the padded owner succeeded")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", " Org2MSP/Jerry ")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoinsBasedOnAmount", "acent", "Org2MSP/Jerry\t")
+	for _, name := range []string{"coin1", "coin2"} {
+		if c := readTestCoin(t, ledger, cc, name); c.Owner != "org2msp/jerry" {
+			t.Errorf("%s is owned by %q", name, c.Owner)
+		}
+	}
+	if jerry := readTestBalance(t, ledger, cc, " ORG2MSP/jerry "); jerry.Coins["adollar"] != 1 || jerry.Coins["acent"] != 1 {
+		t.Errorf("balance of jerry is %+v", jerry)
+	}
+	checkLedgerConsistency(t, ledger)
+}
+
+func TestCompactBalancesRecountsOlderCoins(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, balanceTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin2", "adollar", "org1msp/tom")
+
+	// a coin created before balances were kept has no delta
+	deltaPrefix, err := shim.CreateCompositeKey(balanceIndex, []string{"org1msp/tom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range ledger.state {
+		if strings.HasPrefix(key, deltaPrefix) && strings.HasSuffix(key, "\x00coin2\x00") {
+			delete(ledger.state, key)
+			ledger.sorted = nil
+		}
+	}
+	if tom := readTestBalance(t, ledger, cc, "org1msp/tom"); tom.Coins["adollar"] != 1 {
+		t.Fatalf("balance of tom without the delta of coin2 is %+v", tom)
+	}
+
+	ledger.mustInvoke(t, cc, "org1msp/admin", "compactBalances", "org1msp/tom")
+	if tom := readTestBalance(t, ledger, cc, "org1msp/tom"); tom.Coins["adollar"] != 2 || tom.Deltas != 1 {
+		t.Errorf("balance of tom after compaction is %+v", tom)
+	}
+}
+
+func TestConcurrentPaymentsToOneAccount(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, balanceTestConfig)
+	payments := newPaymentBlock(t, ledger, cc, 10, nil)
+
+	compaction := ledger.newStub("org1msp/admin", "compactBalances", "merchant")
+	if response := cc.Invoke(compaction); response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	valid := ledger.commit(append(payments, compaction)...)
+	for i, ok := range valid[:len(payments)] {
+		if !ok {
+			t.Errorf("payment %d was invalidated", i)
+		}
+	}
+	if valid[len(payments)] {
+		t.Errorf("compaction was not invalidated by the payments committed before it")
+	}
+	if merchant := readTestBalance(t, ledger, cc, "merchant"); merchant.Coins["adollar"] != 10 {
+		t.Errorf("balance of the merchant is %+v", merchant)
+	}
+}
+
+// newPaymentBlock creates a coin for each of n payers and endorses, against the same
+// state, a payment of each coin to the merchant. after, if not nil, runs in each
+// payment transaction after the transfer.
+func newPaymentBlock(tb testing.TB, ledger *fakeLedger, cc *SimpleChaincode, n int, after func(shim.ChaincodeStubInterface) error) []*fakeStub {
+	tb.Helper()
+	coins := make([]string, n)
+	for i := range coins {
+		coins[i] = "coin" + strconv.Itoa(ledger.txs)
+		payer := "payer" + strconv.Itoa(i)
+		ledger.mustInvoke(tb, cc, "org1msp/admin", "initCoin", coins[i], "adollar", "org1msp/"+payer)
+	}
+
+	payments := make([]*fakeStub, n)
+	for i := range payments {
+		payments[i] = ledger.newStub("org1msp/payer"+strconv.Itoa(i), "transferCoin", coins[i], "merchant")
+		if response := cc.Invoke(payments[i]); response.Status != shim.OK {
+			tb.Fatal(response.Message)
+		}
+		if after != nil {
+			err := after(payments[i])
+			if err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	return payments
+}
+
+// hotKeyBalance keeps the balance of an account under a single key, the design the
+// balance deltas replace.
+func hotKeyBalance(account string) func(shim.ChaincodeStubInterface) error {
+	return func(stub shim.ChaincodeStubInterface) error {
+		key := "hotbalance-" + account
+		balanceAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return err
+		}
+		balance := 0
+		if balanceAsBytes != nil {
+			balance, err = strconv.Atoi(string(balanceAsBytes))
+			if err != nil {
+				return err
+			}
+		}
+		return stub.PutState(key, []byte(strconv.Itoa(balance+1)))
+	}
+}
+
+// benchmarkPayments commits blocks of concurrent payments to one merchant and reports
+// the share of the payments that were valid.
+func benchmarkPayments(b *testing.B, blockSize int, after func(shim.ChaincodeStubInterface) error) {
+	ledger, cc := newFakeChaincode(b, balanceTestConfig)
+	committed := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		payments := newPaymentBlock(b, ledger, cc, blockSize, after)
+		b.StartTimer()
+		for _, ok := range ledger.commit(payments...) {
+			if ok {
+				committed++
+			}
+		}
+	}
+	b.ReportMetric(float64(committed)/float64(b.N*blockSize), "valid/payment")
+	b.ReportMetric(float64(committed)/float64(b.N), "payments/block")
+}
+
+func BenchmarkPaymentsBalanceDeltas(b *testing.B) {
+	for _, blockSize := range []int{10, 50} {
+		b.Run(fmt.Sprintf("block=%d", blockSize), func(b *testing.B) {
+			benchmarkPayments(b, blockSize, nil)
+		})
+	}
+}
+
+func BenchmarkPaymentsSingleBalanceKey(b *testing.B) {
+	for _, blockSize := range []int{10, 50} {
+		b.Run(fmt.Sprintf("block=%d", blockSize), func(b *testing.B) {
+			benchmarkPayments(b, blockSize, hotKeyBalance("merchant"))
+		})
+	}
+}
@@ -20,21 +20,26 @@ under the License.
 // ====CHAINCODE EXECUTION SAMPLES (CLI) ==================
 
 // ==== Invoke coins ====
-// peer chaincode invoke -C myc1 -n coins -c '{"Args":["initCoin","coin1","blue","35","tom"]}'
-// peer chaincode invoke -C myc1 -n coins -c '{"Args":["initCoin","coin2","red","50","tom"]}'
-// peer chaincode invoke -C myc1 -n coins -c '{"Args":["initCoin","coin3","blue","70","tom"]}'
-// peer chaincode invoke -C myc1 -n coins -c '{"Args":["transferCoin","coin2","jerry"]}'
-// peer chaincode invoke -C myc1 -n coins -c '{"Args":["transferCoinsBasedOnColor","blue","jerry"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["initLedger"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["initCoin","coin11","aCent","org1msp/tom"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["initCoin","coin12","aDollar","org1msp/tom"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["initCoin","coin13","aCent","org1msp/tom"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["transferCoin","coin12","org2msp/jerry"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["transferCoinsBasedOnAmount","acent","org2msp/jerry"]}'
 // peer chaincode invoke -C myc1 -n coins -c '{"Args":["delete","coin1"]}'
 
 // ==== Query coins ====
 // peer chaincode query -C myc1 -n coins -c '{"Args":["readCoin","coin1"]}'
 // peer chaincode query -C myc1 -n coins -c '{"Args":["getCoinsByRange","coin1","coin3"]}'
 // peer chaincode query -C myc1 -n coins -c '{"Args":["getHistoryForCoin","coin1"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["getHistoryForCoin","coin1","{\"counterparty\":\"org1msp/tom\",\"from\":\"2024-01-01T00:00:00Z\"}"]}'
+// The queries return a page of results bounded in size, see results.go for the options.
 
 // Rich Query (Only supported if CouchDB is used as state database):
-//   peer chaincode query -C myc1 -n coins -c '{"Args":["queryCoinsByOwner","tom"]}'
-//   peer chaincode query -C myc1 -n coins -c '{"Args":["queryCoins","{\"selector\":{\"owner\":\"tom\"}}"]}'
+//   peer chaincode query -C myc1 -n coins -c '{"Args":["queryCoinsByOwner","org1msp/tom"]}'
+//   peer chaincode query -C myc1 -n coins -c '{"Args":["queryCoins","{\"selector\":{\"owner\":\"org1msp/tom\"}}"]}'
+//   peer chaincode query -C myc1 -n coins -c '{"Args":["searchCoins","{\"owner\":\"org1msp/tom\",\"sort\":\"createdAt\",\"order\":\"desc\",\"limit\":20}"]}'
+// queryCoins is only available while the adHocQueries feature is enabled.
 
 // INDEXES TO SUPPORT COUCHDB RICH QUERIES
 //
@@ -45,8 +50,10 @@ under the License.
 // CouchDB index JSON syntax as documented at:
 // http://docs.couchdb.org/en/2.1.1/api/database/find.html#db-index
 //
-// This coins02 example chaincode demonstrates a packaged
-// index which you can find in META-INF/statedb/couchdb/indexes/indexOwner.json.
+// This chaincode packages an index for every query it issues, in
+// META-INF/statedb/couchdb/indexes: indexOwner, indexAmount, indexName and indexCreatedAt,
+// each on docType and one coin field. indexes_test.go checks that they cover the queries
+// built by queryCoinsByOwner and searchCoins.
 // For deployment of chaincode to production environments, it is recommended
 // to define any indexes alongside chaincode so that the chaincode and supporting indexes
 // are deployed automatically as a unit, once the chaincode has been installed on a peer and
@@ -59,9 +66,10 @@ under the License.
 // chaincode in the META-INF/statedb/couchdb/indexes directory, for packaging and deployment
 // to managed environments.
 //
-// In the examples below you can find index definitions that support coins02
-// chaincode queries, along with the syntax that you can use in development environments
-// to create the indexes in the CouchDB Fauxton interface or a curl command line utility.
+// In the examples below you can find the definition of indexOwner, along with the syntax
+// that you can use in development environments to create the indexes in the CouchDB
+// Fauxton interface or a curl command line utility. The other indexes follow the same
+// pattern.
 //
 
 //Example hostname:port configurations to access CouchDB.
@@ -82,49 +90,62 @@ under the License.
 // curl -i -X POST -H "Content-Type: application/json" -d "{\"index\":{\"fields\":[\"data.docType\",\"data.owner\"]},\"name\":\"indexOwner\",\"ddoc\":\"indexOwnerDoc\",\"type\":\"json\"}" http://hostname:port/myc1_coins/_index
 //
 
-// Index for docType, owner, size (descending order).
-// Note that docType, owner and size fields must be prefixed with the "data" wrapper
-//
-// Index definition for use with Fauxton interface
-// {"index":{"fields":[{"data.size":"desc"},{"data.docType":"desc"},{"data.owner":"desc"}]},"ddoc":"indexSizeSortDoc", "name":"indexSizeSortDesc","type":"json"}
-//
-// Example curl command line to define index in the CouchDB channel_chaincode database
-// curl -i -X POST -H "Content-Type: application/json" -d "{\"index\":{\"fields\":[{\"data.size\":\"desc\"},{\"data.docType\":\"desc\"},{\"data.owner\":\"desc\"}]},\"ddoc\":\"indexSizeSortDoc\", \"name\":\"indexSizeSortDesc\",\"type\":\"json\"}" http://hostname:port/myc1_coins/_index
-
 // Rich Query with index design doc and index name specified (Only supported if CouchDB is used as state database):
-//   peer chaincode query -C myc1 -n coins -c '{"Args":["queryCoins","{\"selector\":{\"docType\":\"coin\",\"owner\":\"tom\"}, \"use_index\":[\"_design/indexOwnerDoc\", \"indexOwner\"]}"]}'
+//   peer chaincode query -C myc1 -n coins -c '{"Args":["queryCoins","{\"selector\":{\"docType\":\"coin\",\"owner\":\"org1msp/tom\"}, \"use_index\":[\"_design/indexOwnerDoc\", \"indexOwner\"]}"]}'
 
-// Rich Query with index design doc specified only (Only supported if CouchDB is used as state database):
-//   peer chaincode query -C myc1 -n coins -c '{"Args":["queryCoins","{\"selector\":{\"docType\":{\"$eq\":\"coin\"},\"owner\":{\"$eq\":\"tom\"},\"size\":{\"$gt\":0}},\"fields\":[\"docType\",\"owner\",\"size\"],\"sort\":[{\"size\":\"desc\"}],\"use_index\":\"_design/indexSizeSortDoc\"}"]}'
+// Rich Query with a sort, which needs an index on the sorted fields (Only supported if CouchDB is used as state database):
+//   peer chaincode query -C myc1 -n coins -c '{"Args":["queryCoins","{\"selector\":{\"docType\":{\"$eq\":\"coin\"},\"createdAt\":{\"$gt\":\"2024-01-01T00:00:00Z\"}},\"sort\":[{\"docType\":\"desc\"},{\"createdAt\":\"desc\"}],\"use_index\":\"_design/indexCreatedAtDoc\"}"]}'
 
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"strconv"
+	"os"
 	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
 )
 
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
 }
 
+const coinObjectType = "coin"
+
 type coin struct {
-	Name	string `json:"Name"`
-	Amount       string `json:"amount"`    //the fieldtags are needed to keep case from bouncing around
-	Owner      string `json:"owner"`
+	ObjectType  string        `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Name        string        `json:"Name"`
+	Amount      string        `json:"amount"` //the fieldtags are needed to keep case from bouncing around
+	Owner       string        `json:"owner"`
+	CreatedAt   string        `json:"createdAt,omitempty"`   //RFC3339, empty for coins created before it was recorded
+	LockedUntil string        `json:"lockedUntil,omitempty"` //RFC3339, the coin cannot move or be deleted before
+	Memo        *transferMemo `json:"memo,omitempty"`        //memo of the transfer to the current owner
 }
 
+// errInvalidCoin is returned for a stored coin that decodes but cannot be used.
+var errInvalidCoin = errors.New("invalid coin")
+
 // ===================================================================================
 // Main
 // ===================================================================================
 func main() {
+	// When CHAINCODE_SERVER_ADDRESS is set the chaincode runs as an external
+	// service (chaincode-as-a-service) and the peer connects to it, otherwise
+	// it is launched by the peer as usual.
+	if address := os.Getenv("CHAINCODE_SERVER_ADDRESS"); address != "" {
+		err := startChaincodeServer(address)
+		if err != nil {
+			fmt.Printf("Error starting Simple chaincode server: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	err := shim.Start(new(SimpleChaincode))
 	if err != nil {
 		fmt.Printf("Error starting Simple chaincode: %s", err)
@@ -132,9 +153,11 @@ func main() {
 }
 
 // Init initializes chaincode
+// Init optionally takes the chaincode configuration as a JSON document, see config.go
 // ===========================
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
-	return shim.Success(nil)
+	_, args := stub.GetFunctionAndParameters()
+	return t.initConfig(stub, args)
 }
 
 // Invoke - Our entry point for Invocations
@@ -143,13 +166,21 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 	fmt.Println("invoke is running " + function)
 
+	// Arguments end up in error messages, JSON documents and composite keys, all of
+	// which need valid UTF-8
+	if !validUTF8(function, args) {
+		return shim.Error("Function name and arguments must be valid UTF-8")
+	}
+
 	// Handle different functions
 	if function == "initCoin" { //create a new coin
 		return t.initCoin(stub, args)
 	} else if function == "initLedger" {
-		return s.initLedger(APIstub)
+		return t.initLedger(stub)
 	} else if function == "transferCoin" { //change owner of a specific coin
 		return t.transferCoin(stub, args)
+	} else if function == "transferCoinsBasedOnAmount" { //transfer all coins of a certain amount
+		return t.transferCoinsBasedOnAmount(stub, args)
 	} else if function == "delete" { //delete a coin
 		return t.delete(stub, args)
 	} else if function == "readCoin" { //read a coin
@@ -162,6 +193,124 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.getHistoryForCoin(stub, args)
 	} else if function == "getCoinsByRange" { //get coins based on range query
 		return t.getCoinsByRange(stub, args)
+	} else if function == "updateConfig" { //change the chaincode configuration
+		return t.updateConfig(stub, args)
+	} else if function == "readConfig" { //read the chaincode configuration
+		return t.readConfig(stub, args)
+	} else if function == "getConfigHistory" { //get all versions of the chaincode configuration
+		return t.getConfigHistory(stub, args)
+	} else if function == "rebuildIndexes" { //add coins created before an index existed to it
+		return t.rebuildIndexes(stub, args)
+	} else if function == "registerDenomination" { //add a denomination to the registry
+		return t.registerDenomination(stub, args)
+	} else if function == "setDenominationActive" { //activate or retire a denomination
+		return t.setDenominationActive(stub, args)
+	} else if function == "readDenomination" { //read a denomination from the registry
+		return t.readDenomination(stub, args)
+	} else if function == "listDenominations" { //list all registered denominations
+		return t.listDenominations(stub, args)
+	} else if function == "convert" { //convert a quantity between denominations
+		return t.convert(stub, args)
+	} else if function == "valueOfOwner" { //total value of the coins of an owner
+		return t.valueOfOwner(stub, args)
+	} else if function == "mint" { //create a coin, minters only
+		return t.mint(stub, args)
+	} else if function == "burn" { //destroy a coin, minters only
+		return t.burn(stub, args)
+	} else if function == "readSupply" { //read the supply counters of a denomination
+		return t.readSupply(stub, args)
+	} else if function == "supplyReport" { //reconcile supply counters against the coins
+		return t.supplyReport(stub, args)
+	} else if function == "getAuditTrail" { //get audit records of an action
+		return t.getAuditTrail(stub, args)
+	} else if function == "approve" { //allow a spender to transfer one coin
+		return t.approve(stub, args)
+	} else if function == "setOperator" { //allow an operator to transfer all coins of an owner
+		return t.setOperator(stub, args)
+	} else if function == "transferFrom" { //transfer a coin on behalf of its owner
+		return t.transferFrom(stub, args)
+	} else if function == "getApprovalsGrantedBy" { //approvals and operators granted by an identity
+		return t.getApprovalsGrantedBy(stub, args)
+	} else if function == "getApprovalsGrantedTo" { //approvals and operators granted to an identity
+		return t.getApprovalsGrantedTo(stub, args)
+	} else if function == "createMultisig" { //create an M-of-N multisig account
+		return t.createMultisig(stub, args)
+	} else if function == "proposeTransfer" { //propose a transfer of a multisig owned coin
+		return t.proposeTransfer(stub, args)
+	} else if function == "approveProposal" { //approve a transfer proposal
+		return t.approveProposal(stub, args)
+	} else if function == "cancelProposal" { //withdraw a transfer proposal
+		return t.cancelProposal(stub, args)
+	} else if function == "readMultisig" { //read a multisig account
+		return t.readMultisig(stub, args)
+	} else if function == "readProposal" { //read a transfer proposal
+		return t.readProposal(stub, args)
+	} else if function == "getProposalHistory" { //get all transfer proposals of a coin
+		return t.getProposalHistory(stub, args)
+	} else if function == "freezeAccount" { //freeze an identity
+		return t.freezeAccount(stub, args)
+	} else if function == "unfreezeAccount" { //lift the freeze of an identity
+		return t.unfreezeAccount(stub, args)
+	} else if function == "addSanction" { //put an identity on the sanctions list
+		return t.addSanction(stub, args)
+	} else if function == "removeSanction" { //take an identity off the sanctions list
+		return t.removeSanction(stub, args)
+	} else if function == "readComplianceStatus" { //freeze and sanctions entries of an identity
+		return t.readComplianceStatus(stub, args)
+	} else if function == "forceTransfer" { //move a coin by regulator order
+		return t.forceTransfer(stub, args)
+	} else if function == "clawback" { //recover a coin to the recovery account by regulator order
+		return t.clawback(stub, args)
+	} else if function == "getRegulatoryActions" { //get regulator actions on a coin
+		return t.getRegulatoryActions(stub, args)
+	} else if function == "lockCoin" { //lock a coin until a given time
+		return t.lockCoin(stub, args)
+	} else if function == "grantVesting" { //put a vesting schedule on the coins of an owner
+		return t.grantVesting(stub, args)
+	} else if function == "vestingStatus" { //locked and releasable coins of an owner
+		return t.vestingStatus(stub, args)
+	} else if function == "setTransferLimit" { //set the transfer limits of an identity
+		return t.setTransferLimit(stub, args)
+	} else if function == "transferHeadroom" { //remaining transfer limits of an identity
+		return t.transferHeadroom(stub, args)
+	} else if function == "offerTransfer" { //offer a coin to a recipient
+		return t.offerTransfer(stub, args)
+	} else if function == "acceptTransfer" { //accept an offered coin
+		return t.acceptTransfer(stub, args)
+	} else if function == "rejectTransfer" { //refuse an offered coin
+		return t.rejectTransfer(stub, args)
+	} else if function == "cancelOffer" { //withdraw an offer
+		return t.cancelOffer(stub, args)
+	} else if function == "listOffers" { //incoming and outgoing offers of an identity
+		return t.listOffers(stub, args)
+	} else if function == "getTransfersByReference" { //find transfers by memo reference
+		return t.getTransfersByReference(stub, args)
+	} else if function == "stateAsOf" { //coins as they were at a given time
+		return t.stateAsOf(stub, args)
+	} else if function == "ownerHoldingsAsOf" { //coins of an owner at a given time
+		return t.ownerHoldingsAsOf(stub, args)
+	} else if function == "searchCoins" { //find coins with a filter compiled to a rich query
+		return t.searchCoins(stub, args)
+	} else if function == "countCoins" { //number of coins per owner and/or denomination
+		return t.countCoins(stub, args)
+	} else if function == "holdingsSummary" { //owners ranked by value, with totals per denomination
+		return t.holdingsSummary(stub, args)
+	} else if function == "readBalance" { //number of coins an account holds per denomination
+		return t.readBalance(stub, args)
+	} else if function == "compactBalances" { //fold the balance records of an account into one
+		return t.compactBalances(stub, args)
+	} else if function == "compactSupply" { //fold the supply records of a denomination into one
+		return t.compactSupply(stub, args)
+	} else if function == "reapplyEndorsementPolicies" { //bring the key-level endorsement policies of coins in line with the config
+		return t.reapplyEndorsementPolicies(stub, args)
+	} else if function == "stake" { //put coins into the staking pool
+		return t.stake(stub, args)
+	} else if function == "unstake" { //take coins out of the staking pool after the unbonding period
+		return t.unstake(stub, args)
+	} else if function == "claimRewards" { //mint the staking rewards of the caller
+		return t.claimRewards(stub, args)
+	} else if function == "poolInfo" { //the staking pool and the position of an owner
+		return t.poolInfo(stub, args)
 	}
 
 	fmt.Println("invoke did not find func: " + function) //error
@@ -174,7 +323,7 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 func (t *SimpleChaincode) initCoin(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 
-	//   0       1       2  
+	//   0       1       2
 	// "coin1",  "aCent",   "bob"
 	if len(args) != 3 {
 		return shim.Error("Incorrect number of arguments. Expecting 3")
@@ -192,85 +341,342 @@ func (t *SimpleChaincode) initCoin(stub shim.ChaincodeStubInterface, args []stri
 		return shim.Error("3rd argument must be a non-empty string")
 	}
 	coinName := args[0]
-	owner := strings.ToLower(args[2])
+	owner := normalizeIdentity(args[2])
 	amount := strings.ToLower(args[1])
 
-
-	// ==== Check if coin already exists ====
-	coinAsBytes, err := stub.GetState(coinName)
+	config, err := getConfig(stub)
 	if err != nil {
-		return shim.Error("Failed to get coin: " + err.Error())
-	} else if coinAsBytes != nil {
-		fmt.Println("This coin already exists: " + coinName)
-		return shim.Error("This coin already exists: " + coinName)
+		return shim.Error(err.Error())
 	}
-
-	// ==== Create coin object and marshal to JSON ====
-	//objectType := "coin"
-	coin := &coin{coinName, amount , owner}
-	coinJSONasBytes, err := json.Marshal(coin)
+	issuer, err := issuingIdentity(stub, config)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	//Alternatively, build the coin json string manually if you don't want to use struct marshalling
-	//coinJSONasString := `{"docType":"Coin",  "name": "` + coinName + `", "amount": ` + strconv.Itoa(amount) + `, "owner": "` + owner + `"}`
-	//coinJSONasBytes := []byte(str)
 
-	// === Save coin to state ===
-	err = stub.PutState(coinName, coinJSONasBytes)
+	_, err = createCoin(stub, coinName, amount, owner)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	//  ==== Index the coin to enable color-based range queries, e.g. return all blue coins ====
-	//  An 'index' is a normal key/value entry in state.
-	//  The key is a composite key, with the elements that you want to range query on listed first.
-	//  In our case, the composite key is based on indexName~color~name.
-	//  This will enable very efficient state range queries based on composite keys matching indexName~color~*
-	indexName := "amount~name"
-	amountNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{coin.Amount, coin.Name})
+	err = writeAudit(stub, "initCoin", coinName, issuer, map[string]string{"amount": amount, "owner": owner})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the coin.
-	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-	value := []byte{0x00}
-	stub.PutState(amountNameIndexKey, value)
 
 	// ==== Coin saved and indexed. Return success ====
 	fmt.Println("- end init coin")
 	return shim.Success(nil)
 }
-	//   0       1       2  
-	// "coin1",  "aCent",   "bob"
 
+// ===================================================================================
+// createCoin stores and indexes a new coin and counts it in the circulating supply,
+// shared by initCoin and mint.
+// ===================================================================================
+func createCoin(stub shim.ChaincodeStubInterface, coinName string, amount string, owner string) (*coin, error) {
+	coins, err := createCoins(stub, []string{coinName}, amount, owner)
+	if err != nil {
+		return nil, err
+	}
+	return coins[0], nil
+}
 
-func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface) sc.Response {
-	coin := []Coin{
-		Coin{Name: "coin1", Amount: "aCent", Owner: "Miriam"},
-		Coin{Name: "coin2", Amount: "aDollar", Owner: "Dave"},
-		Coin{Name: "coin3", Amount: "aCent", Owner: "Igor"},
-		Coin{Name: "coin4", Amount: "aCent", Owner: "Amalea"},
-		Coin{Name: "coin5", Amount: "aDollar", Owner: "Rafa"},
-		Coin{Name: "coin6", Amount: "aDollar", Owner: "Shen"},
-		Coin{Name: "coin7", Amount: "aCent", Owner: "Leila"},
-		Coin{Name: "coin8", Amount: "aDollar", Owner: "Yuan"},
-		Coin{Name: "coin9", Amount: "aCent", Owner: "Carlo"},
-		Coin{Name: "coin10", Amount: "aDollar", Owner: "Fatima"},
+// ===================================================================================
+// createCoins stores and indexes new coins of one amount and owner and counts them in
+// the circulating supply. It is the only place coins come into existence. Reads do not
+// see the writes of the transaction, so the supply is adjusted once for all of them.
+// ===================================================================================
+func createCoins(stub shim.ChaincodeStubInterface, coinNames []string, amount string, owner string) ([]*coin, error) {
+	// the name, amount and owner are attributes of the index keys
+	for _, value := range append([]string{amount, owner}, coinNames...) {
+		if !validKeyAttribute(value) {
+			return nil, fmt.Errorf("coin name, amount and owner must be non-empty and must not contain U+0000 or U+10FFFF: %q", value)
+		}
 	}
 
-	i := 0
-	for i < len(coin) {
-		fmt.Println("i is ", i)
-		coinAsBytes, _ := json.Marshal(coin[i])
-		APIstub.PutState(strconv.Itoa(i+1), coinAsBytes)
-		fmt.Println("Added", coin[i])
-		i = i + 1
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !config.denominationAllowed(amount) {
+		return nil, fmt.Errorf("Denomination is not allowed: %s", amount)
+	}
+	_, err = getActiveDenomination(stub, amount)
+	if err != nil {
+		return nil, err
+	}
+	err = checkCompliance(stub, owner)
+	if err != nil {
+		return nil, err
+	}
+	err = checkMultisigOwner(stub, owner)
+	if err != nil {
+		return nil, err
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
 	}
 
-	return shim.Success(nil)
+	coins := make([]*coin, 0, len(coinNames))
+	created := map[string]bool{}
+	for _, coinName := range coinNames {
+		if strings.HasPrefix(coinName, "\x00") {
+			return nil, fmt.Errorf("coin name must not start with a null character, these keys are reserved")
+		}
+
+		// ==== Check if coin already exists ====
+		coinAsBytes, err := stub.GetState(coinName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get coin: %s", err)
+		} else if coinAsBytes != nil || created[coinName] {
+			fmt.Println("This coin already exists: " + coinName)
+			return nil, fmt.Errorf("This coin already exists: %s", coinName)
+		}
+		created[coinName] = true
+
+		// ==== Create coin object and marshal to JSON ====
+		//objectType := "coin"
+		coin := &coin{ObjectType: coinObjectType, Name: coinName, Amount: amount, Owner: owner, CreatedAt: txTime.Format(time.RFC3339)}
+		coinJSONasBytes, err := json.Marshal(coin)
+		if err != nil {
+			return nil, err
+		}
+		//Alternatively, build the coin json string manually if you don't want to use struct marshalling
+		//coinJSONasString := `{"docType":"Coin",  "name": "` + coinName + `", "amount": ` + strconv.Itoa(amount) + `, "owner": "` + owner + `"}`
+		//coinJSONasBytes := []byte(str)
+
+		// === Save coin to state ===
+		err = stub.PutState(coinName, coinJSONasBytes)
+		if err != nil {
+			return nil, err
+		}
+		err = setCoinEndorsement(stub, coin)
+		if err != nil {
+			return nil, err
+		}
+
+		//  ==== Index the coin to enable amount-based range queries, e.g. return all acent coins ====
+		//  An 'index' is a normal key/value entry in state.
+		//  The key is a composite key, with the elements that you want to range query on listed first.
+		//  In our case, the composite keys are based on indexName~amount~name and indexName~owner~amount~name.
+		//  This will enable very efficient state range queries based on composite keys matching indexName~amount~*
+		err = putIndexEntries(stub, coin, amountNameIndex, ownerAmountNameIndex)
+		if err != nil {
+			return nil, err
+		}
+		err = putBalanceDelta(stub, owner, coin, 1)
+		if err != nil {
+			return nil, err
+		}
+		err = registerCoin(stub, coinName)
+		if err != nil {
+			return nil, err
+		}
+		coins = append(coins, coin)
+	}
+
+	if len(coins) > 0 {
+		err = adjustSupply(stub, config, coins[0], int64(len(coins)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return coins, nil
+}
+
+// ===========================================================================================
+// Index helpers. Every index is keyed by a composite key that ends with the coin name.
+// Only the key is needed, so the value is a null character - passing a 'nil' value
+// would effectively delete the key from state.
+// ===========================================================================================
+const (
+	amountNameIndex      = "amount~name"
+	ownerAmountNameIndex = "owner~amount~name"
+)
+
+// indexKey returns the composite key of c in the named index.
+func indexKey(stub shim.ChaincodeStubInterface, indexName string, c *coin) (string, error) {
+	switch indexName {
+	case amountNameIndex:
+		return stub.CreateCompositeKey(indexName, []string{c.Amount, c.Name})
+	case ownerAmountNameIndex:
+		return stub.CreateCompositeKey(indexName, []string{c.Owner, c.Amount, c.Name})
+	}
+	return "", fmt.Errorf("unknown index: %s", indexName)
+}
+
+// putIndexEntries adds c to each of the named indexes.
+func putIndexEntries(stub shim.ChaincodeStubInterface, c *coin, indexNames ...string) error {
+	for _, indexName := range indexNames {
+		key, err := indexKey(stub, indexName, c)
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(key, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delIndexEntries removes c from each of the named indexes.
+func delIndexEntries(stub shim.ChaincodeStubInterface, c *coin, indexNames ...string) error {
+	for _, indexName := range indexNames {
+		key, err := indexKey(stub, indexName, c)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ===========================================================================================
+// rebuildIndexes - admin only, walk one page of the amount~name index and (re)create the
+// remaining index entries of each coin, including its coinreg~name entry. Used after an
+// upgrade that adds an index, for coins created before it existed. Returns the bookmark
+// of the next page, the index key to start it at, empty after the last page.
+// ===========================================================================================
+func (t *SimpleChaincode) rebuildIndexes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1
+	// "100", "bookmark"
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting page size and optional bookmark")
+	}
+
+	_, err := requireAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pageSize, err := config.pageSize(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+
+	// paginated queries are not allowed in transactions that write, and range queries
+	// cannot start inside the composite keys, so the entries before the bookmark are
+	// skipped and the page is cut off by hand
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(amountNameIndex, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	processed := 0
+	nextBookmark := ""
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if responseRange.Key < bookmark {
+			continue
+		}
+		if processed == int(pageSize) {
+			nextBookmark = responseRange.Key
+			break
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(compositeKeyParts) != 2 {
+			return shim.Error(fmt.Sprintf("malformed %s index entry: %q", amountNameIndex, responseRange.Key))
+		}
+		coinName := compositeKeyParts[1]
+
+		processed++
+
+		coinAsBytes, err := stub.GetState(coinName)
+		if err != nil {
+			return shim.Error("Failed to get coin:" + err.Error())
+		} else if coinAsBytes == nil {
+			continue
+		}
+		coinJSON, err := decodeCoin(coinName, coinAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		// coins created before docType was stored are invisible to rich queries
+		if coinJSON.ObjectType != coinObjectType {
+			coinJSON.ObjectType = coinObjectType
+			coinAsBytes, err = json.Marshal(coinJSON)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			err = stub.PutState(coinName, coinAsBytes)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		err = putIndexEntries(stub, coinJSON, ownerAmountNameIndex)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = registerCoin(stub, coinName)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	responsePayload, err := json.Marshal(map[string]interface{}{"processed": processed, "bookmark": nextBookmark})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- end rebuildIndexes: " + string(responsePayload))
+	return shim.Success(responsePayload)
 }
 
+// ============================================================
+// initLedger - seed the ledger with a set of sample coins
+// ============================================================
+func (t *SimpleChaincode) initLedger(stub shim.ChaincodeStubInterface) pb.Response {
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !config.featureEnabled(featureInitLedger) {
+		return shim.Error("initLedger is disabled by configuration")
+	}
+
+	// the owners are identities, "<mspid>/<common name>", so that they can move their coins
+	coins := []coin{
+		coin{Name: "coin1", Amount: "aCent", Owner: "org1msp/miriam"},
+		coin{Name: "coin2", Amount: "aDollar", Owner: "org2msp/dave"},
+		coin{Name: "coin3", Amount: "aCent", Owner: "org1msp/igor"},
+		coin{Name: "coin4", Amount: "aCent", Owner: "org2msp/amalea"},
+		coin{Name: "coin5", Amount: "aDollar", Owner: "org1msp/rafa"},
+		coin{Name: "coin6", Amount: "aDollar", Owner: "org2msp/shen"},
+		coin{Name: "coin7", Amount: "aCent", Owner: "org1msp/leila"},
+		coin{Name: "coin8", Amount: "aDollar", Owner: "org2msp/yuan"},
+		coin{Name: "coin9", Amount: "aCent", Owner: "org1msp/carlo"},
+		coin{Name: "coin10", Amount: "aDollar", Owner: "org2msp/fatima"},
+	}
+
+	for i := 0; i < len(coins); i++ {
+		// Re-use initCoin so that the seeded coins are normalized and indexed
+		// exactly like coins created by clients.
+		response := t.initCoin(stub, []string{coins[i].Name, coins[i].Amount, coins[i].Owner})
+		if response.Status != shim.OK {
+			return shim.Error("Failed to add " + coins[i].Name + ": " + response.Message)
+		}
+		fmt.Println("Added", coins[i])
+	}
+
+	return shim.Success(nil)
+}
 
 // ===============================================
 // readCoin - read a coin from chaincode state
@@ -296,53 +702,138 @@ func (t *SimpleChaincode) readCoin(stub shim.ChaincodeStubInterface, args []stri
 	return shim.Success(valAsbytes)
 }
 
-
-
 // ==================================================
 // delete - remove a coin key/value pair from state
 // ==================================================
 func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var jsonResp string
-	var coinJSON coin
 	if len(args) != 1 {
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 	coinName := args[0]
 
-	// to maintain the color~name index, we need to read the coin first and get its color
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	issuer, err := issuingIdentity(stub, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	coinToDelete, err := getCoin(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if id, ok := multisigID(coinToDelete.Owner); ok {
+		return shim.Error(coinName + " is owned by multisig account " + id + " and cannot be deleted")
+	}
+	err = checkLocks(stub, coinToDelete, 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkNoPendingOffer(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = destroyCoin(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = writeAudit(stub, "delete", coinName, issuer, map[string]string{"amount": coinToDelete.Amount, "owner": coinToDelete.Owner})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// ===================================================================================
+// issuingIdentity returns the caller of initCoin or delete, who must hold the minter
+// role while restrictIssuance is switched on, and must not be sanctioned or frozen
+// ===================================================================================
+func issuingIdentity(stub shim.ChaincodeStubInterface, config *chaincodeConfig) (string, error) {
+	var issuer string
+	var err error
+	if config.featureEnabled(featureRestrictIssuance) {
+		issuer, err = requireRole(stub, roleMinter)
+	} else {
+		issuer, err = callerIdentity(stub)
+	}
+	if err != nil {
+		return "", err
+	}
+	err = checkCompliance(stub, issuer)
+	if err != nil {
+		return "", err
+	}
+	return issuer, nil
+}
+
+// ===================================================================================
+// destroyCoin removes a coin and its index entries and takes it out of the
+// circulating supply. Shared by delete and burn.
+// ===================================================================================
+func destroyCoin(stub shim.ChaincodeStubInterface, coinName string) (*coin, error) {
+	var jsonResp string
+
+	// to maintain the amount~name index, we need to read the coin first and get its amount
 	valAsbytes, err := stub.GetState(coinName) //get the coin from chaincode state
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + coinName + "\"}"
-		return shim.Error(jsonResp)
+		return nil, errors.New(jsonResp)
 	} else if valAsbytes == nil {
 		jsonResp = "{\"Error\":\"Coin does not exist: " + coinName + "\"}"
-		return shim.Error(jsonResp)
+		return nil, errors.New(jsonResp)
 	}
 
-	err = json.Unmarshal([]byte(valAsbytes), &coinJSON)
+	coinJSON, err := decodeCoin(coinName, valAsbytes)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to decode JSON of: " + coinName + "\"}"
-		return shim.Error(jsonResp)
+		return nil, err
+	}
+	err = checkCompliance(stub, coinJSON.Owner)
+	if err != nil {
+		return nil, err
 	}
 
 	err = stub.DelState(coinName) //remove the coin from chaincode state
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return nil, fmt.Errorf("Failed to delete state:%s", err)
 	}
 
-	// maintain the index
-	indexName := "amount~name"
-	amountNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{coinJSON.Amount, coinJSON.Name})
+	// maintain the indexes
+	err = delIndexEntries(stub, coinJSON, amountNameIndex, ownerAmountNameIndex)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, fmt.Errorf("Failed to delete state:%s", err)
+	}
+	err = putBalanceDelta(stub, coinJSON.Owner, coinJSON, -1)
+	if err != nil {
+		return nil, err
+	}
+	err = clearApproval(stub, coinName)
+	if err != nil {
+		return nil, err
+	}
+	err = clearOffer(stub, coinName)
+	if err != nil {
+		return nil, err
+	}
+	err = releaseStake(stub, coinJSON)
+	if err != nil {
+		return nil, err
+	}
+	err = voidProposals(stub, coinJSON)
+	if err != nil {
+		return nil, err
 	}
 
-	//  Delete index entry to state.
-	err = stub.DelState(amountNameIndexKey)
+	config, err := getConfig(stub)
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return nil, err
 	}
-	return shim.Success(nil)
+	err = adjustSupply(stub, config, coinJSON, -1)
+	if err != nil {
+		return nil, err
+	}
+	return coinJSON, nil
 }
 
 // ===========================================================
@@ -350,38 +841,221 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 // ===========================================================
 func (t *SimpleChaincode) transferCoin(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0       1
-	// "name", "bob"
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	//   0       1              2
+	// "name", "bob", "{\"reference\":\"INV-2024-0042\"}"
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting name, new owner and optional memo")
 	}
 
 	coinName := args[0]
-	newOwner := strings.ToLower(args[1])
+	newOwner := normalizeIdentity(args[1])
 	fmt.Println("- start transferCoin ", coinName, newOwner)
 
+	opts := transferOptions{}
+	if len(args) == 3 {
+		memo, err := parseMemo(args[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		opts.Memo = memo
+	}
+
+	err := transferOwnedCoin(stub, coinName, newOwner, opts)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end transferCoin (success)")
+	return shim.Success(nil)
+}
+
+// ===================================================================================
+// transferOwnedCoin moves a coin on behalf of its owner, who has to be the caller;
+// anybody else needs an approval and transferFrom. Shared by transferCoin and
+// transferCoinsBasedOnAmount.
+// ===================================================================================
+func transferOwnedCoin(stub shim.ChaincodeStubInterface, coinName string, newOwner string, opts transferOptions) error {
+	coinToTransfer, err := getCoin(stub, coinName)
+	if err != nil {
+		return err
+	}
+	if id, ok := multisigID(coinToTransfer.Owner); ok {
+		return fmt.Errorf("%s is owned by multisig account %s, use proposeTransfer", coinName, id)
+	}
+
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return err
+	}
+	if caller != coinToTransfer.Owner {
+		return fmt.Errorf("Only the owner can transfer %s, use transferFrom when approved", coinName)
+	}
+
+	return moveCoin(stub, coinToTransfer, newOwner, opts)
+}
+
+// ===================================================================================
+// getCoin reads a coin from chaincode state
+// ===================================================================================
+func getCoin(stub shim.ChaincodeStubInterface, coinName string) (*coin, error) {
 	coinAsBytes, err := stub.GetState(coinName)
 	if err != nil {
-		return shim.Error("Failed to get coin:" + err.Error())
+		return nil, fmt.Errorf("Failed to get coin:%s", err)
 	} else if coinAsBytes == nil {
-		return shim.Error("Coin does not exist")
+		return nil, fmt.Errorf("Coin does not exist: %s", coinName)
 	}
 
-	coinToTransfer := coin{}
-	err = json.Unmarshal(coinAsBytes, &coinToTransfer) //unmarshal it aka JSON.parse()
+	return decodeCoin(coinName, coinAsBytes)
+}
+
+// ===================================================================================
+// decodeCoin decodes the coin stored under key. Stored coins are not trusted: the name
+// has to match the key, and amount and owner have to be usable in the index keys.
+// ===================================================================================
+func decodeCoin(key string, coinAsBytes []byte) (*coin, error) {
+	c := &coin{}
+	err := json.Unmarshal(coinAsBytes, c) //unmarshal it aka JSON.parse()
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, fmt.Errorf("Failed to decode JSON of: %q", key)
+	}
+	if c.Name != key {
+		return nil, fmt.Errorf("%w: %q is stored under %q", errInvalidCoin, c.Name, key)
+	}
+	if !validKeyAttribute(c.Amount) || !validKeyAttribute(c.Owner) {
+		return nil, fmt.Errorf("%w: %q has no valid amount and owner", errInvalidCoin, key)
+	}
+	return c, nil
+}
+
+// validKeyAttribute reports whether value can be an attribute of a composite key.
+func validKeyAttribute(value string) bool {
+	return len(value) > 0 && utf8.ValidString(value) && !strings.ContainsAny(value, "\x00\U0010FFFF")
+}
+
+// validUTF8 reports whether the function name and all arguments are valid UTF-8.
+func validUTF8(function string, args []string) bool {
+	if !utf8.ValidString(function) {
+		return false
 	}
-	coinToTransfer.Owner = newOwner //change the owner
+	for _, arg := range args {
+		if !utf8.ValidString(arg) {
+			return false
+		}
+	}
+	return true
+}
 
-	coinJSONasBytes, _ := json.Marshal(coinToTransfer)
-	err = stub.PutState(coinName, coinJSONasBytes) //rewrite the coin
+// transferOptions carries what the authorising function knows about a transfer.
+type transferOptions struct {
+	// Forced is set for regulator actions, which override restrictions on the
+	// current owner (freezes, sanctions, locks, limits) but not on the new owner.
+	Forced bool
+	// Moved counts the coins each owner has already given away in this transaction,
+	// per denomination. Reads do not see the transaction's own writes, so checks on
+	// the remaining balance add these in. Nil when only one coin is moved.
+	Moved map[holding]int
+	// Offer is set when the move completes the pending offer on the coin, which
+	// otherwise blocks it.
+	Offer bool
+	// Memo is stored on the coin, replacing the memo of the previous transfer.
+	Memo *transferMemo
+}
+
+// holding identifies the coins of one denomination held by one owner.
+type holding struct {
+	Owner  string
+	Amount string
+}
+
+// ===================================================================================
+// moveCoin sets a new owner on the coin. Every ownership change goes through here,
+// whichever function authorised it, so that the owner index is kept in step and
+// approvals granted by the previous owner, and its proposals, are cleared.
+// ===================================================================================
+func moveCoin(stub shim.ChaincodeStubInterface, c *coin, newOwner string, opts transferOptions) error {
+	if len(newOwner) <= 0 {
+		return fmt.Errorf("new owner must be a non-empty string")
+	}
+	// the balance deltas of the old and the new owner would share a key
+	if newOwner == c.Owner {
+		return fmt.Errorf("%s is already owned by %s", c.Name, newOwner)
+	}
+	from := holding{Owner: c.Owner, Amount: c.Amount}
+	var err error
+	if opts.Forced {
+		err = checkCompliance(stub, newOwner)
+	} else {
+		err = checkCompliance(stub, c.Owner, newOwner)
+		if err == nil {
+			err = checkLocks(stub, c, opts.Moved[from])
+		}
+		if err == nil {
+			err = checkLimits(stub, c, opts.Moved)
+		}
+		if err == nil && !opts.Offer {
+			err = checkNoPendingOffer(stub, c.Name)
+		}
+	}
+	if err == nil {
+		err = checkMultisigOwner(stub, newOwner)
+	}
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 
-	fmt.Println("- end transferCoin (success)")
-	return shim.Success(nil)
+	err = delIndexEntries(stub, c, ownerAmountNameIndex)
+	if err != nil {
+		return err
+	}
+	err = clearApproval(stub, c.Name)
+	if err != nil {
+		return err
+	}
+	err = clearOffer(stub, c.Name)
+	if err != nil {
+		return err
+	}
+	err = releaseStake(stub, c)
+	if err != nil {
+		return err
+	}
+	err = voidProposals(stub, c)
+	if err != nil {
+		return err
+	}
+	c.Owner = newOwner //change the owner
+	c.Memo = opts.Memo
+
+	coinJSONasBytes, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(c.Name, coinJSONasBytes) //rewrite the coin
+	if err != nil {
+		return err
+	}
+	err = setCoinEndorsement(stub, c)
+	if err != nil {
+		return err
+	}
+	if opts.Moved != nil {
+		opts.Moved[from]++
+	}
+	err = putBalanceDelta(stub, from.Owner, c, -1)
+	if err != nil {
+		return err
+	}
+	err = putBalanceDelta(stub, c.Owner, c, 1)
+	if err != nil {
+		return err
+	}
+	if c.Memo != nil && len(c.Memo.Reference) > 0 {
+		err = putMemoReference(stub, c, from.Owner)
+		if err != nil {
+			return err
+		}
+	}
+	return putIndexEntries(stub, c, ownerAmountNameIndex)
 }
 
 // ===========================================================================================
@@ -397,12 +1071,31 @@ func (t *SimpleChaincode) transferCoin(stub shim.ChaincodeStubInterface, args []
 // ===========================================================================================
 func (t *SimpleChaincode) getCoinsByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	//    0        1          2
+	// "coin1", "coin3", "{\"maxBytes\":4096}"
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting start key, end key and optional options")
 	}
 
 	startKey := args[0]
 	endKey := args[1]
+	optionsJSON := ""
+	if len(args) == 3 {
+		optionsJSON = args[2]
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	options, err := parseResultOptions(optionsJSON, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// the bookmark is the key to go on from
+	if len(options.Bookmark) > 0 {
+		startKey = options.Bookmark
+	}
 
 	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
 	if err != nil {
@@ -410,41 +1103,22 @@ func (t *SimpleChaincode) getCoinsByRange(stub shim.ChaincodeStubInterface, args
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	results := newResultWriter("records", options)
+	_, bookmark, err := results.writeRecords(resultsIterator, 0, nil)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	buffer.WriteString("]")
-
-	fmt.Printf("- getCoinsByRange queryResult:\n%s\n", buffer.String())
-
-	return shim.Success(buffer.Bytes())
+	resultsJSONasBytes, err := results.response(bookmark, len(optionsJSON) > 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- getCoinsByRange returning %d records\n", results.count)
+	return shim.Success(resultsJSONasBytes)
 }
 
 // ==== Example: GetStateByPartialCompositeKey/RangeQuery =========================================
-// transferCoinsBasedOnColor will transfer coins of a given color to a certain new owner.
-// Uses a GetStateByPartialCompositeKey (range query) against color~name 'index'.
+// transferCoinsBasedOnAmount will transfer coins of a given amount to a certain new owner.
+// Uses a GetStateByPartialCompositeKey (range query) against amount~name 'index'.
 // Committing peers will re-execute range queries to guarantee that result sets are stable
 // between endorsement time and commit time. The transaction is invalidated by the
 // committing peers if the result set has changed between endorsement time and commit time.
@@ -452,25 +1126,47 @@ func (t *SimpleChaincode) getCoinsByRange(stub shim.ChaincodeStubInterface, args
 // ===========================================================================================
 func (t *SimpleChaincode) transferCoinsBasedOnAmount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0       1
-	// "Amount", "bob"
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	//   0       1              2
+	// "Amount", "bob", "{\"reference\":\"INV-2024-0042\"}"
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting amount, new owner and optional memo")
 	}
 
-	amount := args[0]
-	newOwner := strings.ToLower(args[1])
+	amount := strings.ToLower(args[0])
+	newOwner := normalizeIdentity(args[1])
+	if len(amount) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(newOwner) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
 	fmt.Println("- start transferCoinsBasedOnAmount ", amount, newOwner)
 
-	// Query the amount~name index by color
-	// This will execute a key range query on all keys starting with 'color'
-	amountedCoinResultsIterator, err := stub.GetStateByPartialCompositeKey("amount~name", []string{amount})
+	var memo *transferMemo
+	if len(args) == 3 {
+		var err error
+		memo, err = parseMemo(args[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// Only the caller's own coins can be moved, so the owner~amount~name index is
+	// queried by caller and amount.
+	// This will execute a key range query on all keys starting with 'caller~amount'.
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	indexName := ownerAmountNameIndex
+	amountedCoinResultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{caller, amount})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	defer amountedCoinResultsIterator.Close()
 
 	// Iterate through result set and for each coin found, transfer to newOwner
+	moved := map[holding]int{}
 	var i int
 	for i = 0; amountedCoinResultsIterator.HasNext(); i++ {
 		// Note that we don't get the value (2nd return variable), we'll just get the coin name from the composite key
@@ -484,16 +1180,19 @@ func (t *SimpleChaincode) transferCoinsBasedOnAmount(stub shim.ChaincodeStubInte
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		returnedAmount := compositeKeyParts[0]
-		returnedCoinName := compositeKeyParts[1]
+		if len(compositeKeyParts) < 2 {
+			return shim.Error(fmt.Sprintf("malformed %s index entry: %q", indexName, responseRange.Key))
+		}
+		returnedAmount := compositeKeyParts[len(compositeKeyParts)-2]
+		returnedCoinName := compositeKeyParts[len(compositeKeyParts)-1]
 		fmt.Printf("- found a coin from index:%s amount:%s name:%s\n", objectType, returnedAmount, returnedCoinName)
 
-		// Now call the transfer function for the found coin.
+		// Now transfer the found coin.
 		// Re-use the same function that is used to transfer individual coins
-		response := t.transferCoin(stub, []string{returnedCoinName, newOwner})
+		err = transferOwnedCoin(stub, returnedCoinName, newOwner, transferOptions{Moved: moved, Memo: memo})
 		// if the transfer failed break out of loop and return error
-		if response.Status != shim.OK {
-			return shim.Error("Transfer failed: " + response.Message)
+		if err != nil {
+			return shim.Error("Transfer failed: " + err.Error())
 		}
 	}
 
@@ -523,23 +1222,43 @@ func (t *SimpleChaincode) transferCoinsBasedOnAmount(stub shim.ChaincodeStubInte
 // =========================================================================================
 func (t *SimpleChaincode) queryCoinsByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0
-	// "bob"
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	//   0              1
+	// "bob", "{\"skipCorrupt\":true}"
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting owner and optional options")
 	}
 
-	owner := strings.ToLower(args[0])
+	owner := normalizeIdentity(args[0])
+	optionsJSON := ""
+	if len(args) == 2 {
+		optionsJSON = args[1]
+	}
 
-	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"coin\",\"owner\":\"%s\"}}", owner)
+	queryString, err := ownerQuery(owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	queryResults, err := getQueryResultForQueryString(stub, queryString, optionsJSON)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	return shim.Success(queryResults)
 }
 
+// ownerQuery builds the query of queryCoinsByOwner. It is marshalled rather than
+// formatted, so the owner cannot alter the selector.
+func ownerQuery(owner string) (string, error) {
+	queryJSONasBytes, err := json.Marshal(map[string]interface{}{
+		"selector":  map[string]interface{}{"docType": coinObjectType, "owner": owner},
+		"use_index": []string{"_design/" + searchIndexes["owner"].DesignDoc, searchIndexes["owner"].Name},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(queryJSONasBytes), nil
+}
+
 // ===== Example: Ad hoc rich query ========================================================
 // queryCoins uses a query string to perform a query for coins.
 // Query string matching state database syntax is passed in and executed as is.
@@ -549,15 +1268,27 @@ func (t *SimpleChaincode) queryCoinsByOwner(stub shim.ChaincodeStubInterface, ar
 // =========================================================================================
 func (t *SimpleChaincode) queryCoins(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0
-	// "queryString"
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	//   0                1
+	// "queryString", "{\"maxBytes\":4096}"
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting query string and optional options")
 	}
 
 	queryString := args[0]
+	optionsJSON := ""
+	if len(args) == 2 {
+		optionsJSON = args[1]
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !config.featureEnabled(featureAdHocQueries) {
+		return shim.Error("Ad hoc queries are disabled, use searchCoins")
+	}
 
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	queryResults, err := getQueryResultForQueryString(stub, queryString, optionsJSON)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -565,112 +1296,77 @@ func (t *SimpleChaincode) queryCoins(stub shim.ChaincodeStubInterface, args []st
 }
 
 // =========================================================================================
-// getQueryResultForQueryString executes the passed in query string.
-// Result set is built and returned as a byte array containing the JSON results.
+// getQueryResultForQueryString executes the passed in query string, a page at a time,
+// until all results have been read or the response budget of the options is reached.
+// Result set is built and returned as a byte array containing the JSON results, in the
+// envelope of results.go if options were passed.
 // =========================================================================================
-func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
+func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string, optionsJSON string) ([]byte, error) {
 
 	fmt.Printf("- getQueryResultForQueryString queryString:\n%s\n", queryString)
 
-	resultsIterator, err := stub.GetQueryResult(queryString)
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	options, err := parseResultOptions(optionsJSON, config)
 	if err != nil {
 		return nil, err
 	}
-	defer resultsIterator.Close()
-
-	// buffer is a JSON array containing QueryRecords
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return nil, err
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
 
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	results := newResultWriter("records", options)
+	bookmark, err := results.writePages(config.MaxPageSize, 0, func(bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+		return stub.GetQueryResultWithPagination(queryString, config.MaxPageSize, bookmark)
+	}, nil)
+	if err != nil {
+		return nil, err
 	}
-	buffer.WriteString("]")
 
-	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
+	fmt.Printf("- getQueryResultForQueryString returning %d records\n", results.count)
 
-	return buffer.Bytes(), nil
+	return results.response(bookmark, len(optionsJSON) > 0)
 }
 
+// ===========================================================================================
+// getHistoryForCoin returns the history of a coin, one entry per modification with the
+// change it made to the owner and amount. An optional filter narrows it down by time range,
+// change type or counterparty and selects the order and page, see historyFilter.
+// ===========================================================================================
 func (t *SimpleChaincode) getHistoryForCoin(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	//   0                              1
+	// "coin1", "{\"changeType\":\"transfer\",\"order\":\"oldest\",\"pageSize\":10}"
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting coin name and optional filter")
 	}
 
 	coinName := args[0]
+	filterJSON := ""
+	if len(args) == 2 {
+		filterJSON = args[1]
+	}
 
 	fmt.Printf("- start getHistoryForCoin: %s\n", coinName)
 
-	resultsIterator, err := stub.GetHistoryForKey(coinName)
+	config, err := getConfig(stub)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer resultsIterator.Close()
-
-	// buffer is a JSON array containing historic values for the coin
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		response, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"TxId\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(response.TxId)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Value\":")
-		// if it was a delete operation on given key, then we need to set the
-		//corresponding value null. Else, we will write the response.Value
-		//as-is (as the Value itself a JSON coin)
-		if response.IsDelete {
-			buffer.WriteString("null")
-		} else {
-			buffer.WriteString(string(response.Value))
-		}
-
-		buffer.WriteString(", \"Timestamp\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String())
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"IsDelete\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(strconv.FormatBool(response.IsDelete))
-		buffer.WriteString("\"")
-
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	filter, err := parseHistoryFilter(filterJSON, config)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	buffer.WriteString("]")
 
-	fmt.Printf("- getHistoryForCoin returning:\n%s\n", buffer.String())
+	results := newResultWriter("entries", &filter.resultOptions)
+	bookmark, err := filter.writeHistory(stub, coinName, results)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	return shim.Success(buffer.Bytes())
+	pageJSONasBytes, err := results.page(bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- getHistoryForCoin returning %d entries\n", results.count)
+	return shim.Success(pageJSONasBytes)
 }
@@ -0,0 +1,325 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Freeze and sanctions lists ====
+//
+// Admins can freeze an identity, e.g. while it is under investigation, optionally
+// until an expiry time, and put identities on a sanctions list. Coins owned by, or
+// sent to, a frozen or sanctioned identity cannot be transferred, minted or deleted,
+// and a frozen or sanctioned identity cannot move, create or destroy the coins of
+// others as a spender, operator or minter.
+// Every change to the lists is recorded in the audit trail (actions freeze, unfreeze,
+// sanction and unsanction).
+//
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["freezeAccount","org1msp/tom","case 2024-17","2024-12-31T00:00:00Z"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["unfreezeAccount","org1msp/tom","case closed"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["addSanction","org2msp/mallory","OFAC SDN list"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["removeSanction","org2msp/mallory","delisted"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["readComplianceStatus","org1msp/tom"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["getAuditTrail","freeze"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	freezeObjectType   = "freeze"
+	sanctionObjectType = "sanction"
+)
+
+var (
+	errAccountFrozen     = errors.New("ACCOUNT_FROZEN")
+	errAccountSanctioned = errors.New("ACCOUNT_SANCTIONED")
+)
+
+// listEntry is an entry of the freeze or the sanctions list.
+type listEntry struct {
+	ObjectType string `json:"docType"`
+	Identity   string `json:"identity"`
+	Reason     string `json:"reason"`
+	ListedBy   string `json:"listedBy"`
+	ListedAt   string `json:"listedAt"`
+	ExpiresAt  string `json:"expiresAt,omitempty"` //freezes only, empty means until unfrozen
+}
+
+// activeAt reports whether the entry is in force at time now.
+func (e *listEntry) activeAt(now time.Time) bool {
+	if len(e.ExpiresAt) <= 0 {
+		return true
+	}
+	expiresAt, err := time.Parse(time.RFC3339, e.ExpiresAt)
+	return err != nil || now.Before(expiresAt)
+}
+
+func getListEntry(stub shim.ChaincodeStubInterface, objectType string, identity string) (*listEntry, error) {
+	entryKey, err := stub.CreateCompositeKey(objectType, []string{identity})
+	if err != nil {
+		return nil, err
+	}
+	entryAsBytes, err := stub.GetState(entryKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s entry of %s: %s", objectType, identity, err)
+	} else if entryAsBytes == nil {
+		return nil, nil
+	}
+
+	entry := &listEntry{}
+	err = json.Unmarshal(entryAsBytes, entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s entry of %s: %s", objectType, identity, err)
+	}
+	return entry, nil
+}
+
+// ===================================================================================
+// checkCompliance fails with errAccountSanctioned or errAccountFrozen if any of the
+// given identities is on the sanctions list or currently frozen. Callers pass both
+// sides of a movement, e.g. the current and the new owner of a coin.
+// ===================================================================================
+func checkCompliance(stub shim.ChaincodeStubInterface, identities ...string) error {
+	var now time.Time
+	for _, identity := range identities {
+		if len(identity) <= 0 {
+			continue
+		}
+
+		sanction, err := getListEntry(stub, sanctionObjectType, identity)
+		if err != nil {
+			return err
+		}
+		if sanction != nil {
+			return fmt.Errorf("%w: %s is sanctioned: %s", errAccountSanctioned, identity, sanction.Reason)
+		}
+
+		freeze, err := getListEntry(stub, freezeObjectType, identity)
+		if err != nil {
+			return err
+		}
+		if freeze == nil {
+			continue
+		}
+		if now.IsZero() {
+			now, err = getTxTime(stub)
+			if err != nil {
+				return err
+			}
+		}
+		if freeze.activeAt(now) {
+			return fmt.Errorf("%w: %s is frozen: %s", errAccountFrozen, identity, freeze.Reason)
+		}
+	}
+	return nil
+}
+
+// ============================================================
+// freezeAccount - admin only, freeze an identity with a reason
+// and an optional RFC3339 expiry time
+// ============================================================
+func (t *SimpleChaincode) freezeAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//        0             1                  2
+	// "org1msp/tom", "case 2024-17", "2024-12-31T00:00:00Z"
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting identity, reason and optional expiry")
+	}
+
+	expiresAt := ""
+	if len(args) == 3 && len(args[2]) > 0 {
+		expiry, err := time.Parse(time.RFC3339, args[2])
+		if err != nil {
+			return shim.Error("3rd argument must be an RFC3339 timestamp")
+		}
+		expiresAt = expiry.UTC().Format(time.RFC3339)
+	}
+	return putListEntry(stub, freezeObjectType, "freeze", args[0], args[1], expiresAt)
+}
+
+// ============================================================
+// unfreezeAccount - admin only, lift the freeze of an identity
+// ============================================================
+func (t *SimpleChaincode) unfreezeAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//        0             1
+	// "org1msp/tom", "case closed"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting identity and reason")
+	}
+	return delListEntry(stub, freezeObjectType, "unfreeze", args[0], args[1])
+}
+
+// ============================================================
+// addSanction - admin only, put an identity on the sanctions list
+// ============================================================
+func (t *SimpleChaincode) addSanction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//         0                 1
+	// "org2msp/mallory", "OFAC SDN list"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting identity and reason")
+	}
+	return putListEntry(stub, sanctionObjectType, "sanction", args[0], args[1], "")
+}
+
+// ============================================================
+// removeSanction - admin only, take an identity off the sanctions list
+// ============================================================
+func (t *SimpleChaincode) removeSanction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//         0              1
+	// "org2msp/mallory", "delisted"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting identity and reason")
+	}
+	return delListEntry(stub, sanctionObjectType, "unsanction", args[0], args[1])
+}
+
+func putListEntry(stub shim.ChaincodeStubInterface, objectType string, action string, identity string, reason string, expiresAt string) pb.Response {
+	identity = normalizeIdentity(identity)
+	if len(identity) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(reason) <= 0 {
+		return shim.Error("2nd argument must be a non-empty reason")
+	}
+
+	admin, err := requireAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	entry := &listEntry{
+		ObjectType: objectType,
+		Identity:   identity,
+		Reason:     reason,
+		ListedBy:   admin,
+		ListedAt:   now.Format(time.RFC3339),
+		ExpiresAt:  expiresAt,
+	}
+	entryJSONasBytes, err := json.Marshal(entry)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	entryKey, err := stub.CreateCompositeKey(objectType, []string{identity})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(entryKey, entryJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = writeAudit(stub, action, identity, admin, map[string]string{"reason": reason, "expiresAt": expiresAt})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- end %s %s\n", action, identity)
+	return shim.Success(nil)
+}
+
+func delListEntry(stub shim.ChaincodeStubInterface, objectType string, action string, identity string, reason string) pb.Response {
+	identity = normalizeIdentity(identity)
+	if len(reason) <= 0 {
+		return shim.Error("2nd argument must be a non-empty reason")
+	}
+
+	admin, err := requireAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	entry, err := getListEntry(stub, objectType, identity)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if entry == nil {
+		return shim.Error(identity + " is not on the " + objectType + " list")
+	}
+
+	entryKey, err := stub.CreateCompositeKey(objectType, []string{identity})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.DelState(entryKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = writeAudit(stub, action, identity, admin, map[string]string{"reason": reason})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- end %s %s\n", action, identity)
+	return shim.Success(nil)
+}
+
+type complianceStatus struct {
+	Identity   string     `json:"identity"`
+	Frozen     bool       `json:"frozen"`
+	Sanctioned bool       `json:"sanctioned"`
+	Freeze     *listEntry `json:"freeze,omitempty"`
+	Sanction   *listEntry `json:"sanction,omitempty"`
+}
+
+// ============================================================
+// readComplianceStatus - freeze and sanctions entries of an identity
+// ============================================================
+func (t *SimpleChaincode) readComplianceStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting identity")
+	}
+
+	status := complianceStatus{Identity: normalizeIdentity(args[0])}
+	freeze, err := getListEntry(stub, freezeObjectType, status.Identity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	sanction, err := getListEntry(stub, sanctionObjectType, status.Identity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if freeze != nil {
+		now, err := getTxTime(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		status.Frozen = freeze.activeAt(now)
+		status.Freeze = freeze
+	}
+	status.Sanctioned = sanction != nil
+	status.Sanction = sanction
+
+	statusJSONasBytes, err := json.Marshal(status)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(statusJSONasBytes)
+}
@@ -0,0 +1,124 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const complianceTestConfig = `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"],"regulator":["org1msp/admin"]},"recoveryAccount":"org1msp/recovery"}`
+
+// newComplianceLedger returns a ledger where tom holds coin1 and jerry coin2.
+func newComplianceLedger(t *testing.T) (*fakeLedger, *SimpleChaincode) {
+	t.Helper()
+	ledger, cc := newFakeChaincode(t, complianceTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin2", "adollar", "org2msp/jerry")
+	return ledger, cc
+}
+
+// expectRefused invokes a call that must fail with the given error code.
+func expectRefused(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, code string, identity string, function string, args ...string) {
+	t.Helper()
+	response := ledger.invoke(cc, identity, function, args...)
+	if !strings.Contains(response.Message, code) {
+		t.Errorf("%s %v by %s returned %d %s, expected %s", function, args, identity, response.Status, response.Message, code)
+	}
+}
+
+func TestFrozenAccountCannotSendOrReceive(t *testing.T) {
+	ledger, cc := newComplianceLedger(t)
+	if ledger.invoke(cc, "org1msp/tom", "freezeAccount", "org2msp/jerry", "case 1").Status == shim.OK {
+		t.Errorf("an identity that is not an admin froze an account")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "freezeAccount", "Org1MSP/Tom", "case 2024-17")
+
+	expectRefused(t, ledger, cc, "ACCOUNT_FROZEN", "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	expectRefused(t, ledger, cc, "ACCOUNT_FROZEN", "org2msp/jerry", "transferCoin", "coin2", "org1msp/tom")
+	expectRefused(t, ledger, cc, "ACCOUNT_FROZEN", "org1msp/admin", "mint", "coin3", "adollar", "org1msp/tom")
+	expectRefused(t, ledger, cc, "ACCOUNT_FROZEN", "org1msp/admin", "delete", "coin1")
+	// a regulator still moves coins away from a frozen owner, but not to one
+	expectRefused(t, ledger, cc, "ACCOUNT_FROZEN", "org1msp/admin", "forceTransfer", "coin2", "org1msp/tom", "ERROR", testDocumentHash)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "clawback", "coin1", "COURT_ORDER", testDocumentHash)
+
+	ledger.mustInvoke(t, cc, "org1msp/admin", "unfreezeAccount", "org1msp/tom", "case closed")
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "transferCoin", "coin2", "org1msp/tom")
+
+	records := []auditRecord{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/admin", "getAuditTrail", "freeze"), &records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Subject != "org1msp/tom" || records[0].Details["reason"] != "case 2024-17" {
+		t.Errorf("freeze audit trail is %+v", records)
+	}
+}
+
+func TestFreezeExpires(t *testing.T) {
+	ledger, cc := newComplianceLedger(t)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "freezeAccount", "org1msp/tom", "case 2024-17", ledger.clock.Add(time.Hour).Format(time.RFC3339))
+
+	expectRefused(t, ledger, cc, "ACCOUNT_FROZEN", "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	ledger.clock = ledger.clock.Add(time.Hour)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+}
+
+func TestSanctionedAccountCannotSendOrReceive(t *testing.T) {
+	ledger, cc := newComplianceLedger(t)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "addSanction", "org2msp/jerry", "OFAC SDN list")
+
+	expectRefused(t, ledger, cc, "ACCOUNT_SANCTIONED", "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	expectRefused(t, ledger, cc, "ACCOUNT_SANCTIONED", "org2msp/jerry", "transferCoin", "coin2", "org1msp/tom")
+	expectRefused(t, ledger, cc, "ACCOUNT_SANCTIONED", "org1msp/admin", "initCoin", "coin3", "adollar", "org2msp/jerry")
+	// sanctions do not expire with time
+	ledger.clock = ledger.clock.Add(365 * 24 * time.Hour)
+	expectRefused(t, ledger, cc, "ACCOUNT_SANCTIONED", "org2msp/jerry", "transferCoin", "coin2", "org1msp/tom")
+
+	ledger.mustInvoke(t, cc, "org1msp/admin", "removeSanction", "org2msp/jerry", "delisted")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "transferCoin", "coin2", "org1msp/tom")
+}
+
+func TestFrozenOrSanctionedCallerCannotActForOthers(t *testing.T) {
+	ledger, cc := newComplianceLedger(t)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "updateConfig", `{"roles":{"minter":["org1msp/admin","org1msp/treasury"]}}`)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "approve", "coin1", "org1msp/processor")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "setOperator", "org1msp/tom", "org2msp/custodian", "true")
+
+	ledger.mustInvoke(t, cc, "org1msp/admin", "freezeAccount", "org1msp/processor", "case 2024-17")
+	expectRefused(t, ledger, cc, "ACCOUNT_FROZEN", "org1msp/processor", "transferFrom", "coin1", "org1msp/tom", "org2msp/jerry")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "addSanction", "org2msp/custodian", "OFAC SDN list")
+	expectRefused(t, ledger, cc, "ACCOUNT_SANCTIONED", "org2msp/custodian", "transferFrom", "coin1", "org1msp/tom", "org2msp/jerry")
+
+	ledger.mustInvoke(t, cc, "org1msp/admin", "addSanction", "org1msp/treasury", "OFAC SDN list")
+	expectRefused(t, ledger, cc, "ACCOUNT_SANCTIONED", "org1msp/treasury", "burn", "coin2")
+	expectRefused(t, ledger, cc, "ACCOUNT_SANCTIONED", "org1msp/treasury", "delete", "coin2")
+	expectRefused(t, ledger, cc, "ACCOUNT_SANCTIONED", "org1msp/treasury", "initCoin", "coin3", "adollar", "org2msp/jerry")
+	expectRefused(t, ledger, cc, "ACCOUNT_SANCTIONED", "org1msp/treasury", "mint", "coin3", "adollar", "org2msp/jerry")
+
+	// the owners and other minters are not affected
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "burn", "coin2")
+}
@@ -0,0 +1,535 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Chaincode configuration ====
+//
+// The configuration is passed to Init as a JSON document and stored on the ledger
+// under a reserved composite key, so that it can differ per channel without a rebuild.
+// Every version is also kept in a history entry.
+//
+// peer chaincode invoke -C myc1 -n coins --isInit -c '{"Args":["init","{\"tokenName\":\"coin\",\"admins\":[\"Org1MSP/admin\"],\"denominations\":[\"acent\",\"adollar\"],\"maxPageSize\":100}"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["updateConfig","{\"maxPageSize\":50,\"features\":{\"initLedger\":false}}"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["updateConfig","{\"maxResponseBytes\":4194304}"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["updateConfig","{\"roles\":{\"minter\":[\"Org1MSP/treasury\"]},\"supplyCaps\":{\"adollar\":1000000}}"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["updateConfig","{\"roles\":{\"minter\":[\"Org1MSP/treasury\"]},\"features\":{\"restrictIssuance\":true}}"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["updateConfig","{\"roles\":{\"regulator\":[\"Org2MSP/regulator\"]},\"recoveryAccount\":\"Org1MSP/recovery\"}"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["updateConfig","{\"orgs\":{\"org1msp\":\"Org1MSP\"},\"features\":{\"keyLevelEndorsement\":true}}"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["updateConfig","{\"rewardDenomination\":\"acent\",\"rewardsPerDay\":1000,\"unbondingPeriod\":\"72h\",\"features\":{\"staking\":true}}"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["readConfig"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["getConfigHistory"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	configObjectType   = "config"
+	defaultTokenName   = "coin"
+	defaultMaxPageSize = 100
+	maxPageSizeLimit   = 1000
+
+	defaultMaxResponseBytes = 1 << 20
+	maxResponseBytesLimit   = 64 << 20
+
+	// featureInitLedger enables the initLedger function that seeds sample coins.
+	featureInitLedger = "initLedger"
+	// featureRestrictIssuance limits initCoin, delete and initLedger to minters, like
+	// mint and burn. It is off by default, so that a fresh deployment without roles can
+	// create coins; every creation and deletion leaves an audit record either way.
+	featureRestrictIssuance = "restrictIssuance"
+	// featureAdHocQueries enables queryCoins, which runs any CouchDB query a client
+	// sends. searchCoins is the safe alternative.
+	featureAdHocQueries = "adHocQueries"
+	// featureKeyLevelEndorsement requires the endorsement of the organization of the
+	// owner for changes to a coin, see endorsement.go.
+	featureKeyLevelEndorsement = "keyLevelEndorsement"
+	// featureStaking enables stake, unstake and claimRewards, see staking.go.
+	featureStaking = "staking"
+
+	// roleMinter may create and destroy coins with mint and burn.
+	roleMinter = "minter"
+	// roleRegulator may move coins with forceTransfer and clawback.
+	roleRegulator = "regulator"
+)
+
+// defaultFeatures lists every known feature toggle with the value used when the
+// configuration does not set it. Unknown toggles are rejected.
+var defaultFeatures = map[string]bool{
+	featureInitLedger:          true,
+	featureRestrictIssuance:    false,
+	featureAdHocQueries:        false,
+	featureKeyLevelEndorsement: false,
+	featureStaking:             false,
+}
+
+// retiredFeatures lists toggles that no longer switch anything. They are dropped
+// from stored configurations instead of being rejected.
+var retiredFeatures = map[string]bool{
+	"enforceOwnership": true, //only the owner moves a coin with transferCoin, always
+}
+
+// knownRoles lists the roles that can be granted in the configuration.
+var knownRoles = map[string]bool{
+	roleMinter:    true,
+	roleRegulator: true,
+}
+
+type chaincodeConfig struct {
+	ObjectType         string              `json:"docType"`
+	TokenName          string              `json:"tokenName"`
+	Admins             []string            `json:"admins"`           //identities allowed to administer the chaincode
+	Denominations      []string            `json:"denominations"`    //allowed coin amounts, empty allows any
+	MaxPageSize        int32               `json:"maxPageSize"`      //upper bound for the page size of paginated queries
+	MaxResponseBytes   int                 `json:"maxResponseBytes"` //upper bound for the records of a query response
+	Features           map[string]bool     `json:"features"`
+	Roles              map[string][]string `json:"roles"`              //identities holding each role
+	SupplyCaps         map[string]int64    `json:"supplyCaps"`         //maximum circulating supply per denomination
+	RecoveryAccount    string              `json:"recoveryAccount"`    //owner of coins recovered by clawback
+	Orgs               map[string]string   `json:"orgs"`               //MSP ID per owner prefix, for key-level endorsement
+	RewardDenomination string              `json:"rewardDenomination"` //amount of the coins minted as staking rewards
+	RewardsPerDay      int64               `json:"rewardsPerDay"`      //reward coins minted per day, shared by the stakers
+	UnbondingPeriod    string              `json:"unbondingPeriod"`    //Go duration unstaked coins stay locked, e.g. "72h"
+	Version            int                 `json:"version"`
+	UpdatedBy          string              `json:"updatedBy"`
+	UpdatedAt          string              `json:"updatedAt"`
+}
+
+// defaultConfig is in effect until a configuration has been stored.
+func defaultConfig() *chaincodeConfig {
+	return &chaincodeConfig{
+		ObjectType:       configObjectType,
+		TokenName:        defaultTokenName,
+		Admins:           []string{},
+		Denominations:    []string{},
+		MaxPageSize:      defaultMaxPageSize,
+		MaxResponseBytes: defaultMaxResponseBytes,
+		Features:         map[string]bool{},
+		Roles:            map[string][]string{},
+		SupplyCaps:       map[string]int64{},
+		Orgs:             map[string]string{},
+	}
+}
+
+// featureEnabled reports whether the named feature toggle is switched on.
+func (c *chaincodeConfig) featureEnabled(feature string) bool {
+	if enabled, ok := c.Features[feature]; ok {
+		return enabled
+	}
+	return defaultFeatures[feature]
+}
+
+// isAdmin reports whether identity is one of the configured admins.
+func (c *chaincodeConfig) isAdmin(identity string) bool {
+	return containsString(c.Admins, normalizeIdentity(identity))
+}
+
+// hasRole reports whether identity holds the named role.
+func (c *chaincodeConfig) hasRole(role string, identity string) bool {
+	return containsString(c.Roles[role], normalizeIdentity(identity))
+}
+
+// pageSize parses a page size argument, bounded by the configured maximum.
+func (c *chaincodeConfig) pageSize(arg string) (int32, error) {
+	pageSize, err := strconv.ParseInt(arg, 10, 32)
+	if err != nil || pageSize <= 0 || int32(pageSize) > c.MaxPageSize {
+		return 0, fmt.Errorf("Page size must be a number between 1 and %d", c.MaxPageSize)
+	}
+	return int32(pageSize), nil
+}
+
+// unbondingPeriod returns how long unstaked coins stay locked.
+func (c *chaincodeConfig) unbondingPeriod() time.Duration {
+	period, err := time.ParseDuration(c.UnbondingPeriod)
+	if err != nil {
+		return 0
+	}
+	return period
+}
+
+// denominationAllowed reports whether coins of the given amount may be created.
+func (c *chaincodeConfig) denominationAllowed(amount string) bool {
+	return len(c.Denominations) == 0 || containsString(c.Denominations, strings.ToLower(amount))
+}
+
+// validate normalizes the configuration and checks it for consistency.
+func (c *chaincodeConfig) validate() error {
+	c.ObjectType = configObjectType
+	c.TokenName = strings.TrimSpace(c.TokenName)
+	if len(c.TokenName) <= 0 {
+		c.TokenName = defaultTokenName
+	}
+
+	admins, err := normalizeList(c.Admins, normalizeIdentity, "admin")
+	if err != nil {
+		return err
+	}
+	c.Admins = admins
+
+	denominations, err := normalizeList(c.Denominations, strings.ToLower, "denomination")
+	if err != nil {
+		return err
+	}
+	c.Denominations = denominations
+
+	if c.MaxPageSize == 0 {
+		c.MaxPageSize = defaultMaxPageSize
+	}
+	if c.MaxPageSize < 0 || c.MaxPageSize > maxPageSizeLimit {
+		return fmt.Errorf("maxPageSize must be between 1 and %d", maxPageSizeLimit)
+	}
+	if c.MaxResponseBytes == 0 {
+		c.MaxResponseBytes = defaultMaxResponseBytes
+	}
+	if c.MaxResponseBytes < 0 || c.MaxResponseBytes > maxResponseBytesLimit {
+		return fmt.Errorf("maxResponseBytes must be between 1 and %d", maxResponseBytesLimit)
+	}
+
+	if c.Features == nil {
+		c.Features = map[string]bool{}
+	}
+	for feature := range c.Features {
+		if retiredFeatures[feature] {
+			delete(c.Features, feature)
+			continue
+		}
+		if _, ok := defaultFeatures[feature]; !ok {
+			return fmt.Errorf("unknown feature: %s", feature)
+		}
+	}
+
+	if c.Roles == nil {
+		c.Roles = map[string][]string{}
+	}
+	for role, members := range c.Roles {
+		if !knownRoles[role] {
+			return fmt.Errorf("unknown role: %s", role)
+		}
+		members, err := normalizeList(members, normalizeIdentity, role)
+		if err != nil {
+			return err
+		}
+		c.Roles[role] = members
+	}
+
+	supplyCaps := map[string]int64{}
+	for code, supplyCap := range c.SupplyCaps {
+		if supplyCap < 0 {
+			return fmt.Errorf("supply cap of %s must not be negative", code)
+		}
+		supplyCaps[strings.ToLower(code)] = supplyCap
+	}
+	c.SupplyCaps = supplyCaps
+
+	c.RecoveryAccount = normalizeIdentity(c.RecoveryAccount)
+
+	orgs := map[string]string{}
+	for prefix, mspID := range c.Orgs {
+		prefix = strings.ToLower(strings.TrimSpace(prefix))
+		mspID = strings.TrimSpace(mspID)
+		if len(prefix) <= 0 || strings.Contains(prefix, "/") {
+			return fmt.Errorf("org prefix must be a non-empty string without a slash")
+		}
+		if len(mspID) <= 0 {
+			return fmt.Errorf("MSP ID of %s must be a non-empty string", prefix)
+		}
+		orgs[prefix] = mspID
+	}
+	c.Orgs = orgs
+
+	c.RewardDenomination = strings.ToLower(strings.TrimSpace(c.RewardDenomination))
+	if c.RewardsPerDay < 0 {
+		return fmt.Errorf("rewardsPerDay must not be negative")
+	}
+	if len(c.UnbondingPeriod) > 0 {
+		period, err := time.ParseDuration(c.UnbondingPeriod)
+		if err != nil || period < 0 {
+			return fmt.Errorf("unbondingPeriod must be a non-negative duration such as 72h")
+		}
+	}
+	return nil
+}
+
+// normalizeList trims, normalizes and de-duplicates list, rejecting empty entries.
+func normalizeList(list []string, normalize func(string) string, what string) ([]string, error) {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, entry := range list {
+		entry = normalize(strings.TrimSpace(entry))
+		if len(entry) <= 0 {
+			return nil, fmt.Errorf("%s must be a non-empty string", what)
+		}
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		result = append(result, entry)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ===================================================================================
+// getConfig returns the stored configuration, or the defaults if there is none yet
+// ===================================================================================
+func getConfig(stub shim.ChaincodeStubInterface) (*chaincodeConfig, error) {
+	configKey, err := stub.CreateCompositeKey(configObjectType, []string{"current"})
+	if err != nil {
+		return nil, err
+	}
+	configAsBytes, err := stub.GetState(configKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config: %s", err)
+	}
+	if configAsBytes == nil {
+		return defaultConfig(), nil
+	}
+
+	config := defaultConfig()
+	err = json.Unmarshal(configAsBytes, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config: %s", err)
+	}
+	return config, nil
+}
+
+// ===================================================================================
+// putConfig validates config and stores it as the next version, keeping a copy in
+// the configuration history
+// ===================================================================================
+func putConfig(stub shim.ChaincodeStubInterface, config *chaincodeConfig, previousVersion int, updatedBy string) error {
+	err := config.validate()
+	if err != nil {
+		return err
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	config.Version = previousVersion + 1
+	config.UpdatedBy = updatedBy
+	config.UpdatedAt = txTime.Format(time.RFC3339)
+
+	configJSONasBytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	configKey, err := stub.CreateCompositeKey(configObjectType, []string{"current"})
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(configKey, configJSONasBytes)
+	if err != nil {
+		return err
+	}
+
+	historyKey, err := stub.CreateCompositeKey(configObjectType, []string{"history", fmt.Sprintf("%010d", config.Version)})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(historyKey, configJSONasBytes)
+}
+
+// ===================================================================================
+// requireAdmin returns the caller identity if it is a configured admin
+// ===================================================================================
+func requireAdmin(stub shim.ChaincodeStubInterface) (string, error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return "", err
+	}
+	if !config.isAdmin(caller) {
+		return "", fmt.Errorf("%s is not an admin", caller)
+	}
+	return caller, nil
+}
+
+// ===================================================================================
+// requireRole returns the caller identity if it holds the named role
+// ===================================================================================
+func requireRole(stub shim.ChaincodeStubInterface, role string) (string, error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return "", err
+	}
+	if !config.hasRole(role, caller) {
+		return "", fmt.Errorf("%s does not hold the %s role", caller, role)
+	}
+	return caller, nil
+}
+
+// ============================================================
+// initConfig - store the configuration passed to Init
+// ============================================================
+func (t *SimpleChaincode) initConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "{\"tokenName\":\"coin\",\"admins\":[\"org1msp/admin\"]}"
+	if len(args) == 0 {
+		// Nothing to change, e.g. an upgrade that keeps the stored configuration
+		return shim.Success(nil)
+	}
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting a JSON configuration")
+	}
+
+	current, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	config := defaultConfig()
+	err = json.Unmarshal([]byte(args[0]), config)
+	if err != nil {
+		return shim.Error("Failed to decode configuration: " + err.Error())
+	}
+
+	err = putConfig(stub, config, current.Version, "init")
+	if err != nil {
+		return shim.Error("Invalid configuration: " + err.Error())
+	}
+
+	fmt.Printf("- init stored config version %d\n", config.Version)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// updateConfig - admin only, change the stored configuration.
+// Fields not present in the update keep their current value,
+// features are merged into the current toggles.
+// ============================================================
+func (t *SimpleChaincode) updateConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "{\"maxPageSize\":50}"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	caller, err := requireAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	previousVersion := config.Version
+	previousRate := stakingRate(config)
+
+	err = json.Unmarshal([]byte(args[0]), config)
+	if err != nil {
+		return shim.Error("Failed to decode configuration: " + err.Error())
+	}
+	if len(config.Admins) == 0 {
+		return shim.Error("Invalid configuration: at least one admin is required")
+	}
+
+	err = putConfig(stub, config, previousVersion, caller)
+	if err != nil {
+		return shim.Error("Invalid configuration: " + err.Error())
+	}
+	if rate := stakingRate(config); rate != previousRate {
+		err = updateStakingRate(stub, rate)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	fmt.Printf("- updateConfig stored config version %d\n", config.Version)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// readConfig - return the configuration in effect
+// ============================================================
+func (t *SimpleChaincode) readConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	configJSONasBytes, err := json.Marshal(config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(configJSONasBytes)
+}
+
+// ============================================================
+// getConfigHistory - return every stored configuration version, oldest first
+// ============================================================
+func (t *SimpleChaincode) getConfigHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(configObjectType, []string{"history"})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	history := []json.RawMessage{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		history = append(history, json.RawMessage(queryResponse.Value))
+	}
+
+	historyJSONasBytes, err := json.Marshal(history)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(historyJSONasBytes)
+}
@@ -0,0 +1,104 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+func readTestConfig(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode) *chaincodeConfig {
+	t.Helper()
+	config := &chaincodeConfig{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "readConfig"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestUpdateConfigValidation(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, `{"admins":["Org1MSP/Admin "]}`)
+
+	for _, call := range [][]string{
+		{"org1msp/tom", `{"maxPageSize":50}`},
+		{"org1msp/admin", `{"maxPageSize":50`},
+		{"org1msp/admin", `{"maxPageSize":"50"}`},
+		{"org1msp/admin", `{"features":{"fastLane":true}}`},
+		{"org1msp/admin", `{"roles":{"auditor":["org1msp/tom"]}}`},
+		{"org1msp/admin", `{"roles":{"minter":[" "]}}`},
+		{"org1msp/admin", `{"admins":[]}`},
+		{"org1msp/admin", `{"maxPageSize":5000}`},
+		{"org1msp/admin", `{"maxResponseBytes":-1}`},
+		{"org1msp/admin", `{"supplyCaps":{"adollar":-1}}`},
+		{"org1msp/admin", `{"orgs":{"org1msp/x":"Org1MSP"}}`},
+		{"org1msp/admin", `{"unbondingPeriod":"three days"}`},
+	} {
+		if response := ledger.invoke(cc, call[0], "updateConfig", call[1]); response.Status == shim.OK {
+			t.Errorf("updateConfig %s by %s succeeded", call[1], call[0])
+		}
+	}
+	if config := readTestConfig(t, ledger, cc); config.Version != 1 || config.MaxPageSize != defaultMaxPageSize {
+		t.Errorf("refused updates changed the configuration to %+v", config)
+	}
+
+	// the toggle of a retired feature is accepted and dropped
+	ledger.mustInvoke(t, cc, "org1msp/admin", "updateConfig", `{"features":{"enforceOwnership":true,"staking":true}}`)
+	config := readTestConfig(t, ledger, cc)
+	if _, ok := config.Features["enforceOwnership"]; ok || !config.Features["staking"] || config.Version != 2 {
+		t.Errorf("features after enabling a retired one are %v", config.Features)
+	}
+}
+
+func TestConfigHistory(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"],"features":{"staking":true}}`)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "updateConfig", `{"maxPageSize":50,"features":{"adHocQueries":true}}`)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "updateConfig", `{"admins":["org1msp/admin","org2msp/admin"]}`)
+	ledger.mustInvoke(t, cc, "org2msp/admin", "updateConfig", `{"features":{"staking":false}}`)
+
+	history := []*chaincodeConfig{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "getConfigHistory"), &history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 4 {
+		t.Fatalf("config history has %d versions", len(history))
+	}
+	for i, config := range history {
+		if config.Version != i+1 {
+			t.Errorf("version %d of the config history is numbered %d", i+1, config.Version)
+		}
+	}
+	if history[0].UpdatedBy != "init" || history[0].UpdatedAt != "2024-01-01T00:00:00Z" || history[0].MaxPageSize != defaultMaxPageSize {
+		t.Errorf("first version is %+v", history[0])
+	}
+	// updates keep what they do not mention and merge the features
+	if second := history[1]; second.UpdatedBy != "org1msp/admin" || second.MaxPageSize != 50 || !second.Features["staking"] || !second.Features["adHocQueries"] {
+		t.Errorf("second version is %+v", second)
+	}
+	if last := history[3]; last.UpdatedBy != "org2msp/admin" || last.MaxPageSize != 50 || last.Features["staking"] || !last.Features["adHocQueries"] || len(last.Admins) != 2 {
+		t.Errorf("last version is %+v", last)
+	}
+	if config := readTestConfig(t, ledger, cc); config.Version != 4 || config.UpdatedAt != history[3].UpdatedAt {
+		t.Errorf("configuration in effect is %+v", config)
+	}
+}
@@ -0,0 +1,403 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Denomination registry ====
+//
+// The amount of a coin is the code of a registered denomination. Each denomination
+// has a value in minor units, so that holdings of different denominations can be
+// summed and converted. The aCent and aDollar denominations used by the samples are
+// built in; admins can register more and retire any of them.
+//
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["registerDenomination","aeuro","aEuro","110"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["setDenominationActive","aeuro","false"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["readDenomination","adollar"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["listDenominations"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["convert","250","acent","adollar"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["valueOfOwner","org1msp/tom","adollar"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const denominationObjectType = "denomination"
+
+type denomination struct {
+	ObjectType  string `json:"docType"`
+	Code        string `json:"code"`
+	DisplayName string `json:"displayName"`
+	Value       int64  `json:"value"` //value in minor units
+	Active      bool   `json:"active"`
+}
+
+// builtinDenominations are registered until an admin stores a replacement.
+var builtinDenominations = map[string]denomination{
+	"acent":   {ObjectType: denominationObjectType, Code: "acent", DisplayName: "aCent", Value: 1, Active: true},
+	"adollar": {ObjectType: denominationObjectType, Code: "adollar", DisplayName: "aDollar", Value: 100, Active: true},
+}
+
+// ===================================================================================
+// getDenomination returns the registered denomination with the given code, or nil
+// ===================================================================================
+func getDenomination(stub shim.ChaincodeStubInterface, code string) (*denomination, error) {
+	code = strings.ToLower(code)
+	denomKey, err := stub.CreateCompositeKey(denominationObjectType, []string{code})
+	if err != nil {
+		return nil, err
+	}
+	denomAsBytes, err := stub.GetState(denomKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get denomination: %s", err)
+	}
+	if denomAsBytes == nil {
+		if builtin, ok := builtinDenominations[code]; ok {
+			return &builtin, nil
+		}
+		return nil, nil
+	}
+
+	denom := &denomination{}
+	err = json.Unmarshal(denomAsBytes, denom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode denomination %s: %s", code, err)
+	}
+	return denom, nil
+}
+
+// getActiveDenomination is getDenomination for callers that need a usable unit.
+func getActiveDenomination(stub shim.ChaincodeStubInterface, code string) (*denomination, error) {
+	denom, err := getDenomination(stub, code)
+	if err != nil {
+		return nil, err
+	}
+	if denom == nil {
+		return nil, fmt.Errorf("unknown denomination: %s", code)
+	}
+	if !denom.Active {
+		return nil, fmt.Errorf("denomination is not active: %s", code)
+	}
+	return denom, nil
+}
+
+func putDenomination(stub shim.ChaincodeStubInterface, denom *denomination) error {
+	denomKey, err := stub.CreateCompositeKey(denominationObjectType, []string{denom.Code})
+	if err != nil {
+		return err
+	}
+	denomJSONasBytes, err := json.Marshal(denom)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(denomKey, denomJSONasBytes)
+}
+
+// toMinorUnits returns the value of quantity coins of denom in minor units.
+func toMinorUnits(quantity int64, denom *denomination) (int64, error) {
+	if quantity < 0 {
+		return 0, fmt.Errorf("quantity must not be negative")
+	}
+	if quantity > 0 && denom.Value > math.MaxInt64/quantity {
+		return 0, fmt.Errorf("value of %d %s overflows", quantity, denom.Code)
+	}
+	return quantity * denom.Value, nil
+}
+
+// ============================================================
+// registerDenomination - admin only, add a denomination to the registry
+// ============================================================
+func (t *SimpleChaincode) registerDenomination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1         2
+	// "aeuro",  "aEuro",   "110"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	_, err := requireAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	code := strings.ToLower(strings.TrimSpace(args[0]))
+	displayName := strings.TrimSpace(args[1])
+	if !validKeyAttribute(code) {
+		return shim.Error("1st argument must be a non-empty code")
+	}
+	if len(displayName) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	value, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || value <= 0 {
+		return shim.Error("3rd argument must be a positive number of minor units")
+	}
+
+	existing, err := getDenomination(stub, code)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if existing != nil {
+		return shim.Error("This denomination already exists: " + code)
+	}
+
+	denom := &denomination{
+		ObjectType:  denominationObjectType,
+		Code:        code,
+		DisplayName: displayName,
+		Value:       value,
+		Active:      true,
+	}
+	err = putDenomination(stub, denom)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end registerDenomination " + code)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// setDenominationActive - admin only, activate or retire a denomination.
+// Existing coins of a retired denomination keep their value but no new
+// coins of it can be created.
+// ============================================================
+func (t *SimpleChaincode) setDenominationActive(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1
+	// "aeuro",  "false"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	_, err := requireAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	active, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be true or false")
+	}
+	denom, err := getDenomination(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if denom == nil {
+		return shim.Error("Denomination does not exist: " + args[0])
+	}
+
+	denom.Active = active
+	err = putDenomination(stub, denom)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// ============================================================
+// readDenomination - read a denomination from the registry
+// ============================================================
+func (t *SimpleChaincode) readDenomination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting code of the denomination to query")
+	}
+
+	denom, err := getDenomination(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if denom == nil {
+		return shim.Error("Denomination does not exist: " + args[0])
+	}
+
+	denomJSONasBytes, err := json.Marshal(denom)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(denomJSONasBytes)
+}
+
+// ============================================================
+// listDenominations - list the registry, including built-in entries
+// ============================================================
+func (t *SimpleChaincode) listDenominations(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	denoms := map[string]denomination{}
+	for code, builtin := range builtinDenominations {
+		denoms[code] = builtin
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(denominationObjectType, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		denom := denomination{}
+		err = json.Unmarshal(queryResponse.Value, &denom)
+		if err != nil {
+			return shim.Error("Failed to decode denomination: " + queryResponse.Key)
+		}
+		denoms[denom.Code] = denom
+	}
+
+	result := []denomination{}
+	for _, denom := range denoms {
+		result = append(result, denom)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Code < result[j].Code })
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultJSONasBytes)
+}
+
+// conversion reports a value in a target unit. Values that are not a whole
+// number of target units are split into whole units and a remainder in minor units.
+type conversion struct {
+	Unit                string `json:"unit"`
+	MinorUnits          int64  `json:"minorUnits"`
+	Value               int64  `json:"value"`
+	RemainderMinorUnits int64  `json:"remainderMinorUnits"`
+}
+
+func convertMinorUnits(minorUnits int64, unit *denomination) conversion {
+	return conversion{
+		Unit:                unit.Code,
+		MinorUnits:          minorUnits,
+		Value:               minorUnits / unit.Value,
+		RemainderMinorUnits: minorUnits % unit.Value,
+	}
+}
+
+// ============================================================
+// convert - convert a quantity of one denomination into another
+// ============================================================
+func (t *SimpleChaincode) convert(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1          2
+	// "250",  "acent",  "adollar"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	quantity, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || quantity < 0 {
+		return shim.Error("1st argument must be a non-negative number")
+	}
+	from, err := getDenomination(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if from == nil {
+		return shim.Error("Denomination does not exist: " + args[1])
+	}
+	to, err := getDenomination(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if to == nil {
+		return shim.Error("Denomination does not exist: " + args[2])
+	}
+
+	minorUnits, err := toMinorUnits(quantity, from)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultJSONasBytes, err := json.Marshal(convertMinorUnits(minorUnits, to))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultJSONasBytes)
+}
+
+type ownerValue struct {
+	Owner    string           `json:"owner"`
+	Holdings map[string]int64 `json:"holdings"` //number of coins per denomination
+	Unpriced map[string]int64 `json:"unpriced"` //coins whose amount is not in the registry
+	conversion
+}
+
+// ============================================================
+// valueOfOwner - total value of the coins of an owner in a chosen unit.
+// Sums the balance records of the owner, see balance.go.
+// ============================================================
+func (t *SimpleChaincode) valueOfOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "tom",  "adollar"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	owner := normalizeIdentity(args[0])
+	unit, err := getDenomination(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if unit == nil {
+		return shim.Error("Denomination does not exist: " + args[1])
+	}
+
+	balance, _, err := getBalance(stub, owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	holdings := balance.Coins
+
+	result := ownerValue{Owner: owner, Holdings: holdings, Unpriced: map[string]int64{}}
+	var minorUnits int64
+	for amount, quantity := range holdings {
+		denom, err := getDenomination(stub, amount)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if denom == nil {
+			result.Unpriced[amount] = quantity
+			continue
+		}
+		value, err := toMinorUnits(quantity, denom)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if minorUnits > math.MaxInt64-value {
+			return shim.Error("Value of holdings overflows")
+		}
+		minorUnits += value
+	}
+	result.conversion = convertMinorUnits(minorUnits, unit)
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultJSONasBytes)
+}
@@ -0,0 +1,140 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const denominationTestConfig = `{"admins":["org1msp/admin"]}`
+
+func TestConvertMinorUnits(t *testing.T) {
+	dollar := builtinDenominations["adollar"]
+	for _, test := range []struct {
+		minorUnits int64
+		expected   conversion
+	}{
+		{0, conversion{Unit: "adollar"}},
+		{99, conversion{Unit: "adollar", MinorUnits: 99, Value: 0, RemainderMinorUnits: 99}},
+		{100, conversion{Unit: "adollar", MinorUnits: 100, Value: 1}},
+		{250, conversion{Unit: "adollar", MinorUnits: 250, Value: 2, RemainderMinorUnits: 50}},
+	} {
+		if result := convertMinorUnits(test.minorUnits, &dollar); result != test.expected {
+			t.Errorf("%d minor units are %+v in adollar", test.minorUnits, result)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, denominationTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "registerDenomination", "aeuro", "aEuro", "110")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "registerDenomination", "abig", "aBig", "4611686018427387904")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "setDenominationActive", "aeuro", "false")
+
+	for _, test := range []struct {
+		args     []string
+		expected conversion
+	}{
+		{[]string{"250", "acent", "adollar"}, conversion{Unit: "adollar", MinorUnits: 250, Value: 2, RemainderMinorUnits: 50}},
+		{[]string{"3", "ADollar", "acent"}, conversion{Unit: "acent", MinorUnits: 300, Value: 300}},
+		// rounds down, the rest is left in minor units, also for retired denominations
+		{[]string{"2", "adollar", "aeuro"}, conversion{Unit: "aeuro", MinorUnits: 200, Value: 1, RemainderMinorUnits: 90}},
+		{[]string{"3", "aeuro", "adollar"}, conversion{Unit: "adollar", MinorUnits: 330, Value: 3, RemainderMinorUnits: 30}},
+		{[]string{"0", "aeuro", "acent"}, conversion{Unit: "acent"}},
+		{[]string{"1", "abig", "abig"}, conversion{Unit: "abig", MinorUnits: 4611686018427387904, Value: 1}},
+	} {
+		result := conversion{}
+		err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "convert", test.args...), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != test.expected {
+			t.Errorf("convert %v is %+v", test.args, result)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-1", "acent", "adollar"},
+		{"1.5", "adollar", "acent"},
+		{"1", "agold", "acent"},
+		{"1", "acent", "agold"},
+		{"2", "abig", "acent"},
+		{"1", "acent"},
+	} {
+		if ledger.invoke(cc, "org1msp/tom", "convert", args...).Status == shim.OK {
+			t.Errorf("convert %v succeeded", args)
+		}
+	}
+}
+
+func TestValueOfOwner(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, denominationTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "registerDenomination", "aeuro", "aEuro", "110")
+	for _, holding := range [][]string{{"coin1", "adollar"}, {"coin2", "adollar"}, {"coin3", "acent"}, {"coin4", "acent"}, {"coin5", "acent"}, {"coin6", "aeuro"}} {
+		ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", holding[0], holding[1], "org1msp/tom")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin7", "adollar", "org2msp/jerry")
+	// a retired denomination keeps its value
+	ledger.mustInvoke(t, cc, "org1msp/admin", "setDenominationActive", "aeuro", "false")
+
+	// a balance of a denomination that is not registered cannot be priced
+	stub := ledger.newStub("org1msp/admin", "seed")
+	if err := putBalanceDelta(stub, "org1msp/tom", &coin{Name: "coin8", Amount: "agold", Owner: "org1msp/tom"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	ledger.commit(stub)
+
+	result := ownerValue{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "valueOfOwner", "Org1MSP/Tom", "adollar"), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 * 100 + 3 * 1 + 110 minor units
+	expected := conversion{Unit: "adollar", MinorUnits: 313, Value: 3, RemainderMinorUnits: 13}
+	if result.Owner != "org1msp/tom" || result.conversion != expected ||
+		!reflect.DeepEqual(result.Holdings, map[string]int64{"adollar": 2, "acent": 3, "aeuro": 1, "agold": 1}) ||
+		!reflect.DeepEqual(result.Unpriced, map[string]int64{"agold": 1}) {
+		t.Errorf("value of tom is %+v", result)
+	}
+
+	if ledger.invoke(cc, "org1msp/tom", "valueOfOwner", "org1msp/tom", "agold").Status == shim.OK {
+		t.Errorf("value in a denomination that is not registered succeeded")
+	}
+}
+
+func TestRegisterDenominationCodes(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, denominationTestConfig)
+	for _, code := range []string{"", " ", "a\x00b", "a\U0010FFFF"} {
+		if ledger.invoke(cc, "org1msp/admin", "registerDenomination", code, "aBad", "1").Status == shim.OK {
+			t.Errorf("denomination %q was registered", code)
+		}
+	}
+	if ledger.invoke(cc, "org1msp/tom", "registerDenomination", "aeuro", "aEuro", "110").Status == shim.OK {
+		t.Errorf("an identity that is not an admin registered a denomination")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "registerDenomination", " AEuro ", "aEuro", "110")
+	if ledger.invoke(cc, "org1msp/admin", "registerDenomination", "aeuro", "aEuro", "120").Status == shim.OK {
+		t.Errorf("aeuro was registered twice")
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Key-level endorsement ====
+//
+// With the keyLevelEndorsement feature enabled, every coin key gets a state-based
+// endorsement policy that requires a peer of the organization of its owner. The policy
+// is set when the coin is created and whenever its owner changes. Peers validate a
+// write against the policy the key had before, so a transfer needs the endorsement of
+// the organization the coin is moved away from, not just any organization satisfying
+// the chaincode-level policy.
+//
+// The organization of an owner is looked up by the part of the owner before the slash
+// in the orgs map of the configuration, e.g. owner "org1msp/tom" with
+// {"orgs":{"org1msp":"Org1MSP"}}; MSP IDs are case sensitive while owners are
+// lowercased. Coins of owners without a configured organization, such as multisig
+// accounts, have no key-level policy and fall back to the chaincode-level policy.
+//
+// reapplyEndorsementPolicies walks the coin register (coinreg~name) a page at a time and
+// brings the policies of the coins in line with the configuration, e.g. after enabling
+// the feature or adding an organization. It removes the policies while the feature is
+// disabled, as does any transfer of a coin then. Changing the policy of a coin needs the
+// endorsement its current policy requires.
+//
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["updateConfig","{\"orgs\":{\"org1msp\":\"Org1MSP\",\"org2msp\":\"Org2MSP\"},\"features\":{\"keyLevelEndorsement\":true}}"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["reapplyEndorsementPolicies","100"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["reapplyEndorsementPolicies","100","coin42"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/statebased"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// ownerOrg returns the MSP ID of the organization of owner, "" if none is configured.
+func (c *chaincodeConfig) ownerOrg(owner string) string {
+	prefix, _, ok := strings.Cut(owner, "/")
+	if !ok {
+		return ""
+	}
+	return c.Orgs[prefix]
+}
+
+// ===================================================================================
+// coinEndorsementPolicy returns the key-level endorsement policy for a coin of owner,
+// nil for none
+// ===================================================================================
+func coinEndorsementPolicy(config *chaincodeConfig, owner string) ([]byte, error) {
+	if !config.featureEnabled(featureKeyLevelEndorsement) {
+		return nil, nil
+	}
+	mspID := config.ownerOrg(owner)
+	if len(mspID) <= 0 {
+		return nil, nil
+	}
+	endorsementPolicy, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return nil, err
+	}
+	err = endorsementPolicy.AddOrgs(statebased.RoleTypePeer, mspID)
+	if err != nil {
+		return nil, err
+	}
+	return endorsementPolicy.Policy()
+}
+
+// ===================================================================================
+// setCoinEndorsement sets the key-level endorsement policy of a coin for its owner.
+// Called whenever a coin is created or changes owner. While the feature is disabled a
+// policy left from before is removed, so it does not outlive the owner it was set for.
+// ===================================================================================
+func setCoinEndorsement(stub shim.ChaincodeStubInterface, c *coin) error {
+	config, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if !config.featureEnabled(featureKeyLevelEndorsement) {
+		// only coins with a policy pay for the extra write
+		current, err := stub.GetStateValidationParameter(c.Name)
+		if err != nil || len(current) == 0 {
+			return err
+		}
+		return stub.SetStateValidationParameter(c.Name, nil)
+	}
+	policy, err := coinEndorsementPolicy(config, c.Owner)
+	if err != nil {
+		return err
+	}
+	return stub.SetStateValidationParameter(c.Name, policy)
+}
+
+// ===========================================================================================
+// reapplyEndorsementPolicies - admin only, set the key-level endorsement policy of one page
+// of coins, starting at the given coin name. The page walks the coin register, so other
+// documents are never read; deleted coins and coins that cannot be decoded are skipped.
+// Returns the coin name to start the next page at, empty after the last page.
+// ===========================================================================================
+func (t *SimpleChaincode) reapplyEndorsementPolicies(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "100", "coin42"
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting page size and optional coin name to start at")
+	}
+
+	admin, err := requireAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pageSize, err := config.pageSize(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	startKey := ""
+	if len(args) == 2 {
+		startKey = args[1]
+	}
+	fmt.Printf("- start reapplyEndorsementPolicies at %q\n", startKey)
+
+	// paginated queries are not allowed in transactions that write, so the page is cut
+	// off by hand
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(coinRegisterIndex, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	processed := 0
+	skipped := 0
+	bookmark := ""
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(compositeKeyParts) != 1 {
+			return shim.Error(fmt.Sprintf("malformed %s entry: %q", coinRegisterIndex, responseRange.Key))
+		}
+		coinName := compositeKeyParts[0]
+		if coinName < startKey {
+			continue
+		}
+		if processed+skipped == int(pageSize) {
+			bookmark = coinName
+			break
+		}
+
+		coinAsBytes, err := stub.GetState(coinName)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if coinAsBytes == nil {
+			skipped++
+			continue
+		}
+		coinJSON, err := decodeCoin(coinName, coinAsBytes)
+		if err != nil {
+			fmt.Println("- reapplyEndorsementPolicies skipping " + err.Error())
+			skipped++
+			continue
+		}
+		policy, err := coinEndorsementPolicy(config, coinJSON.Owner)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.SetStateValidationParameter(coinName, policy)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		processed++
+	}
+
+	err = writeAudit(stub, "reapplyEndorsementPolicies", startKey, admin, map[string]string{
+		"processed": strconv.Itoa(processed),
+		"skipped":   strconv.Itoa(skipped),
+		"enabled":   strconv.FormatBool(config.featureEnabled(featureKeyLevelEndorsement)),
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	responsePayload, err := json.Marshal(map[string]interface{}{"processed": processed, "skipped": skipped, "bookmark": bookmark})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- end reapplyEndorsementPolicies (%d coins)\n", processed)
+	return shim.Success(responsePayload)
+}
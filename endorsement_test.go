@@ -0,0 +1,148 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/statebased"
+)
+
+const endorsementTestConfig = `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"]},` +
+	`"orgs":{"org1msp":"Org1MSP","org2msp":"Org2MSP"},"features":{"keyLevelEndorsement":true}}`
+
+// testEndorsingOrgs returns the organizations the key-level policy of key requires,
+// nil if it has none.
+func testEndorsingOrgs(t *testing.T, ledger *fakeLedger, key string) []string {
+	t.Helper()
+	policy, ok := ledger.eps[key]
+	if !ok {
+		return nil
+	}
+	endorsementPolicy, err := statebased.NewStateEP(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return endorsementPolicy.ListOrgs()
+}
+
+func expectEndorsingOrg(t *testing.T, ledger *fakeLedger, key string, mspID string) {
+	t.Helper()
+	orgs := testEndorsingOrgs(t, ledger, key)
+	if mspID == "" && len(orgs) > 0 {
+		t.Errorf("%s needs the endorsement of %v, expected no key-level policy", key, orgs)
+	}
+	if mspID != "" && (len(orgs) != 1 || orgs[0] != mspID) {
+		t.Errorf("%s needs the endorsement of %v, expected %s", key, orgs, mspID)
+	}
+}
+
+func TestEndorsementFollowsOwner(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, endorsementTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	expectEndorsingOrg(t, ledger, "coin1", "Org1MSP")
+
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	expectEndorsingOrg(t, ledger, "coin1", "Org2MSP")
+
+	// owners without a configured organization fall back to the chaincode-level policy
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "transferCoin", "coin1", "org3msp/spike")
+	expectEndorsingOrg(t, ledger, "coin1", "")
+
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin2", "adollar", "org3msp/spike")
+	expectEndorsingOrg(t, ledger, "coin2", "")
+}
+
+func TestEndorsementPoliciesReapplied(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"]},"orgs":{"org1msp":"Org1MSP"}}`)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin2", "adollar", "org2msp/jerry")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org1msp/spike")
+	expectEndorsingOrg(t, ledger, "coin1", "")
+	expectEndorsingOrg(t, ledger, "coin2", "")
+
+	// enabling the feature and adding an organization changes nothing until reapplied
+	ledger.mustInvoke(t, cc, "org1msp/admin", "updateConfig", `{"orgs":{"org1msp":"Org1MSP","org2msp":"Org2MSP"},"features":{"keyLevelEndorsement":true}}`)
+	expectEndorsingOrg(t, ledger, "coin1", "")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "reapplyEndorsementPolicies", "1")
+	expectEndorsingOrg(t, ledger, "coin1", "Org1MSP")
+	expectEndorsingOrg(t, ledger, "coin2", "")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "reapplyEndorsementPolicies", "1", "coin2")
+	expectEndorsingOrg(t, ledger, "coin2", "Org2MSP")
+
+	ledger.mustInvoke(t, cc, "org1msp/admin", "updateConfig", `{"features":{"keyLevelEndorsement":false}}`)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "reapplyEndorsementPolicies", "100")
+	expectEndorsingOrg(t, ledger, "coin1", "")
+	expectEndorsingOrg(t, ledger, "coin2", "")
+}
+
+func TestEndorsementClearedWhileDisabled(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, endorsementTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	expectEndorsingOrg(t, ledger, "coin1", "Org1MSP")
+
+	// the policy for tom must not survive a transfer to jerry
+	ledger.mustInvoke(t, cc, "org1msp/admin", "updateConfig", `{"features":{"keyLevelEndorsement":false}}`)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	expectEndorsingOrg(t, ledger, "coin1", "")
+}
+
+func TestEndorsementReapplySkipsBadCoins(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"]},"orgs":{"org1msp":"Org1MSP"}}`)
+	for _, name := range []string{"coin1", "coin2", "coin3", "coin4"} {
+		ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", name, "adollar", "org1msp/tom")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "delete", "coin2")
+	// a coin that does not decode and a simple key that is not a coin at all
+	for key, value := range map[string]string{"coin3": "[]", "aaa": `{"docType":"other"}`} {
+		stub := ledger.newStub("org1msp/admin", "seed")
+		if err := stub.PutState(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		ledger.commit(stub)
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "updateConfig", `{"features":{"keyLevelEndorsement":true}}`)
+
+	page := &struct {
+		Processed int    `json:"processed"`
+		Skipped   int    `json:"skipped"`
+		Bookmark  string `json:"bookmark"`
+	}{}
+	if err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/admin", "reapplyEndorsementPolicies", "3"), page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Processed != 1 || page.Skipped != 2 || page.Bookmark != "coin4" {
+		t.Errorf("first page is %+v", page)
+	}
+	expectEndorsingOrg(t, ledger, "coin1", "Org1MSP")
+	expectEndorsingOrg(t, ledger, "coin4", "")
+	if _, ok := ledger.eps["aaa"]; ok {
+		t.Errorf("a policy was set on a document that is not a coin")
+	}
+
+	if err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/admin", "reapplyEndorsementPolicies", "3", page.Bookmark), page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Processed != 1 || page.Skipped != 0 || page.Bookmark != "" {
+		t.Errorf("last page is %+v", page)
+	}
+	expectEndorsingOrg(t, ledger, "coin4", "Org1MSP")
+}
@@ -0,0 +1,554 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// The fake stub runs the chaincode against an in-memory ledger that behaves like a
+// peer where it matters for the chaincode: a transaction reads the committed state
+// only, never its own writes, and is validated when its block is committed. A
+// transaction is invalid if a key it read has changed since (an MVCC read conflict),
+// or if a range it read now returns other keys (a phantom read conflict). Several
+// transactions endorsed against the same state and committed in one block model
+// concurrent clients.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// fakeVersion is the height of the transaction that last wrote a key, zero if absent.
+type fakeVersion struct {
+	block, tx uint64
+}
+
+type fakeValue struct {
+	value   []byte
+	version fakeVersion
+}
+
+type fakeLedger struct {
+	state   map[string]fakeValue
+	sorted  []string //keys of state in order, nil when stale
+	history map[string][]*queryresult.KeyModification
+	eps     map[string][]byte //key-level endorsement policies
+	height  uint64
+	clock   time.Time //timestamp of the next transaction, advanced a second per transaction
+	txs     int
+	creator map[string][]byte //serialized identity per "mspid/cn"
+	signer  *ecdsa.PrivateKey
+}
+
+func newFakeLedger() *fakeLedger {
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return &fakeLedger{
+		state:   map[string]fakeValue{},
+		history: map[string][]*queryresult.KeyModification{},
+		eps:     map[string][]byte{},
+		clock:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		creator: map[string][]byte{},
+		signer:  signer,
+	}
+}
+
+// serializedIdentity returns the creator of transactions submitted by identity, an
+// X.509 certificate with the common name after the slash, issued to the MSP before it.
+func (l *fakeLedger) serializedIdentity(identity string) []byte {
+	if creator, ok := l.creator[identity]; ok {
+		return creator
+	}
+	mspID, commonName, ok := strings.Cut(identity, "/")
+	if !ok {
+		panic("identity must be mspid/cn: " + identity)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(len(l.creator) + 1)),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &l.signer.PublicKey, l.signer)
+	if err != nil {
+		panic(err)
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+	})
+	if err != nil {
+		panic(err)
+	}
+	l.creator[identity] = creator
+	return creator
+}
+
+// keys returns the keys of the committed state in order.
+func (l *fakeLedger) keys() []string {
+	if l.sorted == nil {
+		l.sorted = make([]string, 0, len(l.state))
+		for key := range l.state {
+			l.sorted = append(l.sorted, key)
+		}
+		sort.Strings(l.sorted)
+	}
+	return l.sorted
+}
+
+// scan returns the committed keys in [start, end), end "" for no bound, at most limit
+// of them if limit > 0.
+func (l *fakeLedger) scan(start, end string, limit int) []fakeRead {
+	keys := l.keys()
+	reads := []fakeRead{}
+	for i := sort.SearchStrings(keys, start); i < len(keys); i++ {
+		if (len(end) > 0 && keys[i] >= end) || (limit > 0 && len(reads) == limit) {
+			break
+		}
+		reads = append(reads, fakeRead{key: keys[i], version: l.state[keys[i]].version})
+	}
+	return reads
+}
+
+// newStub starts a transaction of identity that calls function with args.
+func (l *fakeLedger) newStub(identity string, function string, args ...string) *fakeStub {
+	l.txs++
+	stub := &fakeStub{
+		ledger:    l,
+		txID:      fmt.Sprintf("tx%06d", l.txs),
+		args:      [][]byte{[]byte(function)},
+		creator:   l.serializedIdentity(identity),
+		timestamp: &timestamp.Timestamp{Seconds: l.clock.Unix(), Nanos: int32(l.clock.Nanosecond())},
+		reads:     map[string]fakeVersion{},
+		writes:    map[string][]byte{},
+		eps:       map[string][]byte{},
+		events:    map[string][]byte{},
+	}
+	for _, arg := range args {
+		stub.args = append(stub.args, []byte(arg))
+	}
+	l.clock = l.clock.Add(time.Second)
+	return stub
+}
+
+// commit validates the transactions in order, like the peers committing one block,
+// and applies the writes of the valid ones. Returns whether each was valid.
+func (l *fakeLedger) commit(stubs ...*fakeStub) []bool {
+	l.height++
+	valid := make([]bool, len(stubs))
+	for i, stub := range stubs {
+		valid[i] = stub.validate()
+		if !valid[i] {
+			continue
+		}
+		version := fakeVersion{block: l.height, tx: uint64(i)}
+		for key, value := range stub.writes {
+			modification := &queryresult.KeyModification{TxId: stub.txID, Value: value, Timestamp: stub.timestamp, IsDelete: value == nil}
+			l.history[key] = append(l.history[key], modification)
+			_, exists := l.state[key]
+			if value == nil {
+				delete(l.state, key)
+				delete(l.eps, key)
+			} else {
+				l.state[key] = fakeValue{value: value, version: version}
+			}
+			if exists != (value != nil) {
+				l.resort(key, value != nil)
+			}
+		}
+		for key, ep := range stub.eps {
+			if ep == nil {
+				delete(l.eps, key)
+			} else {
+				l.eps[key] = ep
+			}
+		}
+	}
+	return valid
+}
+
+// resort adds a new key to, or removes a deleted key from, the sorted keys.
+func (l *fakeLedger) resort(key string, added bool) {
+	if l.sorted == nil {
+		return
+	}
+	i := sort.SearchStrings(l.sorted, key)
+	if added {
+		l.sorted = append(l.sorted, "")
+		copy(l.sorted[i+1:], l.sorted[i:])
+		l.sorted[i] = key
+	} else {
+		l.sorted = append(l.sorted[:i], l.sorted[i+1:]...)
+	}
+}
+
+// invoke runs function as identity in a transaction of its own and commits it if the
+// chaincode returned success.
+func (l *fakeLedger) invoke(cc *SimpleChaincode, identity string, function string, args ...string) pb.Response {
+	stub := l.newStub(identity, function, args...)
+	response := cc.Invoke(stub)
+	if response.Status == shim.OK && !l.commit(stub)[0] {
+		return shim.Error("transaction was invalidated")
+	}
+	return response
+}
+
+// mustInvoke is invoke for steps that are expected to succeed.
+func (l *fakeLedger) mustInvoke(tb testing.TB, cc *SimpleChaincode, identity string, function string, args ...string) []byte {
+	tb.Helper()
+	response := l.invoke(cc, identity, function, args...)
+	if response.Status != shim.OK {
+		tb.Fatalf("%s%v failed: %s", function, args, response.Message)
+	}
+	return response.Payload
+}
+
+// clone returns a copy of the ledger that can be changed independently.
+func (l *fakeLedger) clone() *fakeLedger {
+	c := *l
+	c.state = make(map[string]fakeValue, len(l.state))
+	for key, value := range l.state {
+		c.state[key] = value
+	}
+	c.sorted = nil
+	c.history = make(map[string][]*queryresult.KeyModification, len(l.history))
+	for key, modifications := range l.history {
+		c.history[key] = modifications[:len(modifications):len(modifications)]
+	}
+	c.eps = make(map[string][]byte, len(l.eps))
+	for key, ep := range l.eps {
+		c.eps[key] = ep
+	}
+	c.creator = make(map[string][]byte, len(l.creator))
+	for identity, creator := range l.creator {
+		c.creator[identity] = creator
+	}
+	return &c
+}
+
+// newFakeChaincode returns a ledger with the chaincode initialized with configJSON.
+func newFakeChaincode(tb testing.TB, configJSON string) (*fakeLedger, *SimpleChaincode) {
+	tb.Helper()
+	ledger := newFakeLedger()
+	cc := &SimpleChaincode{}
+	stub := ledger.newStub("org1msp/admin", "init", configJSON)
+	response := cc.Init(stub)
+	if response.Status != shim.OK {
+		tb.Fatalf("init failed: %s", response.Message)
+	}
+	ledger.commit(stub)
+	return ledger, cc
+}
+
+type fakeRead struct {
+	key     string
+	version fakeVersion
+}
+
+// fakeRange is a range read, recorded up to the last key the chaincode iterated to.
+type fakeRange struct {
+	start, end string
+	limit      int
+	reads      []fakeRead
+	exhausted  bool
+}
+
+type fakeStub struct {
+	shim.ChaincodeStubInterface //not implemented, the chaincode does not use the rest
+
+	ledger    *fakeLedger
+	txID      string
+	args      [][]byte
+	creator   []byte
+	timestamp *timestamp.Timestamp
+	reads     map[string]fakeVersion
+	ranges    []*fakeRange
+	writes    map[string][]byte //nil value for a delete
+	eps       map[string][]byte //nil policy to remove it
+	events    map[string][]byte
+	paginated bool //a paginated query was run, peers then reject writes
+
+	// keysRead and keysWritten count state accesses, for the benchmarks
+	keysRead, keysWritten int
+}
+
+// validate reports whether the reads of the transaction still hold.
+func (s *fakeStub) validate() bool {
+	for key, version := range s.reads {
+		if s.ledger.state[key].version != version {
+			return false
+		}
+	}
+	for _, r := range s.ranges {
+		end := r.end
+		if !r.exhausted {
+			if len(r.reads) == 0 {
+				continue
+			}
+			end = r.reads[len(r.reads)-1].key + "\x00"
+		}
+		current := s.ledger.scan(r.start, end, r.limit)
+		if len(current) != len(r.reads) {
+			return false
+		}
+		for i := range current {
+			if current[i] != r.reads[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *fakeStub) GetArgs() [][]byte { return s.args }
+
+func (s *fakeStub) GetStringArgs() []string {
+	args := []string{}
+	for _, arg := range s.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (s *fakeStub) GetFunctionAndParameters() (string, []string) {
+	args := s.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+func (s *fakeStub) GetTxID() string                               { return s.txID }
+func (s *fakeStub) GetChannelID() string                          { return "myc1" }
+func (s *fakeStub) GetCreator() ([]byte, error)                   { return s.creator, nil }
+func (s *fakeStub) GetTxTimestamp() (*timestamp.Timestamp, error) { return s.timestamp, nil }
+
+func (s *fakeStub) SetEvent(name string, payload []byte) error {
+	s.events[name] = payload
+	return nil
+}
+
+func (s *fakeStub) GetState(key string) ([]byte, error) {
+	s.keysRead++
+	value := s.ledger.state[key]
+	s.reads[key] = value.version
+	return value.value, nil
+}
+
+// checkWrite fails like a peer's transaction simulator does on a write after a
+// paginated query.
+func (s *fakeStub) checkWrite() error {
+	if s.paginated {
+		return fmt.Errorf("txSimulator does not support paginated queries and write operation")
+	}
+	return nil
+}
+
+func (s *fakeStub) PutState(key string, value []byte) error {
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("key must not be an empty string")
+	}
+	if len(value) == 0 {
+		return fmt.Errorf("value must not be empty, use DelState")
+	}
+	s.keysWritten++
+	s.writes[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *fakeStub) DelState(key string) error {
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	s.keysWritten++
+	s.writes[key] = nil
+	return nil
+}
+
+func (s *fakeStub) SetStateValidationParameter(key string, ep []byte) error {
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	s.eps[key] = ep
+	return nil
+}
+
+func (s *fakeStub) GetStateValidationParameter(key string) ([]byte, error) {
+	return s.ledger.eps[key], nil
+}
+
+func (s *fakeStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return shim.CreateCompositeKey(objectType, attributes)
+}
+
+func (s *fakeStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	return (&shim.ChaincodeStub{}).SplitCompositeKey(compositeKey)
+}
+
+// rangeRead starts a range read and returns an iterator that records it. Like a
+// LevelDB iterator it only visits the keys the chaincode iterates to.
+func (s *fakeStub) rangeRead(start, end string, limit int) *fakeIterator {
+	r := &fakeRange{start: start, end: end, limit: limit}
+	s.ranges = append(s.ranges, r)
+	keys := s.ledger.keys()
+	return &fakeIterator{stub: s, r: r, keys: keys[sort.SearchStrings(keys, start):]}
+}
+
+func (s *fakeStub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if strings.HasPrefix(startKey, "\x00") || strings.HasPrefix(endKey, "\x00") {
+		return nil, fmt.Errorf("range query keys must not be composite keys")
+	}
+	if startKey == "" {
+		startKey = "\x01"
+	}
+	return s.rangeRead(startKey, endKey, 0), nil
+}
+
+func (s *fakeStub) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := shim.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	return s.rangeRead(prefix, prefix+string(rune(0x10FFFF)), 0), nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination pages like LevelDB: the bookmark is the
+// first key of the next page, empty after the last page. Like on a peer, it fails after
+// a write and makes later writes fail.
+func (s *fakeStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	prefix, err := shim.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.pagedRead(prefix, prefix+string(rune(0x10FFFF)), pageSize, bookmark)
+}
+
+// GetStateByRangeWithPagination pages over simple keys like
+// GetStateByPartialCompositeKeyWithPagination.
+func (s *fakeStub) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	if strings.HasPrefix(startKey, "\x00") || strings.HasPrefix(endKey, "\x00") {
+		return nil, nil, fmt.Errorf("range query keys must not be composite keys")
+	}
+	if startKey == "" {
+		startKey = "\x01"
+	}
+	return s.pagedRead(startKey, endKey, pageSize, bookmark)
+}
+
+func (s *fakeStub) pagedRead(start, end string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	if len(s.writes) > 0 || len(s.eps) > 0 {
+		return nil, nil, fmt.Errorf("txSimulator does not support paginated queries and write operation")
+	}
+	s.paginated = true
+	if len(bookmark) > 0 {
+		start = bookmark
+	}
+	results := s.ledger.scan(start, end, int(pageSize)+1)
+	metadata := &pb.QueryResponseMetadata{}
+	if len(results) > int(pageSize) {
+		metadata.Bookmark = results[pageSize].key
+		results = results[:pageSize]
+	}
+	metadata.FetchedRecordsCount = int32(len(results))
+	return s.rangeRead(start, end, int(pageSize)), metadata, nil
+}
+
+func (s *fakeStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, fmt.Errorf("rich queries are only supported with CouchDB")
+}
+
+func (s *fakeStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	return nil, nil, fmt.Errorf("rich queries are only supported with CouchDB")
+}
+
+// GetHistoryForKey returns the modifications newest first, like the history database.
+func (s *fakeStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	history := s.ledger.history[key]
+	modifications := make([]*queryresult.KeyModification, len(history))
+	for i, modification := range history {
+		modifications[len(history)-1-i] = modification
+	}
+	return &fakeHistoryIterator{modifications: modifications}, nil
+}
+
+type fakeIterator struct {
+	stub     *fakeStub
+	r        *fakeRange
+	keys     []string //committed keys in order, from the start of the range on
+	position int
+}
+
+func (it *fakeIterator) HasNext() bool {
+	if it.position < len(it.keys) && (len(it.r.end) == 0 || it.keys[it.position] < it.r.end) && (it.r.limit <= 0 || it.position < it.r.limit) {
+		return true
+	}
+	it.r.exhausted = true
+	return false
+}
+
+func (it *fakeIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, fmt.Errorf("iterator is exhausted")
+	}
+	key := it.keys[it.position]
+	it.position++
+	value := it.stub.ledger.state[key]
+	it.r.reads = append(it.r.reads, fakeRead{key: key, version: value.version})
+	it.stub.keysRead++
+	return &queryresult.KV{Namespace: "coins", Key: key, Value: value.value}, nil
+}
+
+func (it *fakeIterator) Close() error { return nil }
+
+type fakeHistoryIterator struct {
+	modifications []*queryresult.KeyModification
+	position      int
+}
+
+func (it *fakeHistoryIterator) HasNext() bool { return it.position < len(it.modifications) }
+
+func (it *fakeHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	if it.position >= len(it.modifications) {
+		return nil, fmt.Errorf("iterator is exhausted")
+	}
+	it.position++
+	return it.modifications[it.position-1], nil
+}
+
+func (it *fakeHistoryIterator) Close() error { return nil }
@@ -0,0 +1,310 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Fuzz targets ====
+//
+// FuzzInvoke runs a short script of calls with arbitrary function names and arguments
+// against a small ledger, and FuzzStoredCoin runs the functions that decode coins
+// against arbitrary bytes stored as a coin. Neither may panic, every error response
+// must be well formed, and after every committed call the indexes, balances and supply
+// records must agree with the coins.
+//
+//	go test -run '^$' -fuzz FuzzInvoke -fuzztime 60s
+//	go test -run '^$' -fuzz FuzzStoredCoin -fuzztime 60s
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const fuzzConfig = `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"],"regulator":["org1msp/admin"]},"recoveryAccount":"recovery"}`
+
+// fuzzIdentities are the callers the scripts run as.
+var fuzzIdentities = []string{"org1msp/admin", "org1msp/tom", "org2msp/jerry"}
+
+var (
+	fuzzBaseOnce   sync.Once
+	fuzzBaseLedger *fakeLedger
+)
+
+// fuzzLedger returns a copy of a ledger holding a few coins, seeded once per process.
+func fuzzLedger(tb testing.TB) (*fakeLedger, *SimpleChaincode) {
+	tb.Helper()
+	cc := &SimpleChaincode{}
+	fuzzBaseOnce.Do(func() {
+		ledger, _ := newFakeChaincode(tb, fuzzConfig)
+		ledger.mustInvoke(tb, cc, "org1msp/tom", "initCoin", "coin1", "aDollar", "org1msp/tom")
+		ledger.mustInvoke(tb, cc, "org1msp/tom", "initCoin", "coin2", "aCent", "org1msp/tom")
+		ledger.mustInvoke(tb, cc, "org2msp/jerry", "initCoin", "coin3", "aDollar", "org2msp/jerry")
+		ledger.mustInvoke(tb, cc, "org1msp/tom", "transferCoin", "coin2", "org2msp/jerry")
+		for _, identity := range fuzzIdentities {
+			ledger.serializedIdentity(identity)
+		}
+		fuzzBaseLedger = ledger
+	})
+	if fuzzBaseLedger == nil {
+		tb.Fatal("seeding the fuzz ledger failed")
+	}
+	return fuzzBaseLedger.clone(), cc
+}
+
+// invokedFunctions lists the functions Invoke dispatches, read from its source.
+func invokedFunctions(tb testing.TB) []string {
+	tb.Helper()
+	source, err := os.ReadFile("coin.go")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	functions := []string{}
+	for _, match := range regexp.MustCompile(`function == "(\w+)"`).FindAllStringSubmatch(string(source), -1) {
+		functions = append(functions, match[1])
+	}
+	if len(functions) == 0 {
+		tb.Fatal("no functions found in Invoke")
+	}
+	return functions
+}
+
+// checkResponse fails if response is an error response that is not well formed: a
+// peer only accepts a status of 400 or more with a message, and the message has to be
+// valid UTF-8 to be marshalled.
+func checkResponse(tb testing.TB, call string, response pb.Response) {
+	tb.Helper()
+	if response.Status == shim.OK {
+		return
+	}
+	if response.Status != shim.ERROR {
+		tb.Errorf("%s returned status %d", call, response.Status)
+	}
+	if len(response.Message) == 0 {
+		tb.Errorf("%s returned an error without a message", call)
+	}
+	if !utf8.ValidString(response.Message) {
+		tb.Errorf("%s returned a message that is not valid UTF-8: %q", call, response.Message)
+	}
+	if response.Payload != nil {
+		tb.Errorf("%s returned a payload with an error", call)
+	}
+}
+
+// checkLedgerConsistency fails unless every coin is in the amount and owner indexes,
+// every index entry belongs to a coin, and the balances and supply records count the
+// coins there are.
+func checkLedgerConsistency(tb testing.TB, ledger *fakeLedger) {
+	tb.Helper()
+	stub := ledger.newStub("org1msp/admin", "check")
+	indexed := map[string]bool{}
+	held := map[string]map[string]int64{}
+	circulating := map[string]int64{}
+	for key, value := range ledger.state {
+		if strings.HasPrefix(key, "\x00") {
+			continue
+		}
+		c, err := decodeCoin(key, value.value)
+		if err != nil {
+			tb.Errorf("stored coin does not decode: %s", err)
+			continue
+		}
+		for _, indexName := range []string{amountNameIndex, ownerAmountNameIndex} {
+			entry, err := indexKey(stub, indexName, c)
+			if err != nil {
+				tb.Errorf("coin %q cannot be indexed: %s", key, err)
+				continue
+			}
+			if _, ok := ledger.state[entry]; !ok {
+				tb.Errorf("coin %q is missing from the %s index", key, indexName)
+			}
+			indexed[entry] = true
+		}
+		if held[c.Owner] == nil {
+			held[c.Owner] = map[string]int64{}
+		}
+		held[c.Owner][c.Amount]++
+		circulating[c.Amount]++
+	}
+
+	balances := map[string]map[string]int64{}
+	supplies := map[string]int64{}
+	for key, value := range ledger.state {
+		if !strings.HasPrefix(key, "\x00") {
+			continue
+		}
+		objectType, attributes, err := stub.SplitCompositeKey(key)
+		if err != nil {
+			tb.Errorf("composite key %q does not split: %s", key, err)
+			continue
+		}
+		switch objectType {
+		case amountNameIndex, ownerAmountNameIndex:
+			if !indexed[key] {
+				tb.Errorf("%s entry %q does not belong to a coin", objectType, attributes)
+			}
+		case balanceIndex:
+			delta := &balanceDelta{}
+			err = json.Unmarshal(value.value, delta)
+			if err != nil {
+				tb.Errorf("balance record %q does not decode: %s", attributes, err)
+				continue
+			}
+			if balances[attributes[0]] == nil {
+				balances[attributes[0]] = map[string]int64{}
+			}
+			for amount, count := range delta.Coins {
+				balances[attributes[0]][amount] += count
+			}
+		case supplyObjectType:
+			delta := &supplyDelta{}
+			err = json.Unmarshal(value.value, delta)
+			if err != nil {
+				tb.Errorf("supply record %q does not decode: %s", attributes, err)
+				continue
+			}
+			supplies[attributes[0]] += delta.Created - delta.Destroyed
+		}
+	}
+
+	for account, coins := range balances {
+		for amount, count := range coins {
+			if count != held[account][amount] {
+				tb.Errorf("balance of %s counts %d %s coins, it holds %d", account, count, amount, held[account][amount])
+			}
+		}
+	}
+	for account, coins := range held {
+		for amount, count := range coins {
+			if count != balances[account][amount] {
+				tb.Errorf("%s holds %d %s coins, its balance counts %d", account, count, amount, balances[account][amount])
+			}
+		}
+	}
+	for amount, count := range circulating {
+		if supplies[amount] != count {
+			tb.Errorf("supply of %s is %d, there are %d coins", amount, supplies[amount], count)
+		}
+	}
+	for amount, count := range supplies {
+		if count != circulating[amount] {
+			tb.Errorf("supply of %s is %d, there are %d coins", amount, count, circulating[amount])
+		}
+	}
+}
+
+// runFuzzCall invokes one call, commits it if it succeeded and checks the ledger.
+func runFuzzCall(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, identity string, function string, args ...string) pb.Response {
+	t.Helper()
+	call := fmt.Sprintf("%s%q as %s", function, args, identity)
+	stub := ledger.newStub(identity, function, args...)
+	response := cc.Invoke(stub)
+	checkResponse(t, call, response)
+	if response.Status == shim.OK {
+		if !ledger.commit(stub)[0] {
+			t.Errorf("%s was invalidated on its own", call)
+		}
+		checkLedgerConsistency(t, ledger)
+	}
+	return response
+}
+
+// FuzzInvoke runs up to four calls, one per line of script, each a function name and
+// its arguments separated by "|".
+func FuzzInvoke(f *testing.F) {
+	quietStdout(f)
+	for _, function := range invokedFunctions(f) {
+		f.Add(uint8(0), function)
+		f.Add(uint8(1), function+"|coin1")
+		f.Add(uint8(1), function+"|coin1|org2msp/jerry")
+		f.Add(uint8(0), function+"|coin2|acent|org1msp/tom")
+		f.Add(uint8(2), function+"|org1msp/tom|10|adollar|{}")
+	}
+	f.Add(uint8(1), "transferCoin|coin1|org2msp/jerry\ntransferCoinsBasedOnAmount|adollar|org1msp/tom\ndelete|coin3")
+	f.Add(uint8(0), "mint|coin9|acent|bob\nburn|coin9\nrebuildIndexes|10")
+	f.Add(uint8(0), "initCoin|coin\x00|acent|bob\ninitCoin|coin4|\xff|bob\ngetCoinsByRange||")
+
+	f.Fuzz(func(t *testing.T, who uint8, script string) {
+		ledger, cc := fuzzLedger(t)
+		for i, line := range strings.SplitN(script, "\n", 5) {
+			if i == 4 {
+				break
+			}
+			fields := strings.Split(line, "|")
+			identity := fuzzIdentities[(int(who)+i)%len(fuzzIdentities)]
+			runFuzzCall(t, ledger, cc, identity, fields[0], fields[1:]...)
+		}
+	})
+}
+
+// FuzzStoredCoin replaces the stored coin1 with value, leaving its index entries, and
+// endorses the functions that decode it, as an admin or as the owner of coin1 in the
+// seeds. Those that change the coin must fail unless it decodes.
+func FuzzStoredCoin(f *testing.F) {
+	quietStdout(f)
+	f.Add([]byte(`{"docType":"coin","name":"coin1","amount":"adollar","owner":"org1msp/tom"}`))
+	f.Add([]byte(`{"docType":"coin","name":"coin7","amount":"adollar","owner":"org1msp/tom"}`))
+	f.Add([]byte(`{"name":"coin1","amount":"","owner":""}`))
+	f.Add([]byte(`{"name":"coin1","amount":"adollar","owner":"org1msp/tom","memo":null,"createdAt":"yesterday"}`))
+	f.Add([]byte(`{"name":"coin1","amount":"a\u0000b","owner":"org1msp/tom"}`))
+	f.Add([]byte(`[]`))
+	f.Add([]byte(`null`))
+	f.Add([]byte("\xff"))
+
+	calls := []struct {
+		identity string
+		args     []string
+		decodes  bool //fails unless the coin decodes
+	}{
+		{"org1msp/admin", []string{"readCoin", "coin1"}, false},
+		{"org1msp/tom", []string{"transferCoin", "coin1", "org2msp/jerry"}, true},
+		{"org1msp/tom", []string{"delete", "coin1"}, true},
+		{"org1msp/admin", []string{"getCoinsByRange", "coin0", "coin9"}, false},
+		{"org1msp/admin", []string{"getHistoryForCoin", "coin1"}, false},
+		{"org1msp/admin", []string{"stateAsOf", "2100-01-01T00:00:00Z", "10"}, false},
+		{"org1msp/admin", []string{"rebuildIndexes", "10"}, true},
+		{"org1msp/admin", []string{"reapplyEndorsementPolicies", "10"}, false}, //skips the coin
+		{"org1msp/admin", []string{"compactBalances", "org1msp/tom"}, false},
+	}
+	f.Fuzz(func(t *testing.T, value []byte) {
+		if len(value) == 0 {
+			return
+		}
+		ledger, cc := fuzzLedger(t)
+		ledger.state["coin1"] = fakeValue{value: value, version: fakeVersion{block: ledger.height + 1}}
+		_, err := decodeCoin("coin1", value)
+
+		for _, call := range calls {
+			stub := ledger.newStub(call.identity, call.args[0], call.args[1:]...)
+			response := cc.Invoke(stub)
+			name := fmt.Sprintf("%s%q on %q", call.args[0], call.args[1:], value)
+			checkResponse(t, name, response)
+			if response.Status == shim.OK && call.decodes && err != nil {
+				t.Errorf("%s succeeded, the coin does not decode: %s", name, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,534 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Coin history ====
+//
+// getHistoryForCoin returns one entry per modification of a coin, with RFC3339 UTC
+// timestamps, the type of change and the change it made to the owner and amount:
+//
+//	{"entries":[{"txId":"...","timestamp":"2024-03-01T09:30:00Z","isDelete":false,
+//	  "changeType":"transfer","value":{...},"diff":{"owner":{"from":"org1msp/tom","to":"org2msp/jerry"}}}],
+//	 "bookmark":"<txid>"}
+//
+// Transfers made by forceTransfer or clawback carry the record of the regulatory action
+// under regulatoryAction, ordinary transfers have none.
+//
+// The optional filter is a JSON document, all fields optional:
+//
+//	from, to      RFC3339 bounds on the timestamp, inclusive
+//	changeType    create, transfer, update (e.g. a lock) or delete
+//	counterparty  an owner before or after the change
+//	order         newest (the default) or oldest first
+//	pageSize      entries per page, at most the configured maxPageSize
+//	bookmark      the bookmark returned with the previous page
+//	skipCorrupt   leave out entries whose value is not valid JSON
+//	maxBytes      budget for the entries of the response, see results.go
+//
+// ==== Point-in-time queries ====
+//
+// stateAsOf rebuilds every coin as it was at a given time from the history of its
+// key, ownerHoldingsAsOf does the same for the coins of one owner. Deleted coins have
+// no state left to range over, so every coin ever created is registered under
+// coinreg~name and the queries page over that register. Coins created before the
+// register existed are added to it by rebuildIndexes, coins deleted before that are
+// not known to these queries.
+//
+// Both return one page of records in the envelope of results.go, with the
+// bookmark of the next page. An optional last argument takes the options of
+// results.go, the bookmark argument takes precedence over the one in the options.
+// Coins that did not exist at the time are left out, so a page may hold fewer
+// records than the page size. The history database must be enabled on the peer.
+//
+// A page reads the history of page size coins of the register, newest first down to
+// the time asked for. ownerHoldingsAsOf has no register of past owners to go by, so
+// it reads the same coins as stateAsOf and leaves out those of other owners: a full
+// pass costs as much as one of stateAsOf, whatever the owner holds, and most of its
+// pages may be empty. Clients keep paging until the bookmark is empty.
+//
+// peer chaincode query -C myc1 -n coins -c '{"Args":["stateAsOf","2024-12-31T23:59:59Z","100"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["ownerHoldingsAsOf","org1msp/tom","2024-12-31T23:59:59Z","100","<bookmark>"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	coinRegisterIndex = "coinreg~name"
+
+	changeCreate   = "create"
+	changeTransfer = "transfer"
+	changeUpdate   = "update"
+	changeDelete   = "delete"
+
+	orderNewest = "newest"
+	orderOldest = "oldest"
+)
+
+type valueChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type historyEntry struct {
+	TxID       string                 `json:"txId"`
+	Timestamp  string                 `json:"timestamp"`
+	IsDelete   bool                   `json:"isDelete"`
+	ChangeType string                 `json:"changeType"`
+	Value      json.RawMessage        `json:"value"` //null when deleted
+	Diff       map[string]valueChange `json:"diff,omitempty"`
+	Regulatory *regulatoryAction      `json:"regulatoryAction,omitempty"` //set for forceTransfer and clawback
+
+	at     time.Time
+	coin   *coin    //nil when deleted
+	owners []string //owner before and after the change
+}
+
+type historyFilter struct {
+	From         string `json:"from"`
+	To           string `json:"to"`
+	ChangeType   string `json:"changeType"`
+	Counterparty string `json:"counterparty"`
+	Order        string `json:"order"`
+	PageSize     int32  `json:"pageSize"`
+	resultOptions
+
+	from, to time.Time
+}
+
+// ===================================================================================
+// parseHistoryFilter decodes and validates a history filter, empty for no filter
+// ===================================================================================
+func parseHistoryFilter(filterJSON string, config *chaincodeConfig) (*historyFilter, error) {
+	filter := &historyFilter{}
+	if len(strings.TrimSpace(filterJSON)) > 0 {
+		decoder := json.NewDecoder(strings.NewReader(filterJSON))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(filter)
+		if err != nil {
+			return nil, fmt.Errorf("filter must be a JSON document: %s", err)
+		}
+	}
+
+	var err error
+	if len(filter.From) > 0 {
+		filter.from, err = time.Parse(time.RFC3339, filter.From)
+		if err != nil {
+			return nil, fmt.Errorf("from must be an RFC3339 timestamp")
+		}
+	}
+	if len(filter.To) > 0 {
+		filter.to, err = time.Parse(time.RFC3339, filter.To)
+		if err != nil {
+			return nil, fmt.Errorf("to must be an RFC3339 timestamp")
+		}
+	}
+	switch filter.ChangeType {
+	case "", changeCreate, changeTransfer, changeUpdate, changeDelete:
+	default:
+		return nil, fmt.Errorf("unknown change type: %s", filter.ChangeType)
+	}
+	switch filter.Order {
+	case "":
+		filter.Order = orderNewest
+	case orderNewest, orderOldest:
+	default:
+		return nil, fmt.Errorf("order must be %s or %s", orderNewest, orderOldest)
+	}
+	if filter.PageSize == 0 {
+		filter.PageSize = config.MaxPageSize
+	}
+	if filter.PageSize < 0 || filter.PageSize > config.MaxPageSize {
+		return nil, fmt.Errorf("pageSize must be between 1 and %d", config.MaxPageSize)
+	}
+	filter.Counterparty = normalizeIdentity(filter.Counterparty)
+	err = filter.resultOptions.validate(config)
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func (f *historyFilter) matches(entry *historyEntry) bool {
+	if !f.from.IsZero() && entry.at.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && entry.at.After(f.to) {
+		return false
+	}
+	if len(f.ChangeType) > 0 && entry.ChangeType != f.ChangeType {
+		return false
+	}
+	if len(f.Counterparty) > 0 && !containsString(entry.owners, f.Counterparty) {
+		return false
+	}
+	return true
+}
+
+// ===================================================================================
+// writeHistory writes the requested page of the history of a coin to results. Returns
+// the bookmark, the transaction ID of the first matching entry not written.
+//
+// The history database returns the modifications of a key newest first, in the order
+// they were committed. That order is kept, and reversed for oldest first, rather than
+// sorting by the timestamps the clients chose, which may be equal or out of order.
+// Newest first the entries are read only up to the end of the page. Oldest first the
+// whole history has to be read to reverse it.
+// ===================================================================================
+func (f *historyFilter) writeHistory(stub shim.ChaincodeStubInterface, coinName string, results *resultWriter) (string, error) {
+	resultsIterator, err := stub.GetHistoryForKey(coinName)
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+
+	history := &historyReader{coinName: coinName, iterator: resultsIterator, results: results}
+	if f.Order == orderOldest {
+		history.modifications = []*queryresult.KeyModification{}
+		for resultsIterator.HasNext() {
+			modification, err := resultsIterator.Next()
+			if err != nil {
+				return "", err
+			}
+			history.modifications = append(history.modifications, modification)
+		}
+	}
+
+	page := &historyPage{stub: stub, coinName: coinName, filter: f, results: results, started: len(f.Bookmark) <= 0}
+	if f.Order == orderOldest {
+		var previous *historyEntry
+		for {
+			entry, err := history.next()
+			if err != nil || entry == nil {
+				return page.end(err)
+			}
+			entry.describe(previous)
+			previous = entry
+			done, err := page.add(entry)
+			if err != nil || done {
+				return page.bookmark, err
+			}
+		}
+	}
+
+	entry, err := history.next()
+	for entry != nil && err == nil {
+		var older *historyEntry
+		older, err = history.next()
+		if err != nil {
+			break
+		}
+		entry.describe(older)
+		done, err := page.add(entry)
+		if err != nil || done {
+			return page.bookmark, err
+		}
+		entry = older
+	}
+	return page.end(err)
+}
+
+// historyReader reads the modifications of a coin in the order of the page, newest
+// first from the iterator, oldest first from the modifications read before.
+type historyReader struct {
+	coinName      string
+	iterator      shim.HistoryQueryIteratorInterface
+	modifications []*queryresult.KeyModification //oldest first only, read from the end
+	results       *resultWriter
+}
+
+// next returns the next modification whose value can be decoded, nil after the last.
+// Modifications whose value cannot be decoded are passed to results.skip by
+// transaction ID.
+func (r *historyReader) next() (*historyEntry, error) {
+	for {
+		var modification *queryresult.KeyModification
+		if r.modifications != nil {
+			if len(r.modifications) == 0 {
+				return nil, nil
+			}
+			modification = r.modifications[len(r.modifications)-1]
+			r.modifications = r.modifications[:len(r.modifications)-1]
+		} else {
+			if !r.iterator.HasNext() {
+				return nil, nil
+			}
+			var err error
+			modification, err = r.iterator.Next()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		entry := &historyEntry{TxID: modification.TxId, IsDelete: modification.IsDelete}
+		if modification.Timestamp != nil {
+			entry.at = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC()
+		}
+		entry.Timestamp = entry.at.Format(time.RFC3339)
+		if modification.IsDelete {
+			return entry, nil
+		}
+		entry.Value = modification.Value
+		entry.coin = &coin{}
+		err := json.Unmarshal(entry.Value, entry.coin)
+		if err == nil {
+			return entry, nil
+		}
+		err = r.results.skip(entry.TxID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode history of %s in transaction %s: %w", r.coinName, entry.TxID, err)
+		}
+	}
+}
+
+// describe works out the change the entry made to the version before it, nil if the
+// entry is the first.
+func (e *historyEntry) describe(previous *historyEntry) {
+	before, after := coin{}, coin{}
+	if previous != nil && previous.coin != nil {
+		before = *previous.coin
+	}
+	if e.coin != nil {
+		after = *e.coin
+	}
+	switch {
+	case e.IsDelete:
+		e.ChangeType = changeDelete
+	case previous == nil || previous.IsDelete:
+		e.ChangeType = changeCreate
+	case before.Owner != after.Owner:
+		e.ChangeType = changeTransfer
+	default:
+		e.ChangeType = changeUpdate
+	}
+
+	e.Diff = map[string]valueChange{}
+	if before.Owner != after.Owner {
+		e.Diff["owner"] = valueChange{From: before.Owner, To: after.Owner}
+	}
+	if before.Amount != after.Amount {
+		e.Diff["amount"] = valueChange{From: before.Amount, To: after.Amount}
+	}
+	e.owners = []string{before.Owner, after.Owner}
+}
+
+// historyPage collects the matching entries from the bookmark on.
+type historyPage struct {
+	stub     shim.ChaincodeStubInterface
+	coinName string
+	filter   *historyFilter
+	results  *resultWriter
+	started  bool //the entry of the bookmark has been reached
+	written  int32
+	bookmark string
+}
+
+// add writes a matching entry, and reports whether the page is complete. The bookmark
+// is then set to the entry that did not fit.
+func (p *historyPage) add(entry *historyEntry) (bool, error) {
+	if !p.filter.matches(entry) {
+		return false, nil
+	}
+	if !p.started {
+		if entry.TxID != p.filter.Bookmark {
+			return false, nil
+		}
+		p.started = true
+	}
+	if p.written < p.filter.PageSize {
+		if entry.ChangeType == changeTransfer {
+			var err error
+			entry.Regulatory, err = getRegulatoryAction(p.stub, p.coinName, entry.TxID)
+			if err != nil {
+				return false, err
+			}
+		}
+		entryJSONasBytes, err := json.Marshal(entry)
+		if err != nil {
+			return false, err
+		}
+		if p.results.addElement(entryJSONasBytes) {
+			p.written++
+			return false, nil
+		}
+	}
+	p.bookmark = entry.TxID
+	return true, nil
+}
+
+// end finishes a page that ran out of entries.
+func (p *historyPage) end(err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if !p.started {
+		return "", fmt.Errorf("invalid bookmark: %s", p.filter.Bookmark)
+	}
+	return "", nil
+}
+
+// ===================================================================================
+// registerCoin adds a coin to the register of all coins ever created
+// ===================================================================================
+func registerCoin(stub shim.ChaincodeStubInterface, coinName string) error {
+	registerKey, err := stub.CreateCompositeKey(coinRegisterIndex, []string{coinName})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(registerKey, []byte{0x00})
+}
+
+// ===================================================================================
+// coinAsOf returns the value of a coin at time asOf, or nil if it did not exist then.
+// The history comes newest first, so the first modification not after asOf holds the
+// value and the older ones are not read.
+// ===================================================================================
+func coinAsOf(stub shim.ChaincodeStubInterface, coinName string, asOf time.Time) ([]byte, error) {
+	resultsIterator, err := stub.GetHistoryForKey(coinName)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if modification.Timestamp == nil {
+			continue
+		}
+		modifiedAt := time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos))
+		if modifiedAt.After(asOf) {
+			continue
+		}
+		if modification.IsDelete {
+			return nil, nil
+		}
+		return modification.Value, nil
+	}
+	return nil, nil
+}
+
+// ===================================================================================
+// coinsAsOf pages over the coin register and returns the coins that existed at time
+// asOf and that keep accepts
+// ===================================================================================
+func coinsAsOf(stub shim.ChaincodeStubInterface, args []string, keep func(c *coin) bool) pb.Response {
+	asOf, err := time.Parse(time.RFC3339, args[0])
+	if err != nil {
+		return shim.Error("Time must be an RFC3339 timestamp")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pageSize, err := config.pageSize(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	optionsJSON := ""
+	if len(args) == 4 {
+		optionsJSON = args[3]
+	}
+	options, err := parseResultOptions(optionsJSON, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) >= 3 && len(args[2]) > 0 {
+		options.Bookmark = args[2]
+	}
+
+	results := newResultWriter("records", options)
+	bookmark, err := results.writePages(pageSize, 1, func(bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+		return stub.GetStateByPartialCompositeKeyWithPagination(coinRegisterIndex, []string{}, pageSize, bookmark)
+	}, func(key string, _ []byte) (string, []byte, error) {
+		_, compositeKeyParts, err := stub.SplitCompositeKey(key)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(compositeKeyParts) != 1 {
+			return "", nil, fmt.Errorf("malformed %s entry: %q", coinRegisterIndex, key)
+		}
+		coinName := compositeKeyParts[0]
+
+		value, err := coinAsOf(stub, coinName, asOf)
+		if err != nil || value == nil {
+			return "", nil, err
+		}
+		coinJSON := &coin{}
+		err = json.Unmarshal(value, coinJSON)
+		if err != nil {
+			// left to the result writer, which fails or skips the record
+			return coinName, value, nil
+		}
+		if !keep(coinJSON) {
+			return "", nil, nil
+		}
+		return coinName, value, nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pageJSONasBytes, err := results.page(bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- coinsAsOf %s returning %d records\n", asOf.Format(time.RFC3339), results.count)
+	return shim.Success(pageJSONasBytes)
+}
+
+// ============================================================
+// stateAsOf - all coins as they were at a given time, paged
+// ============================================================
+func (t *SimpleChaincode) stateAsOf(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//            0                 1        2            3
+	// "2024-12-31T23:59:59Z", "100", "bookmark", "{\"skipCorrupt\":true}"
+	if len(args) < 2 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting time, page size, optional bookmark and optional options")
+	}
+	return coinsAsOf(stub, args, func(c *coin) bool { return true })
+}
+
+// ============================================================
+// ownerHoldingsAsOf - the coins an owner held at a given time, paged
+// ============================================================
+func (t *SimpleChaincode) ownerHoldingsAsOf(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0            1                 2        3            4
+	// "tom", "2024-12-31T23:59:59Z", "100", "bookmark", "{\"skipCorrupt\":true}"
+	if len(args) < 3 || len(args) > 5 {
+		return shim.Error("Incorrect number of arguments. Expecting owner, time, page size, optional bookmark and optional options")
+	}
+	owner := normalizeIdentity(args[0])
+	if len(owner) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	return coinsAsOf(stub, args[1:], func(c *coin) bool { return c.Owner == owner })
+}
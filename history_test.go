@@ -0,0 +1,276 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+type testHistoryPage struct {
+	Entries  []*historyEntry `json:"entries"`
+	Bookmark string          `json:"bookmark"`
+}
+
+func readTestHistory(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, coinName string, filterJSON string) *testHistoryPage {
+	t.Helper()
+	page := &testHistoryPage{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "getHistoryForCoin", coinName, filterJSON), page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+// changeTypes lists the change type of each entry, with the new owner of transfers.
+func changeTypes(entries []*historyEntry) []string {
+	changes := []string{}
+	for _, entry := range entries {
+		change := entry.ChangeType
+		if entry.ChangeType == changeTransfer {
+			change += " " + entry.Diff["owner"].To
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// newHistoryLedger returns a ledger where coin1 was created for tom at 00:00:01, moved
+// to jerry and to spike a second apart, deleted at 00:00:04 and created again.
+func newHistoryLedger(t *testing.T) (*fakeLedger, *SimpleChaincode) {
+	t.Helper()
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"]}`)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "transferCoin", "coin1", "org1msp/spike")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "delete", "coin1")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "acent", "org1msp/tom")
+	return ledger, cc
+}
+
+func TestHistoryOrders(t *testing.T) {
+	ledger, cc := newHistoryLedger(t)
+
+	newest := []string{"create", "delete", "transfer org1msp/spike", "transfer org2msp/jerry", "create"}
+	if page := readTestHistory(t, ledger, cc, "coin1", ""); !reflect.DeepEqual(changeTypes(page.Entries), newest) || page.Bookmark != "" {
+		t.Errorf("history newest first is %v, bookmark %q", changeTypes(page.Entries), page.Bookmark)
+	}
+	oldest := []string{"create", "transfer org2msp/jerry", "transfer org1msp/spike", "delete", "create"}
+	page := readTestHistory(t, ledger, cc, "coin1", `{"order":"oldest"}`)
+	if !reflect.DeepEqual(changeTypes(page.Entries), oldest) {
+		t.Errorf("history oldest first is %v", changeTypes(page.Entries))
+	}
+	if page.Entries[0].Timestamp != "2024-01-01T00:00:01Z" || string(page.Entries[3].Value) != "null" || !page.Entries[3].IsDelete {
+		t.Errorf("history oldest first starts with %+v and has the delete %+v", page.Entries[0], page.Entries[3])
+	}
+	if diff := page.Entries[4].Diff; diff["amount"].To != "acent" || diff["owner"].To != "org1msp/tom" {
+		t.Errorf("diff of the second creation is %+v", diff)
+	}
+
+	// pages continue at the bookmark in either order
+	for _, order := range []string{"newest", "oldest"} {
+		changes := []string{}
+		bookmark := ""
+		for pages := 0; pages == 0 || bookmark != ""; pages++ {
+			if pages == 3 {
+				t.Fatalf("history %s first did not end after 3 pages", order)
+			}
+			page := readTestHistory(t, ledger, cc, "coin1", `{"order":"`+order+`","pageSize":2,"bookmark":"`+bookmark+`"}`)
+			changes = append(changes, changeTypes(page.Entries)...)
+			bookmark = page.Bookmark
+		}
+		expected := newest
+		if order == orderOldest {
+			expected = oldest
+		}
+		if !reflect.DeepEqual(changes, expected) {
+			t.Errorf("history %s first in pages of 2 is %v", order, changes)
+		}
+	}
+	if ledger.invoke(cc, "org1msp/tom", "getHistoryForCoin", "coin1", `{"bookmark":"tx-unknown"}`).Status == shim.OK {
+		t.Errorf("history with an unknown bookmark succeeded")
+	}
+}
+
+func TestHistoryKeepsCommitOrder(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"]}`)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	// the client of the transfer has a clock an hour behind
+	ledger.clock = ledger.clock.Add(-time.Hour)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+
+	if page := readTestHistory(t, ledger, cc, "coin1", ""); !reflect.DeepEqual(changeTypes(page.Entries), []string{"transfer org2msp/jerry", "create"}) {
+		t.Errorf("history newest first is %v", changeTypes(page.Entries))
+	}
+	if page := readTestHistory(t, ledger, cc, "coin1", `{"order":"oldest"}`); !reflect.DeepEqual(changeTypes(page.Entries), []string{"create", "transfer org2msp/jerry"}) {
+		t.Errorf("history oldest first is %v", changeTypes(page.Entries))
+	}
+}
+
+func TestHistoryFilters(t *testing.T) {
+	ledger, cc := newHistoryLedger(t)
+
+	for _, test := range []struct {
+		filter  string
+		changes []string
+	}{
+		{`{"from":"2024-01-01T00:00:02Z","to":"2024-01-01T00:00:03Z"}`, []string{"transfer org1msp/spike", "transfer org2msp/jerry"}},
+		{`{"from":"2024-01-01T00:00:04Z"}`, []string{"create", "delete"}},
+		{`{"to":"2024-01-01T00:00:01Z"}`, []string{"create"}},
+		{`{"changeType":"transfer","order":"oldest"}`, []string{"transfer org2msp/jerry", "transfer org1msp/spike"}},
+		{`{"changeType":"create"}`, []string{"create", "create"}},
+		{`{"changeType":"delete"}`, []string{"delete"}},
+		{`{"counterparty":"Org1MSP/Spike"}`, []string{"delete", "transfer org1msp/spike"}},
+		{`{"counterparty":"org2msp/jerry","changeType":"transfer"}`, []string{"transfer org1msp/spike", "transfer org2msp/jerry"}},
+		{`{"counterparty":"org2msp/nobody"}`, []string{}},
+	} {
+		if page := readTestHistory(t, ledger, cc, "coin1", test.filter); !reflect.DeepEqual(changeTypes(page.Entries), test.changes) {
+			t.Errorf("history with filter %s is %v", test.filter, changeTypes(page.Entries))
+		}
+	}
+
+	// a filtered page continues at the next matching entry
+	page := readTestHistory(t, ledger, cc, "coin1", `{"changeType":"create","pageSize":1}`)
+	if len(page.Entries) != 1 || page.Bookmark != "tx000002" {
+		t.Errorf("first page of creations is %v, bookmark %q", changeTypes(page.Entries), page.Bookmark)
+	}
+
+	for _, filter := range []string{`{"changeType":"mint"}`, `{"from":"yesterday"}`, `{"order":"random"}`, `{"pageSize":5000}`, `{"unknown":1}`} {
+		if ledger.invoke(cc, "org1msp/tom", "getHistoryForCoin", "coin1", filter).Status == shim.OK {
+			t.Errorf("history with filter %s succeeded", filter)
+		}
+	}
+}
+
+type testRecordPage struct {
+	Records  []testRecord `json:"records"`
+	Bookmark string       `json:"bookmark"`
+}
+
+func readTestRecords(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, function string, args ...string) *testRecordPage {
+	t.Helper()
+	page := &testRecordPage{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", function, args...), page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+// ownersOf lists the key and owner of each record.
+func ownersOf(t *testing.T, records []testRecord) []string {
+	t.Helper()
+	owners := []string{}
+	for _, record := range records {
+		c := &coin{}
+		if err := json.Unmarshal(record.Record, c); err != nil {
+			t.Fatal(err)
+		}
+		owners = append(owners, record.Key+" "+c.Owner)
+	}
+	return owners
+}
+
+// newAsOfLedger returns a ledger where coin1 and coin2 are created for tom and coin3
+// for jerry at 00:00:01 to 00:00:03, coin1 moves to jerry at 00:00:04 and to spike at
+// 00:00:05 and coin2 is deleted at 00:00:06.
+func newAsOfLedger(t *testing.T) (*fakeLedger, *SimpleChaincode) {
+	t.Helper()
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"]}`)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin2", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin3", "acent", "org2msp/jerry")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "transferCoin", "coin1", "org1msp/spike")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "delete", "coin2")
+	return ledger, cc
+}
+
+func TestStateAsOf(t *testing.T) {
+	ledger, cc := newAsOfLedger(t)
+
+	for _, test := range []struct {
+		asOf   string
+		owners []string
+	}{
+		{"2024-01-01T00:00:00.5Z", []string{}},
+		{"2024-01-01T00:00:02Z", []string{"coin1 org1msp/tom", "coin2 org1msp/tom"}},
+		{"2024-01-01T00:00:04.5Z", []string{"coin1 org2msp/jerry", "coin2 org1msp/tom", "coin3 org2msp/jerry"}},
+		{"2024-01-01T00:00:05.5Z", []string{"coin1 org1msp/spike", "coin2 org1msp/tom", "coin3 org2msp/jerry"}},
+		{"2024-01-01T00:00:06Z", []string{"coin1 org1msp/spike", "coin3 org2msp/jerry"}},
+	} {
+		page := readTestRecords(t, ledger, cc, "stateAsOf", test.asOf, "10")
+		if owners := ownersOf(t, page.Records); !reflect.DeepEqual(owners, test.owners) || page.Bookmark != "" {
+			t.Errorf("state as of %s is %v, bookmark %q", test.asOf, owners, page.Bookmark)
+		}
+	}
+	if ledger.invoke(cc, "org1msp/tom", "stateAsOf", "31 Dec", "10").Status == shim.OK {
+		t.Errorf("stateAsOf accepted a time that is not RFC3339")
+	}
+}
+
+func TestOwnerHoldingsAsOf(t *testing.T) {
+	ledger, cc := newAsOfLedger(t)
+
+	for _, test := range []struct {
+		owner  string
+		asOf   string
+		owners []string
+	}{
+		{"org1msp/tom", "2024-01-01T00:00:03.5Z", []string{"coin1 org1msp/tom", "coin2 org1msp/tom"}},
+		{"Org1MSP/Tom", "2024-01-01T00:00:04.5Z", []string{"coin2 org1msp/tom"}},
+		{"org1msp/tom", "2024-01-01T00:00:06.5Z", []string{}},
+		{"org2msp/jerry", "2024-01-01T00:00:04.5Z", []string{"coin1 org2msp/jerry", "coin3 org2msp/jerry"}},
+		{"org1msp/spike", "2024-01-01T00:00:04.5Z", []string{}},
+	} {
+		page := readTestRecords(t, ledger, cc, "ownerHoldingsAsOf", test.owner, test.asOf, "10")
+		if owners := ownersOf(t, page.Records); !reflect.DeepEqual(owners, test.owners) {
+			t.Errorf("holdings of %s as of %s are %v", test.owner, test.asOf, owners)
+		}
+	}
+}
+
+func TestStateAsOfPagesLikeGetCoinsByRange(t *testing.T) {
+	ledger, cc := newAsOfLedger(t)
+	current := readTestRecords(t, ledger, cc, "getCoinsByRange", "", "", `{}`)
+
+	// coin2 is gone, so the second page is empty
+	records := []testRecord{}
+	bookmark := ""
+	for pages := 1; ; pages++ {
+		page := readTestRecords(t, ledger, cc, "stateAsOf", "2024-01-01T00:00:06.5Z", "1", bookmark)
+		records = append(records, page.Records...)
+		if bookmark = page.Bookmark; len(bookmark) == 0 {
+			if pages != 3 {
+				t.Errorf("stateAsOf took %d pages of one coin of the register", pages)
+			}
+			break
+		} else if pages == 5 {
+			t.Fatalf("still paging after %d pages", pages)
+		}
+	}
+	if !reflect.DeepEqual(records, current.Records) {
+		t.Errorf("stateAsOf now returns %+v, getCoinsByRange %+v", records, current.Records)
+	}
+}
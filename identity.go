@@ -0,0 +1,75 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ===================================================================================
+// callerIdentity returns the identity of the client that submitted the transaction
+// in the form "<mspid>/<common name>". Identities are lowercased, like owner names,
+// so that they can be compared with the owner field of a coin.
+// ===================================================================================
+func callerIdentity(stub shim.ChaincodeStubInterface) (string, error) {
+	clientIdentity, err := cid.New(stub)
+	if err != nil {
+		return "", fmt.Errorf("failed to get client identity: %s", err)
+	}
+	mspID, err := clientIdentity.GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get client MSP ID: %s", err)
+	}
+	cert, err := clientIdentity.GetX509Certificate()
+	if err != nil {
+		return "", fmt.Errorf("failed to get client certificate: %s", err)
+	}
+	if cert == nil || len(cert.Subject.CommonName) <= 0 {
+		return "", fmt.Errorf("client certificate has no common name")
+	}
+
+	return normalizeIdentity(mspID + "/" + cert.Subject.CommonName), nil
+}
+
+// normalizeIdentity brings a client supplied identity into the canonical form
+// returned by callerIdentity.
+func normalizeIdentity(identity string) string {
+	return strings.ToLower(strings.TrimSpace(identity))
+}
+
+// ===================================================================================
+// getTxTime returns the transaction timestamp chosen by the client. It is the same
+// on every endorsing peer, unlike the local clock, so it is safe to store.
+// ===================================================================================
+func getTxTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get transaction timestamp: %s", err)
+	}
+	if txTimestamp == nil {
+		return time.Time{}, fmt.Errorf("transaction timestamp is not set")
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC(), nil
+}
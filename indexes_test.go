@@ -0,0 +1,284 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const indexDir = "META-INF/statedb/couchdb/indexes"
+
+type indexDefinition struct {
+	Index struct {
+		Fields []json.RawMessage `json:"fields"`
+	} `json:"index"`
+	DesignDoc string `json:"ddoc"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+
+	fields []string
+}
+
+// loadIndexes parses every index definition shipped with the chaincode.
+func loadIndexes(t *testing.T) map[string]*indexDefinition {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(indexDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no index definitions in %s", indexDir)
+	}
+
+	indexes := map[string]*indexDefinition{}
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := &indexDefinition{}
+		err = json.Unmarshal(contents, index)
+		if err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+		if index.Type != "json" || len(index.DesignDoc) == 0 || len(index.Name) == 0 || len(index.Index.Fields) == 0 {
+			t.Fatalf("%s: an index needs a ddoc, a name, type json and fields", file)
+		}
+		for _, raw := range index.Index.Fields {
+			// a field is "name" or {"name":"asc|desc"}
+			var field string
+			if json.Unmarshal(raw, &field) != nil {
+				var sorted map[string]string
+				if json.Unmarshal(raw, &sorted) != nil || len(sorted) != 1 {
+					t.Fatalf("%s: invalid field %s", file, raw)
+				}
+				for name := range sorted {
+					field = name
+				}
+			}
+			if strings.HasPrefix(field, "data.") {
+				t.Fatalf("%s: packaged indexes must not use the data. prefix", file)
+			}
+			index.fields = append(index.fields, field)
+		}
+		if _, ok := indexes[index.Name]; ok {
+			t.Fatalf("%s: duplicate index name %s", file, index.Name)
+		}
+		indexes[index.Name] = index
+	}
+	return indexes
+}
+
+type mangoQuery struct {
+	Selector map[string]json.RawMessage `json:"selector"`
+	Sort     []map[string]string        `json:"sort"`
+	UseIndex []string                   `json:"use_index"`
+}
+
+// covers reports whether CouchDB can answer the query with the index: every indexed
+// field must be constrained by the selector, and the sort must follow the index fields.
+func (index *indexDefinition) covers(query *mangoQuery) bool {
+	for _, field := range index.fields {
+		if _, ok := query.Selector[field]; !ok {
+			return false
+		}
+	}
+	if len(query.Sort) > len(index.fields) {
+		return false
+	}
+	for i, sort := range query.Sort {
+		if len(sort) != 1 {
+			return false
+		}
+		if _, ok := sort[index.fields[i]]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// checkQuery fails the test if no shipped index covers the query, or if the index the
+// query names does not exist or does not cover it.
+func checkQuery(t *testing.T, indexes map[string]*indexDefinition, queryString string) {
+	t.Helper()
+
+	query := &mangoQuery{}
+	err := json.Unmarshal([]byte(queryString), query)
+	if err != nil {
+		t.Fatalf("query %s: %s", queryString, err)
+	}
+	if string(query.Selector["docType"]) != `"coin"` {
+		t.Errorf("query %s is not scoped to docType coin", queryString)
+	}
+
+	if len(query.UseIndex) > 0 {
+		if len(query.UseIndex) != 2 {
+			t.Fatalf("query %s: use_index must name the design doc and the index", queryString)
+		}
+		index, ok := indexes[query.UseIndex[1]]
+		if !ok || "_design/"+index.DesignDoc != query.UseIndex[0] {
+			t.Fatalf("query %s uses index %v, which is not shipped", queryString, query.UseIndex)
+		}
+		if !index.covers(query) {
+			t.Errorf("query %s is not covered by the index it uses, %s", queryString, index.Name)
+		}
+		return
+	}
+	for _, index := range indexes {
+		if index.covers(query) {
+			return
+		}
+	}
+	t.Errorf("no shipped index covers query %s", queryString)
+}
+
+func TestSearchIndexesAreShipped(t *testing.T) {
+	indexes := loadIndexes(t)
+	for field, searchIndex := range searchIndexes {
+		index, ok := indexes[searchIndex.Name]
+		if !ok {
+			t.Errorf("index %s for %s is not shipped", searchIndex.Name, field)
+			continue
+		}
+		if index.DesignDoc != searchIndex.DesignDoc {
+			t.Errorf("index %s is in design doc %s, searchIndexes says %s", index.Name, index.DesignDoc, searchIndex.DesignDoc)
+		}
+		if len(index.fields) != 2 || index.fields[0] != "docType" || index.fields[1] != field {
+			t.Errorf("index %s must be on docType and %s, it is on %v", index.Name, field, index.fields)
+		}
+	}
+}
+
+func TestQueriesAreCoveredByIndexes(t *testing.T) {
+	indexes := loadIndexes(t)
+
+	queryString, err := ownerQuery("tom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkQuery(t, indexes, queryString)
+
+	filters := []string{
+		`{"owner":"tom"}`,
+		`{"denomination":"adollar"}`,
+		`{"namePrefix":"coin1"}`,
+		`{"createdFrom":"2024-01-01T00:00:00Z"}`,
+		`{"createdTo":"2024-12-31T23:59:59Z"}`,
+		`{"owner":"tom","denomination":"adollar","namePrefix":"coin","createdFrom":"2024-01-01T00:00:00Z"}`,
+		`{"denomination":"acent","owner":"tom"}`,
+	}
+	for _, sort := range []string{"", "owner", "amount", "Name", "createdAt"} {
+		for _, order := range []string{"", "asc", "desc"} {
+			if sort == "" && order != "" {
+				continue
+			}
+			filters = append(filters, `{"owner":"tom","sort":"`+sort+`","order":"`+order+`"}`)
+			filters = append(filters, `{"createdFrom":"2024-01-01T00:00:00Z","sort":"`+sort+`","order":"`+order+`","limit":10}`)
+		}
+	}
+
+	config := defaultConfig()
+	for _, filter := range filters {
+		queryString, _, err := compileSearch(filter, config)
+		if err != nil {
+			t.Fatalf("filter %s: %s", filter, err)
+		}
+		checkQuery(t, indexes, queryString)
+	}
+}
+
+func TestSearchRejectsUnindexedFilters(t *testing.T) {
+	config := defaultConfig()
+	filters := []string{
+		`{}`,
+		`{"size":1}`,
+		`{"owner":"tom","sort":"size"}`,
+		`{"owner":"tom","order":"desc"}`,
+		`{"owner":"tom","selector":{"docType":"denomination"}}`,
+		`{"owner":"tom","limit":100000}`,
+	}
+	for _, filter := range filters {
+		_, _, err := compileSearch(filter, config)
+		if err == nil {
+			t.Errorf("filter %s was accepted", filter)
+		}
+	}
+}
+
+func TestRebuildIndexesPages(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"]}}`)
+	coinNames := []string{"coin1", "coin2", "coin3", "coin4", "coin5"}
+	for _, coinName := range coinNames {
+		ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", coinName, "adollar", "org1msp/tom")
+	}
+
+	// coins created before the owner index and the register existed
+	for key := range ledger.state {
+		if strings.HasPrefix(key, "\x00"+ownerAmountNameIndex+"\x00") || strings.HasPrefix(key, "\x00"+coinRegisterIndex+"\x00") {
+			delete(ledger.state, key)
+		}
+	}
+	ledger.sorted = nil
+
+	calls := 0
+	for bookmark := ""; ; {
+		calls++
+		args := []string{"2"}
+		if len(bookmark) > 0 {
+			args = append(args, bookmark)
+		}
+		page := struct {
+			Processed int    `json:"processed"`
+			Bookmark  string `json:"bookmark"`
+		}{}
+		err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/admin", "rebuildIndexes", args...), &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Processed > 2 {
+			t.Fatalf("call %d processed %d coins", calls, page.Processed)
+		}
+		if len(page.Bookmark) == 0 {
+			break
+		}
+		bookmark = page.Bookmark
+	}
+	if calls != 3 {
+		t.Errorf("rebuilding 5 coins in pages of 2 took %d calls", calls)
+	}
+
+	stub := ledger.newStub("org1msp/admin", "check")
+	for _, coinName := range coinNames {
+		for _, key := range [][]string{{ownerAmountNameIndex, "org1msp/tom", "adollar", coinName}, {coinRegisterIndex, coinName}} {
+			indexKey, err := stub.CreateCompositeKey(key[0], key[1:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := ledger.state[indexKey]; !ok {
+				t.Errorf("%s is missing from %s", coinName, key[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,467 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Transfer limits and velocity controls ====
+//
+// Admins set limits on the coins an identity sends: the number of coins in one
+// transaction, their value in minor units over a rolling day, and the number of
+// transactions within a window of up to a day. A limit is set for an identity or for
+// everyone ("*"), and for one denomination or for all of them ("*"). The most specific
+// limit applies: identity and denomination, identity, denomination, then the default.
+// Limits are checked on every move of a coin except regulator actions, so they cover
+// transferCoin, transferCoinsBasedOnAmount, transferFrom and multisig proposals.
+//
+// Usage is not kept in a counter, which every transfer of an identity would have to
+// update. Each transaction writes its own usage record under
+// usage~identity~hour~txid, and the check sums the records of the hours it covers.
+// Transactions of different identities never touch the same keys. Usage is recorded
+// only while a limit applies to the sender.
+//
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["setTransferLimit","*","adollar","{\"maxCoinsPerTransfer\":10,\"maxValuePerDay\":100000}"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["setTransferLimit","org1msp/tom","*","{\"maxTransfersPerWindow\":5,\"windowSeconds\":3600}"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["transferHeadroom","org1msp/tom"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	limitObjectType = "limit"
+	usageObjectType = "usage"
+	limitWildcard   = "*"
+
+	limitDay = 24 * time.Hour
+)
+
+var errLimitExceeded = errors.New("TRANSFER_LIMIT_EXCEEDED")
+
+// transferLimit is stored under limit~identity~denomination. Zero means no limit.
+type transferLimit struct {
+	ObjectType            string `json:"docType"`
+	Identity              string `json:"identity"`
+	Denomination          string `json:"denomination"`
+	MaxCoinsPerTransfer   int64  `json:"maxCoinsPerTransfer"`
+	MaxValuePerDay        int64  `json:"maxValuePerDay"` //minor units over the last 24 hours
+	MaxTransfersPerWindow int64  `json:"maxTransfersPerWindow"`
+	WindowSeconds         int64  `json:"windowSeconds"`
+	UpdatedBy             string `json:"updatedBy"`
+}
+
+// usageAmount is what one transaction sent in one denomination.
+type usageAmount struct {
+	Coins int64 `json:"coins"`
+	Value int64 `json:"value"` //minor units
+}
+
+// transferUsage is stored under usage~identity~hour~txid.
+type transferUsage struct {
+	ObjectType string                  `json:"docType"`
+	Identity   string                  `json:"identity"`
+	TxID       string                  `json:"txId"`
+	At         string                  `json:"at"`
+	Sent       map[string]*usageAmount `json:"sent"` //by denomination
+}
+
+// total sums the usage the limit counts: one denomination, or all of them.
+func (l *transferLimit) total(sent map[string]*usageAmount) (coins int64, value int64, err error) {
+	for amount, usage := range sent {
+		if l.Denomination == limitWildcard || l.Denomination == amount {
+			coins += usage.Coins
+			err = addValue(&value, usage.Value)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return coins, value, nil
+}
+
+func (l *transferLimit) window() time.Duration {
+	return time.Duration(l.WindowSeconds) * time.Second
+}
+
+func getTransferLimit(stub shim.ChaincodeStubInterface, identity string, amount string) (*transferLimit, error) {
+	limitKey, err := stub.CreateCompositeKey(limitObjectType, []string{identity, amount})
+	if err != nil {
+		return nil, err
+	}
+	limitAsBytes, err := stub.GetState(limitKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfer limit: %s", err)
+	} else if limitAsBytes == nil {
+		return nil, nil
+	}
+
+	limit := &transferLimit{}
+	err = json.Unmarshal(limitAsBytes, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode transfer limit %s/%s: %s", identity, amount, err)
+	}
+	return limit, nil
+}
+
+// ===================================================================================
+// applicableLimit returns the most specific limit on identity sending coins of a
+// denomination, or nil if there is none
+// ===================================================================================
+func applicableLimit(stub shim.ChaincodeStubInterface, identity string, amount string) (*transferLimit, error) {
+	candidates := [][2]string{
+		{identity, amount},
+		{identity, limitWildcard},
+		{limitWildcard, amount},
+		{limitWildcard, limitWildcard},
+	}
+	for _, candidate := range candidates {
+		limit, err := getTransferLimit(stub, candidate[0], candidate[1])
+		if err != nil || limit != nil {
+			return limit, err
+		}
+	}
+	return nil, nil
+}
+
+// ===================================================================================
+// getTransferUsage returns the usage records of identity after since, up to now
+// ===================================================================================
+func getTransferUsage(stub shim.ChaincodeStubInterface, identity string, since time.Time, now time.Time) ([]*transferUsage, error) {
+	records := []*transferUsage{}
+	for hour := since.Unix() / 3600; hour <= now.Unix()/3600; hour++ {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(usageObjectType, []string{identity, strconv.FormatInt(hour, 10)})
+		if err != nil {
+			return nil, err
+		}
+
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			record := &transferUsage{}
+			err = json.Unmarshal(queryResponse.Value, record)
+			if err != nil {
+				resultsIterator.Close()
+				return nil, fmt.Errorf("failed to decode usage record: %s", queryResponse.Key)
+			}
+			at, err := time.Parse(time.RFC3339, record.At)
+			if err == nil && at.After(since) {
+				records = append(records, record)
+			}
+		}
+		resultsIterator.Close()
+	}
+	return records, nil
+}
+
+// ===================================================================================
+// outgoingInTx returns what the owner of c sends in this transaction, c included,
+// by denomination. moved holds the coins moved before c, see transferOptions.
+// ===================================================================================
+func outgoingInTx(stub shim.ChaincodeStubInterface, c *coin, moved map[holding]int) (map[string]*usageAmount, error) {
+	sent := map[string]*usageAmount{c.Amount: {Coins: 1}}
+	for h, n := range moved {
+		if h.Owner != c.Owner {
+			continue
+		}
+		if _, ok := sent[h.Amount]; !ok {
+			sent[h.Amount] = &usageAmount{}
+		}
+		sent[h.Amount].Coins += int64(n)
+	}
+
+	for amount, usage := range sent {
+		d, err := getDenomination(stub, amount)
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			usage.Value, err = toMinorUnits(usage.Coins, d)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sent, nil
+}
+
+// ===================================================================================
+// checkLimits fails with errLimitExceeded if moving c, together with the coins its
+// owner already sent in this transaction, breaks the limit on the owner. Otherwise
+// it records the usage of the transaction.
+// ===================================================================================
+func checkLimits(stub shim.ChaincodeStubInterface, c *coin, moved map[holding]int) error {
+	limit, err := applicableLimit(stub, c.Owner, c.Amount)
+	if err != nil || limit == nil {
+		return err
+	}
+
+	sent, err := outgoingInTx(stub, c, moved)
+	if err != nil {
+		return err
+	}
+	coins, value, err := limit.total(sent)
+	if err != nil {
+		return err
+	}
+	if limit.MaxCoinsPerTransfer > 0 && coins > limit.MaxCoinsPerTransfer {
+		return fmt.Errorf("%w: %s may send at most %d coins per transfer", errLimitExceeded, c.Owner, limit.MaxCoinsPerTransfer)
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	if limit.MaxValuePerDay > 0 || limit.MaxTransfersPerWindow > 0 {
+		usage, err := getTransferUsage(stub, c.Owner, now.Add(-limitDay), now)
+		if err != nil {
+			return err
+		}
+		valueUsed, transfers, err := usedWithin(limit, usage, now)
+		if err != nil {
+			return err
+		}
+		if limit.MaxValuePerDay > 0 && value > limit.MaxValuePerDay-valueUsed {
+			return fmt.Errorf("%w: %s may send a value of %d per day, %d used", errLimitExceeded, c.Owner, limit.MaxValuePerDay, valueUsed)
+		}
+		if limit.MaxTransfersPerWindow > 0 && transfers+1 > limit.MaxTransfersPerWindow {
+			return fmt.Errorf("%w: %s may make %d transfers per %s", errLimitExceeded, c.Owner, limit.MaxTransfersPerWindow, limit.window())
+		}
+	}
+
+	// one record per transaction, rewritten with the running totals for every coin
+	record := &transferUsage{
+		ObjectType: usageObjectType,
+		Identity:   c.Owner,
+		TxID:       stub.GetTxID(),
+		At:         now.Format(time.RFC3339),
+		Sent:       sent,
+	}
+	recordJSONasBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	usageKey, err := stub.CreateCompositeKey(usageObjectType, []string{c.Owner, strconv.FormatInt(now.Unix()/3600, 10), record.TxID})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(usageKey, recordJSONasBytes)
+}
+
+// usedWithin returns the value sent over the last day and the number of transfers
+// within the window of the limit, as counted by the limit.
+func usedWithin(limit *transferLimit, usage []*transferUsage, now time.Time) (valueUsed int64, transfers int64, err error) {
+	windowStart := now.Add(-limit.window())
+	for _, record := range usage {
+		coins, value, err := limit.total(record.Sent)
+		if err != nil {
+			return 0, 0, err
+		}
+		if coins <= 0 {
+			continue
+		}
+		err = addValue(&valueUsed, value)
+		if err != nil {
+			return 0, 0, err
+		}
+		at, err := time.Parse(time.RFC3339, record.At)
+		if err == nil && at.After(windowStart) {
+			transfers++
+		}
+	}
+	return valueUsed, transfers, nil
+}
+
+// ============================================================
+// setTransferLimit - admin only, set or (with all limits zero)
+// remove the limit on an identity and denomination
+// ============================================================
+func (t *SimpleChaincode) setTransferLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//       0            1                   2
+	// "org1msp/tom", "adollar", "{\"maxCoinsPerTransfer\":10}"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting identity, denomination and limits JSON")
+	}
+
+	identity := normalizeIdentity(args[0])
+	amount := strings.ToLower(strings.TrimSpace(args[1]))
+	if len(identity) <= 0 || len(amount) <= 0 {
+		return shim.Error("Identity and denomination must be non-empty strings, use * for all")
+	}
+
+	limit := &transferLimit{}
+	err := json.Unmarshal([]byte(args[2]), limit)
+	if err != nil {
+		return shim.Error("3rd argument must be a JSON document: " + err.Error())
+	}
+	if limit.MaxCoinsPerTransfer < 0 || limit.MaxValuePerDay < 0 || limit.MaxTransfersPerWindow < 0 {
+		return shim.Error("Limits must not be negative")
+	}
+	if limit.MaxTransfersPerWindow > 0 && (limit.WindowSeconds <= 0 || limit.window() > limitDay) {
+		return shim.Error("windowSeconds must be between 1 and 86400")
+	}
+
+	admin, err := requireAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	limitKey, err := stub.CreateCompositeKey(limitObjectType, []string{identity, amount})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if limit.MaxCoinsPerTransfer == 0 && limit.MaxValuePerDay == 0 && limit.MaxTransfersPerWindow == 0 {
+		err = stub.DelState(limitKey)
+	} else {
+		limit.ObjectType = limitObjectType
+		limit.Identity = identity
+		limit.Denomination = amount
+		limit.UpdatedBy = admin
+		var limitJSONasBytes []byte
+		limitJSONasBytes, err = json.Marshal(limit)
+		if err == nil {
+			err = stub.PutState(limitKey, limitJSONasBytes)
+		}
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = writeAudit(stub, "transferLimit", identity+"/"+amount, admin, map[string]string{"limits": args[2]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end setTransferLimit " + identity + " " + amount)
+	return shim.Success(nil)
+}
+
+type headroom struct {
+	Denomination string         `json:"denomination"`
+	Limit        *transferLimit `json:"limit"` //the limit that applies, maybe one for all denominations
+
+	ValueUsed          int64  `json:"valueUsed"`
+	ValueRemaining     *int64 `json:"valueRemaining,omitempty"`
+	Transfers          int64  `json:"transfers"`
+	TransfersRemaining *int64 `json:"transfersRemaining,omitempty"`
+}
+
+// ============================================================
+// transferHeadroom - admin only, the limits that apply to an
+// identity with what remains of them at the transaction time
+// ============================================================
+func (t *SimpleChaincode) transferHeadroom(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting identity")
+	}
+	identity := normalizeIdentity(args[0])
+
+	_, err := requireAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// every denomination a limit is set for, for the identity or by default, with "*"
+	// standing for the others
+	limited := map[string]bool{}
+	for _, owner := range []string{limitWildcard, identity} {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(limitObjectType, []string{owner})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return shim.Error(err.Error())
+			}
+			_, compositeKeyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+			if err != nil || len(compositeKeyParts) != 2 {
+				resultsIterator.Close()
+				return shim.Error("Malformed transfer limit key: " + queryResponse.Key)
+			}
+			limited[compositeKeyParts[1]] = true
+		}
+		resultsIterator.Close()
+	}
+
+	// the limit reported for a denomination is the one a transfer applies
+	limits := map[string]*transferLimit{}
+	for amount := range limited {
+		limits[amount], err = applicableLimit(stub, identity, amount)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	usage, err := getTransferUsage(stub, identity, now.Add(-limitDay), now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	denominations := []string{}
+	for amount := range limits {
+		denominations = append(denominations, amount)
+	}
+	sort.Strings(denominations)
+
+	result := []headroom{}
+	for _, amount := range denominations {
+		limit := limits[amount]
+		entry := headroom{Denomination: amount, Limit: limit}
+		entry.ValueUsed, entry.Transfers, err = usedWithin(limit, usage, now)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if limit.MaxValuePerDay > 0 {
+			remaining := limit.MaxValuePerDay - entry.ValueUsed
+			entry.ValueRemaining = &remaining
+		}
+		if limit.MaxTransfersPerWindow > 0 {
+			remaining := limit.MaxTransfersPerWindow - entry.Transfers
+			entry.TransfersRemaining = &remaining
+		}
+		result = append(result, entry)
+	}
+
+	headroomJSONasBytes, err := json.Marshal(map[string]interface{}{
+		"identity": identity,
+		"asOf":     now.Format(time.RFC3339),
+		"limits":   result,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(headroomJSONasBytes)
+}
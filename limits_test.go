@@ -0,0 +1,165 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const limitsTestConfig = `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"]}}`
+
+// newLimitedLedger returns a ledger where tom and jerry hold n adollar coins each,
+// tom's named tom0, tom1, ... and jerry's jerry0, jerry1, ...
+func newLimitedLedger(t *testing.T, n int, limitJSON string) (*fakeLedger, *SimpleChaincode) {
+	t.Helper()
+	ledger, cc := newFakeChaincode(t, limitsTestConfig)
+	for i := 0; i < n; i++ {
+		ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "tom"+strconv.Itoa(i), "adollar", "org1msp/tom")
+		ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "jerry"+strconv.Itoa(i), "adollar", "org2msp/jerry")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "setTransferLimit", "*", "adollar", limitJSON)
+	return ledger, cc
+}
+
+func TestTransferWindowLimit(t *testing.T) {
+	ledger, cc := newLimitedLedger(t, 3, `{"maxTransfersPerWindow":2,"windowSeconds":3600}`)
+
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "tom0", "org1msp/bob")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "tom1", "org1msp/bob")
+	response := ledger.invoke(cc, "org1msp/tom", "transferCoin", "tom2", "org1msp/bob")
+	if !strings.Contains(response.Message, "TRANSFER_LIMIT_EXCEEDED") {
+		t.Errorf("third transfer in the window returned %d %s", response.Status, response.Message)
+	}
+	// the limit is per sender
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "transferCoin", "jerry0", "org1msp/bob")
+
+	ledger.clock = ledger.clock.Add(time.Hour)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "tom2", "org1msp/bob")
+}
+
+func TestTransferWindowLimitWithConcurrentTransfers(t *testing.T) {
+	ledger, cc := newLimitedLedger(t, 3, `{"maxTransfersPerWindow":2,"windowSeconds":3600}`)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "tom0", "org1msp/bob")
+
+	// endorsed against the same state, each sees one earlier transfer of tom
+	transfers := []*fakeStub{
+		ledger.newStub("org1msp/tom", "transferCoin", "tom1", "org1msp/bob"),
+		ledger.newStub("org1msp/tom", "transferCoin", "tom2", "org1msp/bob"),
+		ledger.newStub("org2msp/jerry", "transferCoin", "jerry0", "org1msp/bob"),
+		ledger.newStub("org2msp/jerry", "transferCoin", "jerry1", "org1msp/bob"),
+	}
+	for _, stub := range transfers {
+		if response := cc.Invoke(stub); response.Status != shim.OK {
+			t.Fatal(response.Message)
+		}
+	}
+	// the usage record of the first transfer of each sender is a phantom for the
+	// usage query of the second, so only one of them commits
+	valid := ledger.commit(transfers...)
+	if !valid[0] || valid[1] || !valid[2] || valid[3] {
+		t.Errorf("validity of concurrent transfers is %v", valid)
+	}
+	if owner := readTestCoin(t, ledger, cc, "tom2").Owner; owner != "org1msp/tom" {
+		t.Errorf("tom2 moved to %s beyond the limit", owner)
+	}
+	response := ledger.invoke(cc, "org1msp/tom", "transferCoin", "tom2", "org1msp/bob")
+	if !strings.Contains(response.Message, "TRANSFER_LIMIT_EXCEEDED") {
+		t.Errorf("retried transfer returned %d %s", response.Status, response.Message)
+	}
+}
+
+func TestTransferValueLimit(t *testing.T) {
+	// an adollar coin is worth 100 minor units
+	ledger, cc := newLimitedLedger(t, 3, `{"maxValuePerDay":250}`)
+
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "tom0", "org1msp/bob")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "tom1", "org1msp/bob")
+	response := ledger.invoke(cc, "org1msp/tom", "transferCoin", "tom2", "org1msp/bob")
+	if !strings.Contains(response.Message, "TRANSFER_LIMIT_EXCEEDED") {
+		t.Errorf("transfer beyond the daily value returned %d %s", response.Status, response.Message)
+	}
+	ledger.clock = ledger.clock.Add(limitDay)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "tom2", "org1msp/bob")
+}
+
+func TestTransferValueDoesNotOverflow(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, limitsTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "registerDenomination", "abig", "aBig", "4611686018427387904")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "big1", "abig", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "big2", "abig", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "setTransferLimit", "*", "*", `{"maxValuePerDay":9223372036854775807}`)
+
+	// two coins are worth 2^63 minor units, which must not wrap around to a negative value
+	response := ledger.invoke(cc, "org1msp/tom", "transferCoinsBasedOnAmount", "abig", "org1msp/bob")
+	if response.Status == shim.OK || !strings.Contains(response.Message, "overflows") {
+		t.Errorf("transfer of two coins worth 2^62 each returned %d %s", response.Status, response.Message)
+	}
+}
+
+func TestTransferHeadroomMatchesAppliedLimit(t *testing.T) {
+	// a default for adollar, and a limit for tom on all denominations, which takes precedence
+	ledger, cc := newLimitedLedger(t, 3, `{"maxValuePerDay":150}`)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "setTransferLimit", "org1msp/tom", "*", `{"maxTransfersPerWindow":2,"windowSeconds":3600}`)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "tom0", "org1msp/bob")
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "transferCoin", "jerry0", "org1msp/bob")
+
+	readHeadroom := func(identity string) map[string]headroom {
+		t.Helper()
+		result := struct {
+			Limits []headroom `json:"limits"`
+		}{}
+		err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/admin", "transferHeadroom", identity), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		limits := map[string]headroom{}
+		for _, entry := range result.Limits {
+			limits[entry.Denomination] = entry
+		}
+		return limits
+	}
+
+	tom := readHeadroom("org1msp/tom")
+	if entry := tom["adollar"]; entry.Limit == nil || entry.Limit.Identity != "org1msp/tom" || entry.ValueRemaining != nil ||
+		entry.TransfersRemaining == nil || *entry.TransfersRemaining != 1 {
+		t.Errorf("headroom of tom in adollar is %+v", entry)
+	}
+	if entry := tom["*"]; entry.Limit == nil || entry.Limit.Identity != "org1msp/tom" {
+		t.Errorf("headroom of tom in other denominations is %+v", entry)
+	}
+	jerry := readHeadroom("org2msp/jerry")
+	if entry := jerry["adollar"]; len(jerry) != 1 || entry.Limit == nil || entry.Limit.Identity != "*" ||
+		entry.ValueRemaining == nil || *entry.ValueRemaining != 50 {
+		t.Errorf("headroom of jerry is %+v", jerry)
+	}
+
+	// the transfers agree: tom is not held to the daily value, jerry is
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "tom1", "org1msp/bob")
+	response := ledger.invoke(cc, "org2msp/jerry", "transferCoin", "jerry1", "org1msp/bob")
+	if !strings.Contains(response.Message, "TRANSFER_LIMIT_EXCEEDED") {
+		t.Errorf("transfer of jerry beyond the daily value returned %d %s", response.Status, response.Message)
+	}
+}
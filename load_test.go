@@ -0,0 +1,446 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Benchmarks and load generator ====
+//
+// The benchmarks endorse one call of a chaincode function per iteration against a
+// seeded in-memory ledger, without committing it, so every iteration sees the same
+// state. Besides time and allocations they report the keys read and written per call.
+// The load generator runs a weighted mix of functions, commits the transactions in
+// blocks and reports the same numbers per function, plus the transactions that failed
+// validation.
+// Transfers are called by the owner of the coins, as only the owner can move them.
+//
+// The dataset is set with flags after -args:
+//
+//	go test -run '^$' -bench . -benchmem -args -load.sizes=1000,100000 -load.dist=zipf
+//	go test -run TestLoadGenerator -v -args -load.ops=20000 -load.coins=100000 -load.mix=transferCoin=9,readCoin=1
+//
+//	-load.sizes          coins in the ledger of each benchmark, comma separated
+//	-load.coins          coins in the ledger of the load generator
+//	-load.owners         accounts holding the coins
+//	-load.denominations  denominations of the coins, other than acent and adollar registered with value 1
+//	-load.dist           how coins are spread over owners and calls over coins and owners:
+//	                     uniform, zipf (a few hot keys) or sequential
+//	-load.window         coins per getCoinsByRange call
+//	-load.ops            calls the load generator makes, 0 to skip it
+//	-load.block          transactions endorsed against the same state and committed together
+//	-load.mix            function=weight pairs the load generator picks from
+//	-load.seed           seed of the random choices
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+var (
+	loadSizes         = flag.String("load.sizes", "1000,10000", "coins in the ledger of each benchmark, comma separated")
+	loadCoins         = flag.Int("load.coins", 10000, "coins in the ledger of the load generator")
+	loadOwners        = flag.Int("load.owners", 100, "accounts holding the coins")
+	loadDenominations = flag.String("load.denominations", "acent,adollar", "denominations of the coins, comma separated")
+	loadDistribution  = flag.String("load.dist", "uniform", "how coins are spread over owners and calls over keys: uniform, zipf or sequential")
+	loadWindow        = flag.Int("load.window", 100, "coins per getCoinsByRange call")
+	loadOps           = flag.Int("load.ops", 0, "calls the load generator makes, 0 to skip it")
+	loadBlock         = flag.Int("load.block", 10, "transactions endorsed against the same state and committed together")
+	loadMix           = flag.String("load.mix", "readCoin=40,transferCoin=40,getCoinsByRange=10,valueOfOwner=9,transferCoinsBasedOnAmount=1", "function=weight pairs the load generator picks from")
+	loadSeed          = flag.Int64("load.seed", 1, "seed of the random choices")
+)
+
+const loadAdmin = "org1msp/admin"
+
+// loadDataset describes the seeded ledger.
+type loadDataset struct {
+	coins         int
+	owners        int
+	denominations []string
+	dist          string
+}
+
+func loadDatasetOf(tb testing.TB, coins int) loadDataset {
+	tb.Helper()
+	ds := loadDataset{coins: coins, owners: *loadOwners, dist: *loadDistribution}
+	for _, code := range strings.Split(*loadDenominations, ",") {
+		if code = strings.ToLower(strings.TrimSpace(code)); len(code) > 0 {
+			ds.denominations = append(ds.denominations, code)
+		}
+	}
+	if ds.coins <= 0 || ds.owners <= 0 || len(ds.denominations) == 0 {
+		tb.Fatalf("the dataset needs coins, owners and denominations: %+v", ds)
+	}
+	return ds
+}
+
+func loadCoinName(i int) string  { return fmt.Sprintf("coin%08d", i) }
+func loadOwnerName(i int) string { return fmt.Sprintf("org1msp/owner%06d", i) }
+
+// newKeyPicker returns a function that picks numbers in [0, n) with the distribution
+// dist.
+func newKeyPicker(dist string, n int, rng *rand.Rand) (func() int, error) {
+	switch dist {
+	case "uniform":
+		return func() int { return rng.Intn(n) }, nil
+	case "zipf":
+		if n == 1 {
+			return func() int { return 0 }, nil
+		}
+		zipf := rand.NewZipf(rng, 1.1, 1, uint64(n-1))
+		return func() int { return int(zipf.Uint64()) }, nil
+	case "sequential":
+		next := -1
+		return func() int {
+			next = (next + 1) % n
+			return next
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown distribution %q, expecting uniform, zipf or sequential", dist)
+}
+
+// quietStdout discards what the chaincode prints until the test or benchmark ends.
+func quietStdout(tb testing.TB) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	tb.Cleanup(func() {
+		os.Stdout = stdout
+		devNull.Close()
+	})
+}
+
+// seedLoadLedger returns a ledger holding the coins of ds. The coins are created with
+// createCoin, a thousand to a transaction, so they are indexed and counted in the
+// balances like any other; the supply records, which each of those transactions
+// overwrites, are corrected at the end.
+func seedLoadLedger(tb testing.TB, ds loadDataset, rng *rand.Rand) (*fakeLedger, *SimpleChaincode) {
+	tb.Helper()
+	ledger, cc := newFakeChaincode(tb, `{"admins":["`+loadAdmin+`"]}`)
+	for _, code := range ds.denominations {
+		if _, ok := builtinDenominations[code]; !ok {
+			ledger.mustInvoke(tb, cc, loadAdmin, "registerDenomination", code, code, "1")
+		}
+	}
+
+	pickOwner, err := newKeyPicker(ds.dist, ds.owners, rng)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	created := map[string]int64{}
+	const batchSize = 1000
+	for first := 0; first < ds.coins; first += batchSize {
+		stub := ledger.newStub(loadAdmin, "seed")
+		for i := first; i < first+batchSize && i < ds.coins; i++ {
+			amount := ds.denominations[i%len(ds.denominations)]
+			_, err := createCoin(stub, loadCoinName(i), amount, loadOwnerName(pickOwner()))
+			if err != nil {
+				tb.Fatal(err)
+			}
+			created[amount]++
+		}
+		ledger.sorted = nil //sorted again on the next read, cheaper than inserting each key
+		if !ledger.commit(stub)[0] {
+			tb.Fatal("seeding transaction was invalidated")
+		}
+	}
+
+	stub := ledger.newStub(loadAdmin, "seed")
+	for amount, count := range created {
+		supplyKey, err := stub.CreateCompositeKey(supplyObjectType, []string{amount})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		supplyJSONasBytes, err := json.Marshal(&supply{ObjectType: supplyObjectType, Denomination: amount, Circulating: count, Created: count})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		err = stub.PutState(supplyKey, supplyJSONasBytes)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	ledger.commit(stub)
+	return ledger, cc
+}
+
+// loadWorkload picks the callers and arguments of the calls.
+type loadWorkload struct {
+	ds        loadDataset
+	ledger    *fakeLedger
+	rng       *rand.Rand
+	pickCoin  func() int
+	pickOwner func() int
+}
+
+func newLoadWorkload(tb testing.TB, ds loadDataset, ledger *fakeLedger, rng *rand.Rand) *loadWorkload {
+	tb.Helper()
+	pickCoin, err := newKeyPicker(ds.dist, ds.coins, rng)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pickOwner, err := newKeyPicker(ds.dist, ds.owners, rng)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &loadWorkload{ds: ds, ledger: ledger, rng: rng, pickCoin: pickCoin, pickOwner: pickOwner}
+}
+
+// ownerOf returns the committed owner of a coin, only the owner can transfer it.
+func (w *loadWorkload) ownerOf(coinName string) string {
+	c, err := decodeCoin(coinName, w.ledger.state[coinName].value)
+	if err != nil {
+		return loadAdmin
+	}
+	return c.Owner
+}
+
+// otherOwner picks an owner other than owner.
+func (w *loadWorkload) otherOwner(owner string) string {
+	for {
+		other := loadOwnerName(w.pickOwner())
+		if other != owner || w.ds.owners == 1 {
+			return other
+		}
+	}
+}
+
+func (w *loadWorkload) denomination() string {
+	return w.ds.denominations[w.rng.Intn(len(w.ds.denominations))]
+}
+
+// loadOp is a chaincode function the benchmarks and the load generator can call.
+type loadOp struct {
+	query bool //only endorsed, never committed
+	call  func(w *loadWorkload) (caller string, args []string)
+}
+
+var loadFunctions = map[string]loadOp{
+	"readCoin": {query: true, call: func(w *loadWorkload) (string, []string) {
+		return loadAdmin, []string{loadCoinName(w.pickCoin())}
+	}},
+	"transferCoin": {call: func(w *loadWorkload) (string, []string) {
+		coinName := loadCoinName(w.pickCoin())
+		owner := w.ownerOf(coinName)
+		return owner, []string{coinName, w.otherOwner(owner)}
+	}},
+	"transferCoinsBasedOnAmount": {call: func(w *loadWorkload) (string, []string) {
+		owner := loadOwnerName(w.pickOwner())
+		return owner, []string{w.denomination(), w.otherOwner(owner)}
+	}},
+	"getCoinsByRange": {query: true, call: func(w *loadWorkload) (string, []string) {
+		start := w.pickCoin()
+		return loadAdmin, []string{loadCoinName(start), loadCoinName(start + *loadWindow)}
+	}},
+	"valueOfOwner": {query: true, call: func(w *loadWorkload) (string, []string) {
+		return loadAdmin, []string{loadOwnerName(w.pickOwner()), "adollar"}
+	}},
+	"countCoins": {query: true, call: func(w *loadWorkload) (string, []string) {
+		return loadAdmin, []string{"owner", "10"}
+	}},
+	"holdingsSummary": {query: true, call: func(w *loadWorkload) (string, []string) {
+		return loadAdmin, []string{"10"}
+	}},
+}
+
+// seededLedgers caches the ledger of each benchmark size, the benchmarks do not
+// commit so it never changes.
+var seededLedgers = map[int]struct {
+	ledger *fakeLedger
+	cc     *SimpleChaincode
+}{}
+
+// benchmarkOp endorses calls of function against ledgers of each of the -load.sizes.
+func benchmarkOp(b *testing.B, function string) {
+	for _, field := range strings.Split(*loadSizes, ",") {
+		coins, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			b.Fatalf("invalid -load.sizes: %s", err)
+		}
+		b.Run(fmt.Sprintf("coins=%d", coins), func(b *testing.B) {
+			quietStdout(b)
+			ds := loadDatasetOf(b, coins)
+			seeded, ok := seededLedgers[coins]
+			if !ok {
+				seeded.ledger, seeded.cc = seedLoadLedger(b, ds, rand.New(rand.NewSource(*loadSeed)))
+				seededLedgers[coins] = seeded
+			}
+			w := newLoadWorkload(b, ds, seeded.ledger, rand.New(rand.NewSource(*loadSeed)))
+			op := loadFunctions[function]
+
+			reads, writes := 0, 0
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				caller, args := op.call(w)
+				stub := seeded.ledger.newStub(caller, function, args...)
+				response := seeded.cc.Invoke(stub)
+				if response.Status != shim.OK {
+					b.Fatalf("%s failed: %s", function, response.Message)
+				}
+				reads += stub.keysRead
+				writes += stub.keysWritten
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func BenchmarkReadCoin(b *testing.B)        { benchmarkOp(b, "readCoin") }
+func BenchmarkTransferCoin(b *testing.B)    { benchmarkOp(b, "transferCoin") }
+func BenchmarkGetCoinsByRange(b *testing.B) { benchmarkOp(b, "getCoinsByRange") }
+func BenchmarkValueOfOwner(b *testing.B)    { benchmarkOp(b, "valueOfOwner") }
+func BenchmarkCountCoins(b *testing.B)      { benchmarkOp(b, "countCoins") }
+func BenchmarkHoldingsSummary(b *testing.B) { benchmarkOp(b, "holdingsSummary") }
+
+func BenchmarkTransferCoinsBasedOnAmount(b *testing.B) {
+	benchmarkOp(b, "transferCoinsBasedOnAmount")
+}
+
+// loadMixEntry is a function of the mix with its cumulative weight.
+type loadMixEntry struct {
+	function string
+	weight   int
+}
+
+func parseLoadMix(mix string) ([]loadMixEntry, int, error) {
+	entries := []loadMixEntry{}
+	total := 0
+	for _, pair := range strings.Split(mix, ",") {
+		function, weightArg, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		weight, err := strconv.Atoi(weightArg)
+		if !ok || err != nil || weight <= 0 {
+			return nil, 0, fmt.Errorf("mix entries must be function=weight with a positive weight: %q", pair)
+		}
+		if _, ok := loadFunctions[function]; !ok {
+			return nil, 0, fmt.Errorf("no load operation for %s", function)
+		}
+		for _, entry := range entries {
+			if entry.function == function {
+				return nil, 0, fmt.Errorf("%s is in the mix twice", function)
+			}
+		}
+		total += weight
+		entries = append(entries, loadMixEntry{function: function, weight: total})
+	}
+	return entries, total, nil
+}
+
+type loadStats struct {
+	calls, failed, invalid int
+	elapsed                time.Duration
+	allocs                 uint64
+	reads, writes          int
+}
+
+// TestLoadGenerator runs -load.ops calls picked from -load.mix, endorsing -load.block
+// of them against the same state before committing the transactions among them. It
+// only runs when -load.ops is set.
+func TestLoadGenerator(t *testing.T) {
+	if *loadOps <= 0 {
+		t.Skip("set -load.ops to run the load generator")
+	}
+	if *loadBlock <= 0 {
+		t.Fatal("-load.block must be positive")
+	}
+	mix, total, err := parseLoadMix(*loadMix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quietStdout(t)
+	ds := loadDatasetOf(t, *loadCoins)
+	rng := rand.New(rand.NewSource(*loadSeed))
+	seeding := time.Now()
+	ledger, cc := seedLoadLedger(t, ds, rng)
+	t.Logf("seeded %d coins of %d owners in %s", ds.coins, ds.owners, time.Since(seeding).Round(time.Millisecond))
+	w := newLoadWorkload(t, ds, ledger, rng)
+
+	stats := map[string]*loadStats{}
+	for _, entry := range mix {
+		stats[entry.function] = &loadStats{}
+	}
+	var before, after runtime.MemStats
+	started := time.Now()
+	for done := 0; done < *loadOps; {
+		block := []*fakeStub{}
+		functions := []string{}
+		for ; len(block) < *loadBlock && done < *loadOps; done++ {
+			pick := rng.Intn(total)
+			i := sort.Search(len(mix), func(i int) bool { return mix[i].weight > pick })
+			function := mix[i].function
+			op := loadFunctions[function]
+			caller, args := op.call(w)
+			stub := ledger.newStub(caller, function, args...)
+
+			runtime.ReadMemStats(&before)
+			began := time.Now()
+			response := cc.Invoke(stub)
+			elapsed := time.Since(began)
+			runtime.ReadMemStats(&after)
+
+			s := stats[function]
+			s.calls++
+			s.elapsed += elapsed
+			s.allocs += after.Mallocs - before.Mallocs
+			s.reads += stub.keysRead
+			s.writes += stub.keysWritten
+			if response.Status != shim.OK {
+				s.failed++
+			} else if !op.query {
+				block = append(block, stub)
+				functions = append(functions, function)
+			}
+		}
+		for i, ok := range ledger.commit(block...) {
+			if !ok {
+				stats[functions[i]].invalid++
+			}
+		}
+	}
+	wall := time.Since(started)
+
+	var report strings.Builder
+	table := tabwriter.NewWriter(&report, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "function\tcalls\tfailed\tinvalid\tcalls/s\tµs/call\tallocs/call\treads/call\twrites/call\t")
+	for _, entry := range mix {
+		s := stats[entry.function]
+		if s.calls == 0 {
+			continue
+		}
+		calls := float64(s.calls)
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%.0f\t%.1f\t%.0f\t%.1f\t%.1f\t\n", entry.function, s.calls, s.failed, s.invalid,
+			calls/s.elapsed.Seconds(), float64(s.elapsed.Microseconds())/calls, float64(s.allocs)/calls, float64(s.reads)/calls, float64(s.writes)/calls)
+	}
+	table.Flush()
+	t.Logf("%d calls in %s, %.0f calls/s including commits, %s distribution\n%s", *loadOps, wall.Round(time.Millisecond), float64(*loadOps)/wall.Seconds(), ds.dist, report.String())
+}
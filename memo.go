@@ -0,0 +1,175 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Transfer memos ====
+//
+// transferCoin, transferCoinsBasedOnAmount and transferFrom take an optional memo as
+// their last argument, a JSON document with a payment reference, a purpose code and
+// free text. The memo is stored on the coin, so it shows in getHistoryForCoin next to
+// the owner it was transferred to. Transfers with a reference are also recorded under
+// memoref~reference~coin~txid, so the movements paying e.g. one invoice can be found.
+//
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["transferCoin","coin1","org1msp/jerry","{\"reference\":\"INV-2024-0042\",\"purpose\":\"SUPP\",\"text\":\"March delivery\"}"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["getTransfersByReference","INV-2024-0042"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	memoReferenceIndex = "memoref~reference~coin~txid"
+
+	maxMemoBytes     = 512
+	maxReferenceLen  = 64
+	maxPurposeLen    = 16
+	memoPurposeChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_"
+)
+
+// transferMemo describes the transfer that gave the coin its current owner.
+type transferMemo struct {
+	Reference string `json:"reference,omitempty"` //e.g. an invoice number
+	Purpose   string `json:"purpose,omitempty"`   //purpose code, e.g. SUPP or SALA
+	Text      string `json:"text,omitempty"`
+}
+
+// referencedTransfer is stored under memoref~reference~coin~txid.
+type referencedTransfer struct {
+	Coin      string        `json:"coin"`
+	Amount    string        `json:"amount"`
+	From      string        `json:"from"`
+	To        string        `json:"to"`
+	TxID      string        `json:"txId"`
+	Timestamp string        `json:"timestamp"`
+	Memo      *transferMemo `json:"memo"`
+}
+
+// ===================================================================================
+// parseMemo decodes and validates a memo argument
+// ===================================================================================
+func parseMemo(arg string) (*transferMemo, error) {
+	if len(arg) > maxMemoBytes {
+		return nil, fmt.Errorf("memo must not be longer than %d bytes", maxMemoBytes)
+	}
+	if !utf8.ValidString(arg) {
+		return nil, fmt.Errorf("memo must be valid UTF-8")
+	}
+
+	memo := &transferMemo{}
+	decoder := json.NewDecoder(strings.NewReader(arg))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(memo)
+	if err == nil && decoder.Decode(&json.RawMessage{}) != io.EOF {
+		err = fmt.Errorf("unexpected data after the JSON document")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("memo must be a JSON document with reference, purpose and text: %s", err)
+	}
+
+	if len(memo.Reference) > maxReferenceLen || strings.ContainsRune(memo.Reference, 0) {
+		return nil, fmt.Errorf("memo reference must be at most %d characters and not contain null characters", maxReferenceLen)
+	}
+	if len(memo.Purpose) > maxPurposeLen {
+		return nil, fmt.Errorf("memo purpose must be at most %d characters", maxPurposeLen)
+	}
+	for _, r := range memo.Purpose {
+		if !strings.ContainsRune(memoPurposeChars, r) {
+			return nil, fmt.Errorf("memo purpose must consist of upper case letters, digits and underscores")
+		}
+	}
+	if len(memo.Reference) <= 0 && len(memo.Purpose) <= 0 && len(memo.Text) <= 0 {
+		return nil, fmt.Errorf("memo must not be empty")
+	}
+	return memo, nil
+}
+
+// ===================================================================================
+// putMemoReference records a transfer with a memo reference in the reference index
+// ===================================================================================
+func putMemoReference(stub shim.ChaincodeStubInterface, c *coin, from string) error {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	record := &referencedTransfer{
+		Coin:      c.Name,
+		Amount:    c.Amount,
+		From:      from,
+		To:        c.Owner,
+		TxID:      stub.GetTxID(),
+		Timestamp: txTime.Format(time.RFC3339),
+		Memo:      c.Memo,
+	}
+	recordJSONasBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	referenceKey, err := stub.CreateCompositeKey(memoReferenceIndex, []string{c.Memo.Reference, c.Name, record.TxID})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(referenceKey, recordJSONasBytes)
+}
+
+// ============================================================
+// getTransfersByReference - the transfers with a memo reference
+// ============================================================
+func (t *SimpleChaincode) getTransfersByReference(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//       0
+	// "INV-2024-0042"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting reference")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(memoReferenceIndex, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	records := []json.RawMessage{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		records = append(records, json.RawMessage(queryResponse.Value))
+	}
+
+	recordsJSONasBytes, err := json.Marshal(records)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- getTransfersByReference returning %d records\n", len(records))
+	return shim.Success(recordsJSONasBytes)
+}
@@ -0,0 +1,104 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+func readTestTransfers(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, reference string) []referencedTransfer {
+	t.Helper()
+	transfers := []referencedTransfer{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "getTransfersByReference", reference), &transfers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transfers
+}
+
+func TestMemoValidation(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, supplyTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+
+	for _, memo := range []string{
+		`{}`,
+		`not a memo`,
+		`{"reference":"INV-1","note":"unknown field"}`,
+		`{"reference":"INV-1"}garbage`,
+		`{"reference":"INV-1"} {"reference":"INV-2"}`,
+		`{"purpose":"supp"}`,
+		`{"purpose":"SUPPLIERPAYMENTS1"}`,
+		`{"reference":"INV\u00001"}`,
+		`{"reference":"` + strings.Repeat("R", maxReferenceLen+1) + `"}`,
+		`{"text":"` + strings.Repeat("x", maxMemoBytes) + `"}`,
+	} {
+		if ledger.invoke(cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry", memo).Status == shim.OK {
+			t.Errorf("transfer with memo %.40q succeeded", memo)
+		}
+	}
+
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry", `{"reference":"INV-1","purpose":"SUPP","text":"March delivery"}`)
+	if memo := readTestCoin(t, ledger, cc, "coin1").Memo; memo == nil || memo.Reference != "INV-1" || memo.Purpose != "SUPP" || memo.Text != "March delivery" {
+		t.Errorf("memo on coin1 is %+v", memo)
+	}
+	// the memo describes the last transfer only
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "transferCoin", "coin1", "org1msp/tom")
+	if memo := readTestCoin(t, ledger, cc, "coin1").Memo; memo != nil {
+		t.Errorf("memo on coin1 after a transfer without one is %+v", memo)
+	}
+}
+
+func TestGetTransfersByReference(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, supplyTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin2", "acent", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin3", "adollar", "org1msp/tom")
+
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry", `{"reference":"INV-1"}`)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoinsBasedOnAmount", "acent", "org2msp/jerry", `{"reference":"INV-1","purpose":"SUPP"}`)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin3", "org2msp/jerry", `{"reference":"INV-10"}`)
+	// a refund of the same coin under the same reference is a second transfer
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "transferCoin", "coin1", "org1msp/tom", `{"reference":"INV-1","text":"refund"}`)
+
+	transfers := readTestTransfers(t, ledger, cc, "INV-1")
+	if len(transfers) != 3 {
+		t.Fatalf("transfers with reference INV-1 are %+v", transfers)
+	}
+	moves := map[string]int{}
+	for _, transfer := range transfers {
+		moves[transfer.Coin+" "+transfer.From+">"+transfer.To]++
+		if transfer.Memo == nil || transfer.Memo.Reference != "INV-1" || len(transfer.TxID) == 0 {
+			t.Errorf("transfer %+v", transfer)
+		}
+	}
+	if moves["coin1 org1msp/tom>org2msp/jerry"] != 1 || moves["coin1 org2msp/jerry>org1msp/tom"] != 1 || moves["coin2 org1msp/tom>org2msp/jerry"] != 1 {
+		t.Errorf("transfers with reference INV-1 are %v", moves)
+	}
+	if transfers := readTestTransfers(t, ledger, cc, "INV-10"); len(transfers) != 1 || transfers[0].Coin != "coin3" {
+		t.Errorf("transfers with reference INV-10 are %+v", transfers)
+	}
+	if transfers := readTestTransfers(t, ledger, cc, "INV-2"); len(transfers) != 0 {
+		t.Errorf("transfers with reference INV-2 are %+v", transfers)
+	}
+}
@@ -0,0 +1,376 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Model-based test ====
+//
+// TestCoinModel runs random sequences of initCoin, transferCoin, delete and
+// transferCoinsBasedOnAmount against the chaincode on the fake stub and against a
+// reference model, a map of coins with the history of each. The calls are made by
+// modelCaller, who can only move the coins it owns. After every call the
+// two must agree on whether it succeeded, on the coins in state, on the amount~name
+// and owner~amount~name indexes, and on the history getHistoryForCoin returns. A
+// failing sequence is shrunk, by dropping calls and replacing arguments with simpler
+// ones, and reported with the seed that produced it:
+//
+//	go test -run TestCoinModel -args -model.runs=1000 -model.steps=60
+//	go test -run TestCoinModel -args -model.seed=1700000000000000000
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+var (
+	modelSeed  = flag.Int64("model.seed", 0, "seed of the first sequence, 0 for the current time")
+	modelRuns  = flag.Int("model.runs", 100, "random sequences to run")
+	modelSteps = flag.Int("model.steps", 40, "maximum calls per sequence")
+)
+
+// modelCaller is the identity the calls are made by.
+const modelCaller = "org1msp/tom"
+
+// modelArgPools lists the values each argument of a function is drawn from, simplest
+// first. Amounts and owners come in mixed case, which the chaincode lowercases; aeuro
+// is not a registered denomination and empty owners are rejected.
+var modelArgPools = map[string][][]string{
+	"initCoin":                   {modelCoinNames, {"acent", "aDollar", "aeuro"}, modelOwners},
+	"transferCoin":               {modelCoinNames, modelOwners},
+	"delete":                     {modelCoinNames},
+	"transferCoinsBasedOnAmount": {{"acent", "aDollar", "aeuro", ""}, modelOwners},
+}
+
+var modelOwners = []string{modelCaller, "Org1MSP/Jerry", "bob", ""}
+
+var modelCoinNames = []string{"coin0", "coin1", "coin2", "coin3", "coin4", "coin5"}
+
+// modelFunctions are the functions in the order sequences are shrunk towards, with
+// the weight they are picked with.
+var modelFunctions = []struct {
+	name   string
+	weight int
+}{
+	{"initCoin", 35},
+	{"transferCoin", 35},
+	{"delete", 15},
+	{"transferCoinsBasedOnAmount", 15},
+}
+
+type modelCall struct {
+	function string
+	args     []string
+}
+
+func (c modelCall) String() string { return fmt.Sprintf("%s%q", c.function, c.args) }
+
+func randomModelCall(rng *rand.Rand) modelCall {
+	pick := rng.Intn(100)
+	function := modelFunctions[len(modelFunctions)-1].name
+	for _, f := range modelFunctions {
+		if pick < f.weight {
+			function = f.name
+			break
+		}
+		pick -= f.weight
+	}
+	call := modelCall{function: function}
+	for _, pool := range modelArgPools[function] {
+		call.args = append(call.args, pool[rng.Intn(len(pool))])
+	}
+	return call
+}
+
+type modelCoin struct {
+	amount, owner string
+}
+
+type modelChange struct {
+	txID, changeType string
+	coin             modelCoin //zero for a delete
+}
+
+// coinModel is the reference the chaincode is compared with.
+type coinModel struct {
+	coins   map[string]modelCoin
+	history map[string][]modelChange
+}
+
+func newCoinModel() *coinModel {
+	return &coinModel{coins: map[string]modelCoin{}, history: map[string][]modelChange{}}
+}
+
+func (m *coinModel) record(name string, txID string, c *modelCoin) {
+	change := modelChange{txID: txID, changeType: changeDelete}
+	previous, existed := m.coins[name]
+	switch {
+	case c == nil:
+		delete(m.coins, name)
+	case !existed:
+		change.changeType = changeCreate
+	case previous.owner != c.owner:
+		change.changeType = changeTransfer
+	default:
+		change.changeType = changeUpdate
+	}
+	if c != nil {
+		change.coin = *c
+		m.coins[name] = *c
+	}
+	m.history[name] = append(m.history[name], change)
+}
+
+// apply applies call, made in transaction txID, to the model and reports whether the
+// chaincode is expected to accept it.
+func (m *coinModel) apply(call modelCall, txID string) bool {
+	switch call.function {
+	case "initCoin":
+		name, amount, owner := call.args[0], strings.ToLower(call.args[1]), strings.ToLower(call.args[2])
+		if _, exists := m.coins[name]; exists || len(owner) == 0 {
+			return false
+		}
+		if _, ok := builtinDenominations[amount]; !ok {
+			return false
+		}
+		m.record(name, txID, &modelCoin{amount: amount, owner: owner})
+	case "transferCoin":
+		name, owner := call.args[0], strings.ToLower(call.args[1])
+		c, exists := m.coins[name]
+		if !exists || c.owner != modelCaller || len(owner) == 0 || owner == c.owner {
+			return false
+		}
+		c.owner = owner
+		m.record(name, txID, &c)
+	case "delete":
+		if _, exists := m.coins[call.args[0]]; !exists {
+			return false
+		}
+		m.record(call.args[0], txID, nil)
+	case "transferCoinsBasedOnAmount":
+		amount, owner := strings.ToLower(call.args[0]), strings.ToLower(call.args[1])
+		if len(amount) == 0 || len(owner) == 0 {
+			return false
+		}
+		if owner == modelCaller {
+			// moving the caller's coins to the caller fails on the first coin
+			for _, c := range m.coins {
+				if c.amount == amount && c.owner == modelCaller {
+					return false
+				}
+			}
+			return true
+		}
+		for name, c := range m.coins {
+			if c.amount == amount && c.owner == modelCaller {
+				c.owner = owner
+				m.record(name, txID, &c)
+			}
+		}
+	}
+	return true
+}
+
+var (
+	modelBaseOnce   sync.Once
+	modelBaseLedger *fakeLedger
+)
+
+// runModel runs calls against a fresh ledger and the model, and describes the first
+// disagreement, "" if there is none.
+func runModel(tb testing.TB, calls []modelCall) string {
+	modelBaseOnce.Do(func() {
+		modelBaseLedger, _ = newFakeChaincode(tb, `{"admins":["org1msp/admin"]}`)
+		modelBaseLedger.serializedIdentity(modelCaller)
+	})
+	ledger, cc := modelBaseLedger.clone(), &SimpleChaincode{}
+	model := newCoinModel()
+
+	for step, call := range calls {
+		stub := ledger.newStub(modelCaller, call.function, call.args...)
+		response := cc.Invoke(stub)
+		expected := model.apply(call, stub.GetTxID())
+		if expected != (response.Status == shim.OK) {
+			return fmt.Sprintf("step %d, %s: the model expected success %t, the chaincode returned %d %s", step, call, expected, response.Status, response.Message)
+		}
+		if response.Status == shim.OK && !ledger.commit(stub)[0] {
+			return fmt.Sprintf("step %d, %s: the transaction was invalidated", step, call)
+		}
+		if problem := compareWithModel(ledger, cc, model); len(problem) > 0 {
+			return fmt.Sprintf("step %d, %s: %s", step, call, problem)
+		}
+	}
+	return ""
+}
+
+// compareWithModel describes the first difference between the ledger and the model.
+func compareWithModel(ledger *fakeLedger, cc *SimpleChaincode, model *coinModel) string {
+	stub := ledger.newStub(modelCaller, "compare")
+	inState := map[string]modelCoin{}
+	amountIndex, ownerIndex := map[string]bool{}, map[string]bool{}
+	for key, value := range ledger.state {
+		if !strings.HasPrefix(key, "\x00") {
+			c, err := decodeCoin(key, value.value)
+			if err != nil {
+				return err.Error()
+			}
+			inState[key] = modelCoin{amount: c.Amount, owner: c.Owner}
+			continue
+		}
+		objectType, attributes, err := stub.SplitCompositeKey(key)
+		if err != nil {
+			return err.Error()
+		}
+		switch objectType {
+		case amountNameIndex:
+			amountIndex[strings.Join(attributes, "/")] = true
+		case ownerAmountNameIndex:
+			ownerIndex[strings.Join(attributes, "/")] = true
+		}
+	}
+
+	if fmt.Sprint(inState) != fmt.Sprint(model.coins) {
+		return fmt.Sprintf("state holds %v, the model %v", inState, model.coins)
+	}
+	expectedAmountIndex, expectedOwnerIndex := map[string]bool{}, map[string]bool{}
+	for name, c := range model.coins {
+		expectedAmountIndex[c.amount+"/"+name] = true
+		expectedOwnerIndex[c.owner+"/"+c.amount+"/"+name] = true
+	}
+	if fmt.Sprint(amountIndex) != fmt.Sprint(expectedAmountIndex) {
+		return fmt.Sprintf("the %s index holds %v, the model expects %v", amountNameIndex, sortedKeys(amountIndex), sortedKeys(expectedAmountIndex))
+	}
+	if fmt.Sprint(ownerIndex) != fmt.Sprint(expectedOwnerIndex) {
+		return fmt.Sprintf("the %s index holds %v, the model expects %v", ownerAmountNameIndex, sortedKeys(ownerIndex), sortedKeys(expectedOwnerIndex))
+	}
+
+	for name, changes := range model.history {
+		response := cc.Invoke(ledger.newStub(modelCaller, "getHistoryForCoin", name, `{"order":"oldest"}`))
+		if response.Status != shim.OK {
+			return fmt.Sprintf("getHistoryForCoin %s failed: %s", name, response.Message)
+		}
+		page := struct {
+			Entries []historyEntry `json:"entries"`
+		}{}
+		err := json.Unmarshal(response.Payload, &page)
+		if err != nil {
+			return err.Error()
+		}
+		history := []modelChange{}
+		for _, entry := range page.Entries {
+			change := modelChange{txID: entry.TxID, changeType: entry.ChangeType}
+			if !entry.IsDelete {
+				c := &coin{}
+				err = json.Unmarshal(entry.Value, c)
+				if err != nil {
+					return err.Error()
+				}
+				change.coin = modelCoin{amount: c.Amount, owner: c.Owner}
+			}
+			history = append(history, change)
+		}
+		if fmt.Sprint(history) != fmt.Sprint(changes) {
+			return fmt.Sprintf("history of %s is %v, the model has %v", name, history, changes)
+		}
+	}
+	return ""
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// shrinkModelCalls returns a shorter or simpler sequence that still fails, repeating
+// until neither dropping calls nor simplifying an argument keeps it failing.
+func shrinkModelCalls(calls []modelCall, fails func([]modelCall) bool) []modelCall {
+	for shrunk := true; shrunk; {
+		shrunk = false
+		// drop runs of calls, halving the run length down to single calls
+		for size := len(calls) / 2; size >= 1; size /= 2 {
+			for start := 0; start+size <= len(calls); {
+				candidate := append(append([]modelCall{}, calls[:start]...), calls[start+size:]...)
+				if fails(candidate) {
+					calls, shrunk = candidate, true
+				} else {
+					start++
+				}
+			}
+		}
+		// replace each argument with the simpler values of its pool
+		for i, call := range calls {
+			for a, pool := range modelArgPools[call.function] {
+				for _, simpler := range pool {
+					if simpler == call.args[a] {
+						break
+					}
+					candidate := append([]modelCall{}, calls...)
+					candidate[i].args = append([]string{}, call.args...)
+					candidate[i].args[a] = simpler
+					if fails(candidate) {
+						calls, call, shrunk = candidate, candidate[i], true
+						break
+					}
+				}
+			}
+		}
+	}
+	return calls
+}
+
+func TestCoinModel(t *testing.T) {
+	quietStdout(t)
+	seed := *modelSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	runs := *modelRuns
+	if testing.Short() && runs > 10 {
+		runs = 10
+	}
+
+	for run := 0; run < runs; run++ {
+		rng := rand.New(rand.NewSource(seed + int64(run)))
+		calls := make([]modelCall, 1+rng.Intn(*modelSteps))
+		for i := range calls {
+			calls[i] = randomModelCall(rng)
+		}
+		if problem := runModel(t, calls); len(problem) > 0 {
+			minimal := shrinkModelCalls(calls, func(candidate []modelCall) bool { return len(runModel(t, candidate)) > 0 })
+			lines := make([]string, len(minimal))
+			for i, call := range minimal {
+				lines[i] = "\t" + call.String()
+			}
+			t.Fatalf("sequence %d of seed %d failed after %d calls: %s\nshrunk to %d calls: %s\n%s",
+				run, seed, len(calls), problem, len(minimal), runModel(t, minimal), strings.Join(lines, "\n"))
+		}
+	}
+}
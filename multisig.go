@@ -0,0 +1,579 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Multi-signature ownership ====
+//
+// A multisig account is an M-of-N set of signer identities. Coins are owned by the
+// account by setting their owner to "multisig:<id>". Such coins cannot be moved with
+// transferCoin or deleted; instead a signer proposes a transfer, the other signers
+// approve it, and the transfer executes once the threshold of distinct signers is
+// reached. Proposals expire after their time to live and can be cancelled by the
+// proposer while pending. Coins can only be given to an account that exists, and the
+// pending proposals of a coin are voided when it leaves the account, so that their
+// approvals do not carry over if the coin comes back.
+//
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["createMultisig","treasury","2","org1msp/alice","org1msp/bob","org2msp/carol"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["transferCoin","coin1","multisig:treasury"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["proposeTransfer","coin1","org1msp/tom","86400"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["approveProposal","<proposal id>"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["cancelProposal","<proposal id>"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["readMultisig","treasury"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["readProposal","<proposal id>"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["getProposalHistory","coin1"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	multisigObjectType  = "multisig"
+	multisigOwnerPrefix = "multisig:"
+	proposalObjectType  = "proposal"
+	proposalCoinIndex   = "proposal~coin~id"
+
+	defaultProposalTTL = 7 * 24 * time.Hour
+	maxProposalTTL     = 90 * 24 * time.Hour
+
+	proposalPending   = "pending"
+	proposalExecuted  = "executed"
+	proposalCancelled = "cancelled"
+	proposalExpired   = "expired"
+	proposalVoided    = "voided" //the coin left the account
+)
+
+type multisigAccount struct {
+	ObjectType string   `json:"docType"`
+	ID         string   `json:"id"`
+	Signers    []string `json:"signers"`
+	Threshold  int      `json:"threshold"`
+}
+
+type transferProposal struct {
+	ObjectType string   `json:"docType"`
+	ID         string   `json:"id"`
+	Coin       string   `json:"coin"`
+	Multisig   string   `json:"multisig"`
+	NewOwner   string   `json:"newOwner"`
+	Proposer   string   `json:"proposer"`
+	Approvals  []string `json:"approvals"` //distinct signers that approved, in order
+	Status     string   `json:"status"`
+	CreatedAt  string   `json:"createdAt"`
+	ExpiresAt  string   `json:"expiresAt"`
+	ClosedAt   string   `json:"closedAt,omitempty"`
+}
+
+// multisigID returns the account ID if owner is a multisig account.
+func multisigID(owner string) (string, bool) {
+	if !strings.HasPrefix(owner, multisigOwnerPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(owner, multisigOwnerPrefix), true
+}
+
+func getMultisig(stub shim.ChaincodeStubInterface, id string) (*multisigAccount, error) {
+	multisigKey, err := stub.CreateCompositeKey(multisigObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	multisigAsBytes, err := stub.GetState(multisigKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get multisig account %s: %s", id, err)
+	} else if multisigAsBytes == nil {
+		return nil, fmt.Errorf("multisig account does not exist: %s", id)
+	}
+
+	account := &multisigAccount{}
+	err = json.Unmarshal(multisigAsBytes, account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode multisig account %s: %s", id, err)
+	}
+	return account, nil
+}
+
+// checkMultisigOwner fails if owner is a multisig account that does not exist, a coin
+// given to it could be taken by whoever creates the account.
+func checkMultisigOwner(stub shim.ChaincodeStubInterface, owner string) error {
+	id, ok := multisigID(owner)
+	if !ok {
+		return nil
+	}
+	_, err := getMultisig(stub, id)
+	return err
+}
+
+// ===================================================================================
+// voidProposals closes the pending proposals of a coin that leaves its multisig
+// account. Called by moveCoin and destroyCoin.
+// ===================================================================================
+func voidProposals(stub shim.ChaincodeStubInterface, c *coin) error {
+	if _, ok := multisigID(c.Owner); !ok {
+		return nil
+	}
+	proposalIDs, err := listIndex(stub, proposalCoinIndex, c.Name)
+	if err != nil || len(proposalIDs) == 0 {
+		return err
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	for _, id := range proposalIDs {
+		proposal, err := getProposal(stub, id)
+		if err != nil {
+			return err
+		}
+		if proposal.effectiveStatus(now) != proposalPending {
+			continue
+		}
+		// a proposal executing in this transaction is stored after the move
+		proposal.Status = proposalVoided
+		proposal.ClosedAt = now.Format(time.RFC3339)
+		err = putProposal(stub, proposal)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getProposal(stub shim.ChaincodeStubInterface, id string) (*transferProposal, error) {
+	proposalKey, err := stub.CreateCompositeKey(proposalObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	proposalAsBytes, err := stub.GetState(proposalKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proposal %s: %s", id, err)
+	} else if proposalAsBytes == nil {
+		return nil, fmt.Errorf("proposal does not exist: %s", id)
+	}
+
+	proposal := &transferProposal{}
+	err = json.Unmarshal(proposalAsBytes, proposal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode proposal %s: %s", id, err)
+	}
+	return proposal, nil
+}
+
+func putProposal(stub shim.ChaincodeStubInterface, proposal *transferProposal) error {
+	proposalKey, err := stub.CreateCompositeKey(proposalObjectType, []string{proposal.ID})
+	if err != nil {
+		return err
+	}
+	proposalJSONasBytes, err := json.Marshal(proposal)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(proposalKey, proposalJSONasBytes)
+}
+
+// effectiveStatus reports a pending proposal past its expiry as expired. Expiry is
+// not written to the ledger, calls on an expired proposal simply fail.
+func (p *transferProposal) effectiveStatus(now time.Time) string {
+	if p.Status != proposalPending {
+		return p.Status
+	}
+	expiresAt, err := time.Parse(time.RFC3339, p.ExpiresAt)
+	if err != nil || !now.Before(expiresAt) {
+		return proposalExpired
+	}
+	return proposalPending
+}
+
+// ============================================================
+// createMultisig - create an M-of-N multisig account.
+// The caller must be one of the signers.
+// ============================================================
+func (t *SimpleChaincode) createMultisig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0        1         2...
+	// "treasury", "2", "org1msp/alice", "org1msp/bob", ...
+	if len(args) < 3 {
+		return shim.Error("Incorrect number of arguments. Expecting ID, threshold and at least one signer")
+	}
+
+	id := strings.ToLower(args[0])
+	if len(id) <= 0 || strings.ContainsRune(id, 0) {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	signers, err := normalizeList(args[2:], normalizeIdentity, "signer")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	threshold, err := strconv.Atoi(args[1])
+	if err != nil || threshold < 1 || threshold > len(signers) {
+		return shim.Error(fmt.Sprintf("Threshold must be a number between 1 and %d", len(signers)))
+	}
+
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !containsString(signers, caller) {
+		return shim.Error("The creator of a multisig account must be one of its signers")
+	}
+
+	multisigKey, err := stub.CreateCompositeKey(multisigObjectType, []string{id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	existing, err := stub.GetState(multisigKey)
+	if err != nil {
+		return shim.Error("Failed to get multisig account: " + err.Error())
+	} else if existing != nil {
+		return shim.Error("This multisig account already exists: " + id)
+	}
+
+	account := &multisigAccount{ObjectType: multisigObjectType, ID: id, Signers: signers, Threshold: threshold}
+	accountJSONasBytes, err := json.Marshal(account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(multisigKey, accountJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- end createMultisig %s %d of %d\n", id, threshold, len(signers))
+	return shim.Success([]byte(multisigOwnerPrefix + id))
+}
+
+// ============================================================
+// proposeTransfer - a signer proposes to transfer a coin owned
+// by its multisig account. The proposer's approval is recorded.
+// Returns the proposal ID.
+// ============================================================
+func (t *SimpleChaincode) proposeTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1               2
+	// "coin1", "org1msp/tom", "86400"
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting coin, new owner and optional time to live in seconds")
+	}
+
+	coinName := args[0]
+	newOwner := normalizeIdentity(args[1])
+	if len(newOwner) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	ttl := defaultProposalTTL
+	if len(args) == 3 {
+		seconds, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxProposalTTL {
+			return shim.Error(fmt.Sprintf("Time to live must be between 1 and %d seconds", int64(maxProposalTTL/time.Second)))
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	c, err := getCoin(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	id, ok := multisigID(c.Owner)
+	if !ok {
+		return shim.Error(coinName + " is not owned by a multisig account")
+	}
+	account, err := getMultisig(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !containsString(account.Signers, caller) {
+		return shim.Error(caller + " is not a signer of " + id)
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	proposal := &transferProposal{
+		ObjectType: proposalObjectType,
+		ID:         stub.GetTxID(),
+		Coin:       coinName,
+		Multisig:   id,
+		NewOwner:   newOwner,
+		Proposer:   caller,
+		Approvals:  []string{},
+		Status:     proposalPending,
+		CreatedAt:  now.Format(time.RFC3339),
+		ExpiresAt:  now.Add(ttl).Format(time.RFC3339),
+	}
+
+	//  Index the proposal by coin, so the proposals of a coin can be listed
+	coinIndexKey, err := stub.CreateCompositeKey(proposalCoinIndex, []string{coinName, proposal.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(coinIndexKey, []byte{0x00})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = recordProposalApproval(stub, proposal, account, caller, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end proposeTransfer " + proposal.ID)
+	return shim.Success([]byte(proposal.ID))
+}
+
+// ============================================================
+// approveProposal - a signer approves a pending proposal; the
+// transfer executes when the threshold is reached
+// ============================================================
+func (t *SimpleChaincode) approveProposal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "proposal id"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting proposal ID")
+	}
+
+	proposal, err := getProposal(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if status := proposal.effectiveStatus(now); status != proposalPending {
+		return shim.Error("Proposal is " + status)
+	}
+	account, err := getMultisig(stub, proposal.Multisig)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !containsString(account.Signers, caller) {
+		return shim.Error(caller + " is not a signer of " + account.ID)
+	}
+	if containsString(proposal.Approvals, caller) {
+		return shim.Error(caller + " has already approved this proposal")
+	}
+
+	err = recordProposalApproval(stub, proposal, account, caller, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- end approveProposal %s (%s)\n", proposal.ID, proposal.Status)
+	return shim.Success([]byte(proposal.Status))
+}
+
+// recordProposalApproval adds the approval of signer and executes the transfer when
+// the threshold is reached. The proposal is stored either way.
+func recordProposalApproval(stub shim.ChaincodeStubInterface, proposal *transferProposal, account *multisigAccount, signer string, now time.Time) error {
+	proposal.Approvals = append(proposal.Approvals, signer)
+
+	if len(proposal.Approvals) >= account.Threshold {
+		c, err := getCoin(stub, proposal.Coin)
+		if err != nil {
+			return err
+		}
+		if c.Owner != multisigOwnerPrefix+account.ID {
+			return fmt.Errorf("%s is no longer owned by %s", proposal.Coin, account.ID)
+		}
+		err = moveCoin(stub, c, proposal.NewOwner, transferOptions{})
+		if err != nil {
+			return err
+		}
+		proposal.Status = proposalExecuted
+		proposal.ClosedAt = now.Format(time.RFC3339)
+	}
+
+	return putProposal(stub, proposal)
+}
+
+// ============================================================
+// cancelProposal - the proposer withdraws a pending proposal
+// ============================================================
+func (t *SimpleChaincode) cancelProposal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "proposal id"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting proposal ID")
+	}
+
+	proposal, err := getProposal(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if status := proposal.effectiveStatus(now); status != proposalPending {
+		return shim.Error("Proposal is " + status)
+	}
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != proposal.Proposer {
+		return shim.Error("Only the proposer can cancel a proposal")
+	}
+
+	proposal.Status = proposalCancelled
+	proposal.ClosedAt = now.Format(time.RFC3339)
+	err = putProposal(stub, proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end cancelProposal " + proposal.ID)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// readMultisig - read a multisig account
+// ============================================================
+func (t *SimpleChaincode) readMultisig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting ID of the multisig account")
+	}
+
+	account, err := getMultisig(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	accountJSONasBytes, err := json.Marshal(account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(accountJSONasBytes)
+}
+
+// ============================================================
+// readProposal - read a proposal, with expiry applied to its status
+// ============================================================
+func (t *SimpleChaincode) readProposal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting proposal ID")
+	}
+
+	proposal, err := getProposal(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	proposal.Status = proposal.effectiveStatus(now)
+
+	proposalJSONasBytes, err := json.Marshal(proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(proposalJSONasBytes)
+}
+
+type proposalVersion struct {
+	TxID      string          `json:"txId"`
+	Timestamp string          `json:"timestamp"`
+	Value     json.RawMessage `json:"value"`
+}
+
+type proposalWithHistory struct {
+	Proposal *transferProposal `json:"proposal"`
+	History  []proposalVersion `json:"history"` //every version of the proposal, as returned by the ledger history
+}
+
+// ============================================================
+// getProposalHistory - every proposal for a coin, each with the
+// full history of its proposal record. Complements getHistoryForCoin.
+// ============================================================
+func (t *SimpleChaincode) getProposalHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting name of the coin")
+	}
+
+	coinName := args[0]
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	proposalIDs, err := listIndex(stub, proposalCoinIndex, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := []proposalWithHistory{}
+	for _, id := range proposalIDs {
+		proposal, err := getProposal(stub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		proposal.Status = proposal.effectiveStatus(now)
+
+		proposalKey, err := stub.CreateCompositeKey(proposalObjectType, []string{id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		historyIterator, err := stub.GetHistoryForKey(proposalKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		history := []proposalVersion{}
+		for historyIterator.HasNext() {
+			modification, err := historyIterator.Next()
+			if err != nil {
+				historyIterator.Close()
+				return shim.Error(err.Error())
+			}
+			version := proposalVersion{TxID: modification.TxId, Value: json.RawMessage("null")}
+			if modification.Timestamp != nil {
+				version.Timestamp = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC().Format(time.RFC3339)
+			}
+			if !modification.IsDelete && json.Valid(modification.Value) {
+				version.Value = json.RawMessage(modification.Value)
+			}
+			history = append(history, version)
+		}
+		historyIterator.Close()
+
+		result = append(result, proposalWithHistory{Proposal: proposal, History: history})
+	}
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultJSONasBytes)
+}
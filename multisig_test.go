@@ -0,0 +1,171 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// testDocumentHash stands for the hash of the document authorising a regulatory action.
+var testDocumentHash = strings.Repeat("ab", 32)
+
+const multisigTestConfig = `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"],"regulator":["org1msp/admin"]},"recoveryAccount":"org1msp/recovery"}`
+
+// newTreasury returns a ledger with a 2 of 3 multisig account "treasury" of alice, bob
+// and carol holding coin1.
+func newTreasury(t *testing.T) (*fakeLedger, *SimpleChaincode) {
+	t.Helper()
+	ledger, cc := newFakeChaincode(t, multisigTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/alice", "createMultisig", "treasury", "2", "org1msp/alice", "org1msp/bob", "org2msp/carol")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "multisig:treasury")
+	return ledger, cc
+}
+
+func readTestCoin(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, coinName string) *coin {
+	t.Helper()
+	c := &coin{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "readCoin", coinName), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func readTestProposal(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, id string) *transferProposal {
+	t.Helper()
+	proposal := &transferProposal{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/alice", "readProposal", id), proposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proposal
+}
+
+func TestMultisigThreshold(t *testing.T) {
+	ledger, cc := newTreasury(t)
+
+	if ledger.invoke(cc, "org1msp/alice", "transferCoin", "coin1", "org1msp/alice").Status == shim.OK {
+		t.Errorf("a signer moved a multisig coin with transferCoin")
+	}
+	if ledger.invoke(cc, "org1msp/tom", "proposeTransfer", "coin1", "org1msp/tom").Status == shim.OK {
+		t.Errorf("a non-signer proposed a transfer")
+	}
+
+	id := string(ledger.mustInvoke(t, cc, "org1msp/alice", "proposeTransfer", "coin1", "org1msp/dave"))
+	if ledger.invoke(cc, "org1msp/alice", "approveProposal", id).Status == shim.OK {
+		t.Errorf("the proposer approved twice")
+	}
+	if ledger.invoke(cc, "org1msp/tom", "approveProposal", id).Status == shim.OK {
+		t.Errorf("a non-signer approved")
+	}
+	if owner := readTestCoin(t, ledger, cc, "coin1").Owner; owner != "multisig:treasury" {
+		t.Fatalf("coin1 moved to %s below the threshold", owner)
+	}
+
+	if status := string(ledger.mustInvoke(t, cc, "org2msp/carol", "approveProposal", id)); status != proposalExecuted {
+		t.Errorf("proposal is %s at the threshold", status)
+	}
+	if owner := readTestCoin(t, ledger, cc, "coin1").Owner; owner != "org1msp/dave" {
+		t.Errorf("coin1 is owned by %s after execution", owner)
+	}
+	if ledger.invoke(cc, "org1msp/bob", "approveProposal", id).Status == shim.OK {
+		t.Errorf("an executed proposal was approved")
+	}
+}
+
+func TestMultisigProposalExpiry(t *testing.T) {
+	ledger, cc := newTreasury(t)
+
+	id := string(ledger.mustInvoke(t, cc, "org1msp/alice", "proposeTransfer", "coin1", "org1msp/dave", "3600"))
+	ledger.clock = ledger.clock.Add(time.Hour)
+	if ledger.invoke(cc, "org1msp/bob", "approveProposal", id).Status == shim.OK {
+		t.Errorf("an expired proposal was approved")
+	}
+	if status := readTestProposal(t, ledger, cc, id).Status; status != proposalExpired {
+		t.Errorf("proposal is %s after its time to live", status)
+	}
+	if owner := readTestCoin(t, ledger, cc, "coin1").Owner; owner != "multisig:treasury" {
+		t.Errorf("coin1 moved to %s", owner)
+	}
+
+	for _, ttl := range []string{"0", "-1", "7776001", "soon"} {
+		if ledger.invoke(cc, "org1msp/alice", "proposeTransfer", "coin1", "org1msp/dave", ttl).Status == shim.OK {
+			t.Errorf("proposal with time to live %q was accepted", ttl)
+		}
+	}
+}
+
+func TestProposeTransferNormalizesOwner(t *testing.T) {
+	ledger, cc := newTreasury(t)
+
+	id := string(ledger.mustInvoke(t, cc, "org1msp/alice", "proposeTransfer", "coin1", " Org1MSP/Dave "))
+	if proposal := readTestProposal(t, ledger, cc, id); proposal.NewOwner != "org1msp/dave" {
+		t.Errorf("proposal moves coin1 to %q", proposal.NewOwner)
+	}
+	ledger.mustInvoke(t, cc, "org1msp/bob", "approveProposal", id)
+	if owner := readTestCoin(t, ledger, cc, "coin1").Owner; owner != "org1msp/dave" {
+		t.Errorf("coin1 is owned by %q after execution", owner)
+	}
+}
+
+func TestMultisigOwnerMustExist(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, multisigTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+
+	if ledger.invoke(cc, "org1msp/tom", "transferCoin", "coin1", "multisig:nope").Status == shim.OK {
+		t.Errorf("coin1 was given to a multisig account that does not exist")
+	}
+	if ledger.invoke(cc, "org1msp/admin", "initCoin", "coin2", "adollar", "multisig:nope").Status == shim.OK {
+		t.Errorf("coin2 was created for a multisig account that does not exist")
+	}
+}
+
+func TestMultisigProposalsVoidedWhenCoinLeaves(t *testing.T) {
+	ledger, cc := newTreasury(t)
+
+	stale := string(ledger.mustInvoke(t, cc, "org1msp/alice", "proposeTransfer", "coin1", "org1msp/alice"))
+	ledger.mustInvoke(t, cc, "org1msp/admin", "clawback", "coin1", "COURT_ORDER", testDocumentHash)
+	if status := readTestProposal(t, ledger, cc, stale).Status; status != proposalVoided {
+		t.Errorf("proposal is %s after the coin left the account", status)
+	}
+
+	// the approval of alice does not carry over when the coin comes back
+	ledger.mustInvoke(t, cc, "org1msp/admin", "forceTransfer", "coin1", "multisig:treasury", "ERROR", testDocumentHash)
+	if ledger.invoke(cc, "org1msp/bob", "approveProposal", stale).Status == shim.OK {
+		t.Errorf("a voided proposal was approved")
+	}
+
+	// executing one proposal voids the others
+	first := string(ledger.mustInvoke(t, cc, "org1msp/alice", "proposeTransfer", "coin1", "org1msp/dave"))
+	second := string(ledger.mustInvoke(t, cc, "org1msp/bob", "proposeTransfer", "coin1", "org1msp/erin"))
+	ledger.mustInvoke(t, cc, "org1msp/bob", "approveProposal", first)
+	if status := readTestProposal(t, ledger, cc, first).Status; status != proposalExecuted {
+		t.Errorf("executed proposal is %s", status)
+	}
+	if status := readTestProposal(t, ledger, cc, second).Status; status != proposalVoided {
+		t.Errorf("other proposal is %s after the coin left the account", status)
+	}
+}
@@ -0,0 +1,421 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Offer and accept transfers ====
+//
+// transferCoin moves a coin to whatever owner string it is given. With offerTransfer
+// the owner instead offers the coin to a recipient identity, and the coin only moves
+// when the recipient accepts it with acceptTransfer. The recipient can refuse the
+// offer with rejectTransfer and the owner can withdraw it with cancelOffer. While an
+// offer is pending the coin cannot be moved or deleted in any other way. Offers
+// expire after their time to live, an expired offer no longer blocks the coin.
+//
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["offerTransfer","coin1","org1msp/jerry","86400"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["acceptTransfer","coin1"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["rejectTransfer","coin1"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["cancelOffer","coin1"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["listOffers","org1msp/jerry"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	offerObjectType    = "offer"
+	offerFromIndex     = "offer~from~coin"
+	offerToIndex       = "offer~to~coin"
+	defaultOfferTTL    = 7 * 24 * time.Hour
+	maxOfferTTL        = 30 * 24 * time.Hour
+	offerStatusPending = "pending"
+	offerStatusExpired = "expired"
+)
+
+type transferOffer struct {
+	ObjectType string `json:"docType"`
+	Coin       string `json:"coin"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	TxID       string `json:"txId"`
+	CreatedAt  string `json:"createdAt"`
+	ExpiresAt  string `json:"expiresAt"`
+}
+
+// pendingAt reports whether the offer can still be accepted at time now.
+func (o *transferOffer) pendingAt(now time.Time) bool {
+	expiresAt, err := time.Parse(time.RFC3339, o.ExpiresAt)
+	return err == nil && now.Before(expiresAt)
+}
+
+// ===================================================================================
+// getOffer returns the offer on a coin, or nil if there is none
+// ===================================================================================
+func getOffer(stub shim.ChaincodeStubInterface, coinName string) (*transferOffer, error) {
+	offerKey, err := stub.CreateCompositeKey(offerObjectType, []string{coinName})
+	if err != nil {
+		return nil, err
+	}
+	offerAsBytes, err := stub.GetState(offerKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get offer of %s: %s", coinName, err)
+	} else if offerAsBytes == nil {
+		return nil, nil
+	}
+
+	offer := &transferOffer{}
+	err = json.Unmarshal(offerAsBytes, offer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode offer of %s: %s", coinName, err)
+	}
+	return offer, nil
+}
+
+// ===================================================================================
+// getPendingOffer returns the offer on a coin if it has not expired, or nil
+// ===================================================================================
+func getPendingOffer(stub shim.ChaincodeStubInterface, coinName string) (*transferOffer, error) {
+	offer, err := getOffer(stub, coinName)
+	if err != nil || offer == nil {
+		return nil, err
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !offer.pendingAt(now) {
+		return nil, nil
+	}
+	return offer, nil
+}
+
+// ===================================================================================
+// checkNoPendingOffer fails if the coin is offered to someone
+// ===================================================================================
+func checkNoPendingOffer(stub shim.ChaincodeStubInterface, coinName string) error {
+	offer, err := getPendingOffer(stub, coinName)
+	if err != nil {
+		return err
+	} else if offer != nil {
+		return fmt.Errorf("%s is offered to %s, the offer has to be cancelled first", coinName, offer.To)
+	}
+	return nil
+}
+
+// ===================================================================================
+// clearOffer removes the offer on a coin and its index entries, if any
+// ===================================================================================
+func clearOffer(stub shim.ChaincodeStubInterface, coinName string) error {
+	offer, err := getOffer(stub, coinName)
+	if err != nil || offer == nil {
+		return err
+	}
+
+	keys := [][]string{
+		{offerObjectType, coinName},
+		{offerFromIndex, offer.From, coinName},
+		{offerToIndex, offer.To, coinName},
+	}
+	for _, parts := range keys {
+		key, err := stub.CreateCompositeKey(parts[0], parts[1:])
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================
+// offerTransfer - owner only, offer a coin to a recipient who
+// has to accept it
+// ============================================================
+func (t *SimpleChaincode) offerTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0           1              2
+	// "coin1", "org1msp/jerry", "86400"
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting coin, recipient and optional time to live in seconds")
+	}
+
+	coinName := args[0]
+	recipient := normalizeIdentity(args[1])
+	if len(recipient) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	ttl := defaultOfferTTL
+	if len(args) == 3 {
+		seconds, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxOfferTTL {
+			return shim.Error(fmt.Sprintf("Time to live must be between 1 and %d seconds", int64(maxOfferTTL/time.Second)))
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	fmt.Println("- start offerTransfer ", coinName, recipient)
+
+	c, err := getCoin(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if id, ok := multisigID(c.Owner); ok {
+		return shim.Error(coinName + " is owned by multisig account " + id + ", use proposeTransfer")
+	}
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != c.Owner {
+		return shim.Error("Only the owner can offer " + coinName)
+	}
+	if recipient == c.Owner {
+		return shim.Error("Cannot offer a coin to its owner")
+	}
+
+	pending, err := getPendingOffer(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if pending != nil {
+		return shim.Error(coinName + " is already offered to " + pending.To)
+	}
+	// fail early, acceptTransfer checks again when the coin moves
+	err = checkCompliance(stub, c.Owner, recipient)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// an expired offer is replaced
+	err = clearOffer(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offer := &transferOffer{
+		ObjectType: offerObjectType,
+		Coin:       coinName,
+		From:       c.Owner,
+		To:         recipient,
+		TxID:       stub.GetTxID(),
+		CreatedAt:  now.Format(time.RFC3339),
+		ExpiresAt:  now.Add(ttl).Format(time.RFC3339),
+	}
+	offerJSONasBytes, err := json.Marshal(offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	keys := [][]string{
+		{offerObjectType, coinName},
+		{offerFromIndex, offer.From, coinName},
+		{offerToIndex, offer.To, coinName},
+	}
+	for i, parts := range keys {
+		key, err := stub.CreateCompositeKey(parts[0], parts[1:])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		value := []byte{0x00}
+		if i == 0 {
+			value = offerJSONasBytes
+		}
+		err = stub.PutState(key, value)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	fmt.Println("- end offerTransfer (success)")
+	return shim.Success(offerJSONasBytes)
+}
+
+// ============================================================
+// acceptTransfer - the recipient of an offer takes the coin
+// ============================================================
+func (t *SimpleChaincode) acceptTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "coin1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	coinName := args[0]
+	offer, caller, err := offerForCaller(stub, coinName, func(o *transferOffer) string { return o.To }, true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- start acceptTransfer ", coinName, caller)
+
+	c, err := getCoin(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if c.Owner != offer.From {
+		return shim.Error(coinName + " is no longer owned by " + offer.From)
+	}
+
+	err = moveCoin(stub, c, offer.To, transferOptions{Offer: true})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end acceptTransfer (success)")
+	return shim.Success(nil)
+}
+
+// ============================================================
+// rejectTransfer - the recipient of an offer refuses the coin
+// ============================================================
+func (t *SimpleChaincode) rejectTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	_, _, err := offerForCaller(stub, args[0], func(o *transferOffer) string { return o.To }, false)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = clearOffer(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end rejectTransfer " + args[0])
+	return shim.Success(nil)
+}
+
+// ============================================================
+// cancelOffer - the owner withdraws an offer
+// ============================================================
+func (t *SimpleChaincode) cancelOffer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	_, _, err := offerForCaller(stub, args[0], func(o *transferOffer) string { return o.From }, false)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = clearOffer(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end cancelOffer " + args[0])
+	return shim.Success(nil)
+}
+
+// offerForCaller returns the offer on a coin if the caller is the party of the offer
+// selected by party. Accepting needs a pending offer, rejecting and cancelling also
+// clear expired ones.
+func offerForCaller(stub shim.ChaincodeStubInterface, coinName string, party func(*transferOffer) string, requirePending bool) (*transferOffer, string, error) {
+	offer, err := getOffer(stub, coinName)
+	if err != nil {
+		return nil, "", err
+	} else if offer == nil {
+		return nil, "", fmt.Errorf("%s has no offer", coinName)
+	}
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return nil, "", err
+	}
+	if caller != party(offer) {
+		return nil, "", fmt.Errorf("%s is not a party to the offer of %s", caller, coinName)
+	}
+	if requirePending {
+		now, err := getTxTime(stub)
+		if err != nil {
+			return nil, "", err
+		}
+		if !offer.pendingAt(now) {
+			return nil, "", fmt.Errorf("the offer of %s expired at %s", coinName, offer.ExpiresAt)
+		}
+	}
+	return offer, caller, nil
+}
+
+type offerStatus struct {
+	*transferOffer
+	Status string `json:"status"`
+}
+
+// ============================================================
+// listOffers - the incoming and outgoing offers of an identity
+// ============================================================
+func (t *SimpleChaincode) listOffers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting identity")
+	}
+	identity := normalizeIdentity(args[0])
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	incoming, err := listOffersIn(stub, offerToIndex, identity, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	outgoing, err := listOffersIn(stub, offerFromIndex, identity, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offersJSONasBytes, err := json.Marshal(map[string][]offerStatus{"incoming": incoming, "outgoing": outgoing})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(offersJSONasBytes)
+}
+
+func listOffersIn(stub shim.ChaincodeStubInterface, index string, identity string, now time.Time) ([]offerStatus, error) {
+	coinNames, err := listIndex(stub, index, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	offers := []offerStatus{}
+	for _, coinName := range coinNames {
+		offer, err := getOffer(stub, coinName)
+		if err != nil {
+			return nil, err
+		} else if offer == nil {
+			continue
+		}
+		status := offerStatusPending
+		if !offer.pendingAt(now) {
+			status = offerStatusExpired
+		}
+		offers = append(offers, offerStatus{transferOffer: offer, Status: status})
+	}
+	return offers, nil
+}
@@ -0,0 +1,151 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const offerTestConfig = `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"],"regulator":["org1msp/admin"]},"recoveryAccount":"org1msp/recovery"}`
+
+// newOfferLedger returns a ledger where tom holds coin1 and has offered it to jerry
+// for an hour.
+func newOfferLedger(t *testing.T) (*fakeLedger, *SimpleChaincode) {
+	t.Helper()
+	ledger, cc := newFakeChaincode(t, offerTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "offerTransfer", "coin1", "org2msp/jerry", "3600")
+	return ledger, cc
+}
+
+// testOffer is an offer as listOffers returns it.
+type testOffer struct {
+	Coin   string `json:"coin"`
+	To     string `json:"to"`
+	Status string `json:"status"`
+}
+
+func readTestOffers(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, identity string) map[string][]testOffer {
+	t.Helper()
+	offers := map[string][]testOffer{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, identity, "listOffers", identity), &offers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return offers
+}
+
+func TestOfferAccepted(t *testing.T) {
+	ledger, cc := newOfferLedger(t)
+
+	if ledger.invoke(cc, "org1msp/tom", "transferCoin", "coin1", "org1msp/bob").Status == shim.OK {
+		t.Errorf("an offered coin was transferred")
+	}
+	if ledger.invoke(cc, "org1msp/admin", "delete", "coin1").Status == shim.OK {
+		t.Errorf("an offered coin was deleted")
+	}
+	if ledger.invoke(cc, "org1msp/bob", "acceptTransfer", "coin1").Status == shim.OK {
+		t.Errorf("an offer was accepted by someone else than the recipient")
+	}
+
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "acceptTransfer", "coin1")
+	if owner := readTestCoin(t, ledger, cc, "coin1").Owner; owner != "org2msp/jerry" {
+		t.Errorf("coin1 is owned by %s after the offer was accepted", owner)
+	}
+	if offers := readTestOffers(t, ledger, cc, "org2msp/jerry"); len(offers["incoming"]) != 0 {
+		t.Errorf("offers of jerry after accepting are %+v", offers)
+	}
+	checkLedgerConsistency(t, ledger)
+}
+
+func TestOfferExpires(t *testing.T) {
+	ledger, cc := newOfferLedger(t)
+
+	ledger.clock = ledger.clock.Add(time.Hour)
+	offers := readTestOffers(t, ledger, cc, "org2msp/jerry")
+	if len(offers["incoming"]) != 1 || offers["incoming"][0].Status != offerStatusExpired {
+		t.Errorf("incoming offers of jerry after the time to live are %+v", offers["incoming"])
+	}
+	if ledger.invoke(cc, "org2msp/jerry", "acceptTransfer", "coin1").Status == shim.OK {
+		t.Errorf("an expired offer was accepted")
+	}
+
+	// the expired offer no longer blocks the coin, and is gone once it moves
+	ledger.mustInvoke(t, cc, "org1msp/tom", "offerTransfer", "coin1", "org1msp/bob", "60")
+	ledger.clock = ledger.clock.Add(time.Minute)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org1msp/bob")
+	if offers := readTestOffers(t, ledger, cc, "org1msp/tom"); len(offers["outgoing"]) != 0 {
+		t.Errorf("outgoing offers of tom after the coin moved are %+v", offers["outgoing"])
+	}
+}
+
+func TestOfferAcceptedAfterOwnerChanged(t *testing.T) {
+	ledger, cc := newOfferLedger(t)
+
+	// a clawback takes the offer with the coin
+	ledger.mustInvoke(t, cc, "org1msp/admin", "clawback", "coin1", "COURT_ORDER", testDocumentHash)
+	if ledger.invoke(cc, "org2msp/jerry", "acceptTransfer", "coin1").Status == shim.OK {
+		t.Errorf("the offer of tom was accepted after the coin was clawed back")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "forceTransfer", "coin1", "org1msp/tom", "ERROR", testDocumentHash)
+	if ledger.invoke(cc, "org2msp/jerry", "acceptTransfer", "coin1").Status == shim.OK {
+		t.Errorf("the offer of tom was accepted after the coin came back to tom")
+	}
+
+	// endorsed against the same state, the accept loses to the clawback ordered before it
+	ledger.mustInvoke(t, cc, "org1msp/tom", "offerTransfer", "coin1", "org2msp/jerry")
+	clawback := ledger.newStub("org1msp/admin", "clawback", "coin1", "COURT_ORDER", testDocumentHash)
+	accept := ledger.newStub("org2msp/jerry", "acceptTransfer", "coin1")
+	for _, stub := range []*fakeStub{clawback, accept} {
+		if response := cc.Invoke(stub); response.Status != shim.OK {
+			t.Fatal(response.Message)
+		}
+	}
+	if valid := ledger.commit(clawback, accept); !valid[0] || valid[1] {
+		t.Errorf("validity of a clawback and an accept in one block is %v", valid)
+	}
+	if owner := readTestCoin(t, ledger, cc, "coin1").Owner; owner != "org1msp/recovery" {
+		t.Errorf("coin1 is owned by %s", owner)
+	}
+	checkLedgerConsistency(t, ledger)
+}
+
+func TestOfferRejectedAndCancelled(t *testing.T) {
+	ledger, cc := newOfferLedger(t)
+
+	if ledger.invoke(cc, "org1msp/tom", "rejectTransfer", "coin1").Status == shim.OK {
+		t.Errorf("the owner rejected the offer")
+	}
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "rejectTransfer", "coin1")
+	if ledger.invoke(cc, "org2msp/jerry", "acceptTransfer", "coin1").Status == shim.OK {
+		t.Errorf("a rejected offer was accepted")
+	}
+
+	ledger.mustInvoke(t, cc, "org1msp/tom", "offerTransfer", "coin1", "org2msp/jerry")
+	if ledger.invoke(cc, "org2msp/jerry", "cancelOffer", "coin1").Status == shim.OK {
+		t.Errorf("the recipient cancelled the offer")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/tom", "cancelOffer", "coin1")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org1msp/bob")
+}
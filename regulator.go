@@ -0,0 +1,250 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Regulatory actions ====
+//
+// Identities holding the regulator role can move a coin without the consent of its
+// owner: forceTransfer moves it to a given identity, clawback moves it to the
+// recovery account set in the configuration (recoveryAccount). Both require a reason
+// code and the SHA-256 hash (64 hex digits) of the document authorising the action,
+// e.g. a court order. Restrictions on the current owner, such as a freeze, do not
+// apply to these actions, restrictions on the new owner do.
+//
+// Each action emits a RegulatoryAction event, writes an audit record (actions
+// forceTransfer and clawback) and is recorded under regaction~coin~txid, so the
+// regulatory actions on a coin can be read separately from its ordinary history. In the
+// history of the coin the transfer carries the same record.
+//
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["forceTransfer","coin1","org1msp/tom","FRAUD","<sha256 hex>"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["clawback","coin1","COURT_ORDER","<sha256 hex>"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["getRegulatoryActions","coin1"]}'
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	regulatoryActionObjectType = "regaction"
+	regulatoryActionCoinIndex  = "regaction~coin~txid"
+	regulatoryActionEvent      = "RegulatoryAction"
+)
+
+// reasonCodes are the accepted reasons for a regulatory action.
+var reasonCodes = map[string]bool{
+	"FRAUD":       true,
+	"COURT_ORDER": true,
+	"SANCTIONS":   true,
+	"ERROR":       true,
+}
+
+type regulatoryAction struct {
+	ObjectType    string `json:"docType"`
+	Action        string `json:"action"`
+	Coin          string `json:"coin"`
+	PreviousOwner string `json:"previousOwner"`
+	NewOwner      string `json:"newOwner"`
+	ReasonCode    string `json:"reasonCode"`
+	DocumentHash  string `json:"documentHash"`
+	Regulator     string `json:"regulator"`
+	TxID          string `json:"txId"`
+	Timestamp     string `json:"timestamp"`
+}
+
+// ============================================================
+// forceTransfer - regulators only, move a coin to a new owner
+// ============================================================
+func (t *SimpleChaincode) forceTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1              2          3
+	// "coin1", "org1msp/tom", "FRAUD", "<sha256 hex>"
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	newOwner := normalizeIdentity(args[1])
+	if len(newOwner) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	return regulatoryMove(stub, "forceTransfer", args[0], newOwner, args[2], args[3])
+}
+
+// ============================================================
+// clawback - regulators only, move a coin to the recovery account
+// ============================================================
+func (t *SimpleChaincode) clawback(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1               2
+	// "coin1", "COURT_ORDER", "<sha256 hex>"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(config.RecoveryAccount) <= 0 {
+		return shim.Error("No recovery account is configured")
+	}
+	return regulatoryMove(stub, "clawback", args[0], config.RecoveryAccount, args[1], args[2])
+}
+
+// regulatoryMove performs and records a forced move of a coin.
+func regulatoryMove(stub shim.ChaincodeStubInterface, action string, coinName string, newOwner string, reasonCode string, documentHash string) pb.Response {
+	reasonCode = strings.ToUpper(strings.TrimSpace(reasonCode))
+	if !reasonCodes[reasonCode] {
+		return shim.Error("Unknown reason code: " + reasonCode)
+	}
+	documentHash = strings.ToLower(strings.TrimSpace(documentHash))
+	if _, err := hex.DecodeString(documentHash); err != nil || len(documentHash) != 64 {
+		return shim.Error("Document hash must be a SHA-256 hash of 64 hex digits")
+	}
+
+	regulator, err := requireRole(stub, roleRegulator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- start "+action, coinName, newOwner, reasonCode)
+
+	c, err := getCoin(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	previousOwner := c.Owner
+	if previousOwner == newOwner {
+		return shim.Error(coinName + " is already owned by " + newOwner)
+	}
+
+	err = moveCoin(stub, c, newOwner, transferOptions{Forced: true})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	record := &regulatoryAction{
+		ObjectType:    regulatoryActionObjectType,
+		Action:        action,
+		Coin:          coinName,
+		PreviousOwner: previousOwner,
+		NewOwner:      newOwner,
+		ReasonCode:    reasonCode,
+		DocumentHash:  documentHash,
+		Regulator:     regulator,
+		TxID:          stub.GetTxID(),
+		Timestamp:     txTime.Format(time.RFC3339),
+	}
+	recordJSONasBytes, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recordKey, err := stub.CreateCompositeKey(regulatoryActionCoinIndex, []string{coinName, record.TxID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(recordKey, recordJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = writeAudit(stub, action, coinName, regulator, map[string]string{
+		"previousOwner": previousOwner,
+		"newOwner":      newOwner,
+		"reasonCode":    reasonCode,
+		"documentHash":  documentHash,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = stub.SetEvent(regulatoryActionEvent, recordJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end " + action + " (success)")
+	return shim.Success(recordJSONasBytes)
+}
+
+// ===================================================================================
+// getRegulatoryAction returns the regulatory action on a coin in a transaction, or nil
+// if the transaction was not one
+// ===================================================================================
+func getRegulatoryAction(stub shim.ChaincodeStubInterface, coinName string, txID string) (*regulatoryAction, error) {
+	recordKey, err := stub.CreateCompositeKey(regulatoryActionCoinIndex, []string{coinName, txID})
+	if err != nil {
+		return nil, err
+	}
+	recordAsBytes, err := stub.GetState(recordKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get regulatory action on %s: %s", coinName, err)
+	} else if recordAsBytes == nil {
+		return nil, nil
+	}
+
+	record := &regulatoryAction{}
+	err = json.Unmarshal(recordAsBytes, record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode regulatory action on %s: %s", coinName, err)
+	}
+	return record, nil
+}
+
+// ============================================================
+// getRegulatoryActions - the forced transfers and clawbacks of a coin
+// ============================================================
+func (t *SimpleChaincode) getRegulatoryActions(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting coin name")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(regulatoryActionCoinIndex, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	records := []json.RawMessage{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		records = append(records, json.RawMessage(queryResponse.Value))
+	}
+
+	recordsJSONasBytes, err := json.Marshal(records)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- getRegulatoryActions returning %d records\n", len(records))
+	return shim.Success(recordsJSONasBytes)
+}
@@ -0,0 +1,117 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const regulatorTestConfig = `{"admins":["org1msp/admin"],"roles":{"regulator":["org2msp/regulator"]}}`
+
+func readTestRegulatoryActions(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, coinName string) []*regulatoryAction {
+	t.Helper()
+	records := []*regulatoryAction{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "getRegulatoryActions", coinName), &records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestRegulatoryActionsValidated(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, regulatorTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+
+	for _, call := range [][]string{
+		{"org1msp/admin", "forceTransfer", "coin1", "org2msp/jerry", "FRAUD", testDocumentHash},
+		{"org2msp/regulator", "forceTransfer", "coin1", "org2msp/jerry", "BECAUSE", testDocumentHash},
+		{"org2msp/regulator", "forceTransfer", "coin1", "org2msp/jerry", "FRAUD", testDocumentHash[:62]},
+		{"org2msp/regulator", "forceTransfer", "coin1", "org2msp/jerry", "FRAUD", strings.Repeat("zz", 32)},
+		{"org2msp/regulator", "forceTransfer", "coin1", "org2msp/jerry", "FRAUD", ""},
+		{"org2msp/regulator", "forceTransfer", "coin1", "org1msp/tom", "FRAUD", testDocumentHash},
+		{"org2msp/regulator", "forceTransfer", "coin1", " ", "FRAUD", testDocumentHash},
+		{"org2msp/regulator", "clawback", "coin1", "COURT_ORDER", testDocumentHash},
+	} {
+		if ledger.invoke(cc, call[0], call[1], call[2:]...).Status == shim.OK {
+			t.Errorf("%s by %s with %v succeeded", call[1], call[0], call[2:])
+		}
+	}
+	if records := readTestRegulatoryActions(t, ledger, cc, "coin1"); len(records) != 0 {
+		t.Errorf("refused actions left records %+v", records)
+	}
+}
+
+func TestRegulatoryActionsRecorded(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, regulatorTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+
+	// reason codes and hashes are normalized
+	stub := ledger.newStub("org2msp/regulator", "forceTransfer", "coin1", "Org1MSP/Spike", " fraud ", strings.ToUpper(testDocumentHash))
+	if response := cc.Invoke(stub); response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	ledger.commit(stub)
+	event := &regulatoryAction{}
+	if err := json.Unmarshal(stub.events[regulatoryActionEvent], event); err != nil {
+		t.Fatalf("no %s event: %s", regulatoryActionEvent, err)
+	}
+	expected := regulatoryAction{ObjectType: regulatoryActionObjectType, Action: "forceTransfer", Coin: "coin1", PreviousOwner: "org2msp/jerry",
+		NewOwner: "org1msp/spike", ReasonCode: "FRAUD", DocumentHash: testDocumentHash, Regulator: "org2msp/regulator", TxID: stub.txID, Timestamp: event.Timestamp}
+	if *event != expected {
+		t.Errorf("event of forceTransfer is %+v", event)
+	}
+
+	ledger.mustInvoke(t, cc, "org1msp/admin", "updateConfig", `{"recoveryAccount":"org1msp/recovery"}`)
+	ledger.mustInvoke(t, cc, "org2msp/regulator", "clawback", "coin1", "COURT_ORDER", testDocumentHash)
+	records := readTestRegulatoryActions(t, ledger, cc, "coin1")
+	if len(records) != 2 || *records[0] != expected {
+		t.Fatalf("regulatory actions on coin1 are %+v", records)
+	}
+	if clawback := records[1]; clawback.Action != "clawback" || clawback.PreviousOwner != "org1msp/spike" || clawback.NewOwner != "org1msp/recovery" || clawback.ReasonCode != "COURT_ORDER" {
+		t.Errorf("clawback is recorded as %+v", clawback)
+	}
+	if c := readTestCoin(t, ledger, cc, "coin1"); c.Owner != "org1msp/recovery" {
+		t.Errorf("coin1 is owned by %s after the clawback", c.Owner)
+	}
+	if records := readTestRegulatoryActions(t, ledger, cc, "coin2"); len(records) != 0 {
+		t.Errorf("regulatory actions on coin2 are %+v", records)
+	}
+
+	trail := []auditRecord{}
+	if err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/admin", "getAuditTrail", "forceTransfer"), &trail); err != nil {
+		t.Fatal(err)
+	}
+	if len(trail) != 1 || trail[0].Actor != "org2msp/regulator" || trail[0].Details["reasonCode"] != "FRAUD" {
+		t.Errorf("audit trail of forceTransfer is %+v", trail)
+	}
+
+	// the history tells the forced moves from the transfer of the owner
+	page := readTestHistory(t, ledger, cc, "coin1", `{"changeType":"transfer","order":"oldest"}`)
+	if len(page.Entries) != 3 || page.Entries[0].Regulatory != nil ||
+		page.Entries[1].Regulatory == nil || *page.Entries[1].Regulatory != expected ||
+		page.Entries[2].Regulatory == nil || page.Entries[2].Regulatory.Action != "clawback" {
+		t.Errorf("history of the transfers of coin1 is %+v", page.Entries)
+	}
+}
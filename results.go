@@ -0,0 +1,297 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Query results ====
+//
+// The query functions stream their results through a resultWriter, which returns
+// one page in the envelope
+//
+//	{"records":[{"Key":"coin1","Record":{...}}],"bookmark":"...","skipped":["coin7"]}
+//
+// (getHistoryForCoin names the array "entries"). Keys are escaped, so composite keys
+// with their null separators still give valid JSON, and every record is checked to be
+// valid JSON before it is written. A corrupt record fails the query, unless the caller
+// asks to skip corrupt records; their keys are then listed under skipped.
+//
+// The records of a response take at most maxResponseBytes from the configuration, or
+// less if the caller asks for it. When the budget is reached the response ends early
+// and its bookmark continues after the last record written. The first record is always
+// written, so that a record larger than the budget does not stall the client. The
+// bookmark is empty once there are no more records.
+//
+// The options are a JSON document, all fields optional. getHistoryForCoin and
+// searchCoins take them as part of their filter, the other queries as their last
+// argument. getCoinsByRange, queryCoinsByOwner and queryCoins return the bare array
+// of records, as they always have, when they are called without options. They fail
+// instead of ending early when the records do not fit in the budget:
+//
+//	skipCorrupt   leave out records that are not valid JSON instead of failing
+//	maxBytes      budget for the records of the response
+//	bookmark      the bookmark returned with the previous response
+//
+// peer chaincode query -C myc1 -n coins -c '{"Args":["getCoinsByRange","coin1","coin3","{\"maxBytes\":4096}"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["queryCoinsByOwner","org1msp/tom","{\"skipCorrupt\":true,\"bookmark\":\"<bookmark>\"}"]}'
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+var errCorruptRecord = errors.New("record is not valid JSON")
+
+type resultOptions struct {
+	SkipCorrupt bool   `json:"skipCorrupt"`
+	MaxBytes    int    `json:"maxBytes"` //0 for the configured maxResponseBytes
+	Bookmark    string `json:"bookmark"`
+}
+
+// validate applies the configured budget to the options.
+func (o *resultOptions) validate(config *chaincodeConfig) error {
+	if o.MaxBytes == 0 {
+		o.MaxBytes = config.MaxResponseBytes
+	}
+	if o.MaxBytes < 0 || o.MaxBytes > config.MaxResponseBytes {
+		return fmt.Errorf("maxBytes must be between 1 and %d", config.MaxResponseBytes)
+	}
+	return nil
+}
+
+// ===================================================================================
+// parseResultOptions decodes and validates an options argument, empty for the defaults
+// ===================================================================================
+func parseResultOptions(optionsJSON string, config *chaincodeConfig) (*resultOptions, error) {
+	options := &resultOptions{}
+	if len(strings.TrimSpace(optionsJSON)) > 0 {
+		decoder := json.NewDecoder(strings.NewReader(optionsJSON))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(options)
+		if err != nil {
+			return nil, fmt.Errorf("options must be a JSON document with skipCorrupt, maxBytes and bookmark: %s", err)
+		}
+	}
+	err := options.validate(config)
+	if err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// ===================================================================================
+// resultWriter builds a page of results within the byte budget of its options
+// ===================================================================================
+type resultWriter struct {
+	field   string //name of the array in the envelope
+	options resultOptions
+	buffer  bytes.Buffer //the elements written, comma separated
+	count   int
+	skipped []string
+}
+
+func newResultWriter(field string, options *resultOptions) *resultWriter {
+	return &resultWriter{field: field, options: *options}
+}
+
+// addElement appends an encoded element, or returns false if it does not fit.
+func (w *resultWriter) addElement(element []byte) bool {
+	if w.count > 0 {
+		if w.buffer.Len()+1+len(element) > w.options.MaxBytes {
+			return false
+		}
+		w.buffer.WriteString(",")
+	}
+	w.buffer.Write(element)
+	w.count++
+	return true
+}
+
+// skip lists the key of a corrupt record, or fails if the options do not allow that.
+func (w *resultWriter) skip(key string) error {
+	if !w.options.SkipCorrupt {
+		return fmt.Errorf("%w: %q", errCorruptRecord, key)
+	}
+	w.skipped = append(w.skipped, key)
+	return nil
+}
+
+// addRecord appends a key and its value, or returns false if they do not fit.
+func (w *resultWriter) addRecord(key string, value []byte) (bool, error) {
+	keyJSONasBytes, err := json.Marshal(key)
+	if err != nil {
+		return false, err
+	}
+	var record bytes.Buffer
+	record.WriteString(`{"Key":`)
+	record.Write(keyJSONasBytes)
+	record.WriteString(`,"Record":`)
+	err = json.Compact(&record, value)
+	if err != nil {
+		return true, w.skip(key)
+	}
+	record.WriteString("}")
+	return w.addElement(record.Bytes()), nil
+}
+
+// ===================================================================================
+// writeRecords writes the records of resultsIterator, leaving out the first skip, until
+// the budget is reached. It returns the position and key of the first record that did
+// not fit, or -1 if every record was written. transform, if given, returns the key and
+// value to write for a record, a nil value to leave it out.
+// ===================================================================================
+func (w *resultWriter) writeRecords(resultsIterator shim.StateQueryIteratorInterface, skip int, transform func(string, []byte) (string, []byte, error)) (int, string, error) {
+	for position := 0; resultsIterator.HasNext(); position++ {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, "", err
+		}
+		if position < skip {
+			continue
+		}
+		key, value := queryResponse.Key, queryResponse.Value
+		if transform != nil {
+			key, value, err = transform(key, value)
+			if err != nil {
+				return 0, "", err
+			} else if value == nil {
+				continue
+			}
+		}
+		written, err := w.addRecord(key, value)
+		if err != nil {
+			return 0, "", err
+		} else if !written {
+			return position, queryResponse.Key, nil
+		}
+	}
+	return -1, "", nil
+}
+
+// continuation is the bookmark of a paginated query: the bookmark of the page to go on
+// with, and how many of its records were already returned.
+type continuation struct {
+	Bookmark string `json:"b"`
+	Skip     int    `json:"s,omitempty"`
+}
+
+func parseContinuation(bookmark string) (*continuation, error) {
+	next := &continuation{}
+	if len(bookmark) <= 0 {
+		return next, nil
+	}
+	bookmarkAsBytes, err := base64.RawURLEncoding.DecodeString(bookmark)
+	if err == nil {
+		err = json.Unmarshal(bookmarkAsBytes, next)
+	}
+	if err != nil || next.Skip < 0 {
+		return nil, fmt.Errorf("invalid bookmark: %s", bookmark)
+	}
+	return next, nil
+}
+
+func (c *continuation) String() string {
+	bookmarkAsBytes, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(bookmarkAsBytes)
+}
+
+// ===================================================================================
+// writePages writes the records of up to pages pages, 0 for all, starting at the
+// bookmark of the options. fetch returns the page with the given bookmark. Returns the
+// bookmark to continue with, empty after the last page.
+// ===================================================================================
+func (w *resultWriter) writePages(pageSize int32, pages int, fetch func(string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error), transform func(string, []byte) (string, []byte, error)) (string, error) {
+	next, err := parseContinuation(w.options.Bookmark)
+	if err != nil {
+		return "", err
+	}
+	for page := 1; ; page++ {
+		resultsIterator, metadata, err := fetch(next.Bookmark)
+		if err != nil {
+			return "", err
+		}
+		position, _, err := w.writeRecords(resultsIterator, next.Skip, transform)
+		resultsIterator.Close()
+		if err != nil {
+			return "", err
+		}
+		if position >= 0 {
+			next.Skip = position
+			return next.String(), nil
+		}
+		if metadata.FetchedRecordsCount < pageSize || len(metadata.Bookmark) <= 0 {
+			return "", nil
+		}
+		next = &continuation{Bookmark: metadata.Bookmark}
+		if page == pages {
+			return next.String(), nil
+		}
+	}
+}
+
+// ===================================================================================
+// page returns the envelope with the elements written and the bookmark
+// ===================================================================================
+func (w *resultWriter) page(bookmark string) ([]byte, error) {
+	bookmarkJSONasBytes, err := json.Marshal(bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	var page bytes.Buffer
+	page.WriteString(`{"` + w.field + `":[`)
+	page.Write(w.buffer.Bytes())
+	page.WriteString(`],"bookmark":`)
+	page.Write(bookmarkJSONasBytes)
+	if len(w.skipped) > 0 {
+		skippedJSONasBytes, err := json.Marshal(w.skipped)
+		if err != nil {
+			return nil, err
+		}
+		page.WriteString(`,"skipped":`)
+		page.Write(skippedJSONasBytes)
+	}
+	page.WriteString("}")
+	return page.Bytes(), nil
+}
+
+// ===================================================================================
+// response returns the envelope if the caller passed options, otherwise the bare array
+// of the elements, which holds all of them or fails
+// ===================================================================================
+func (w *resultWriter) response(bookmark string, paged bool) ([]byte, error) {
+	if paged {
+		return w.page(bookmark)
+	}
+	if len(bookmark) > 0 {
+		return nil, fmt.Errorf("results exceed %d bytes, pass options to page through them", w.options.MaxBytes)
+	}
+
+	var array bytes.Buffer
+	array.WriteString("[")
+	array.Write(w.buffer.Bytes())
+	array.WriteString("]")
+	return array.Bytes(), nil
+}
@@ -0,0 +1,94 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// testRecord is an element of the records of a query response.
+type testRecord struct {
+	Key    string          `json:"Key"`
+	Record json.RawMessage `json:"Record"`
+}
+
+// newRangeLedger returns a ledger with coin0 to coin4, and a response budget that
+// holds about two of them.
+func newRangeLedger(t *testing.T) (*fakeLedger, *SimpleChaincode) {
+	t.Helper()
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"]},"maxResponseBytes":400}`)
+	for i := 0; i < 5; i++ {
+		ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin"+strconv.Itoa(i), "adollar", "org1msp/tom")
+	}
+	return ledger, cc
+}
+
+func TestGetCoinsByRangeWithoutOptions(t *testing.T) {
+	ledger, cc := newRangeLedger(t)
+
+	records := []testRecord{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "getCoinsByRange", "coin1", "coin3"), &records)
+	if err != nil {
+		t.Fatalf("response without options is not an array: %s", err)
+	}
+	if len(records) != 2 || records[0].Key != "coin1" || records[1].Key != "coin2" {
+		t.Errorf("records are %+v", records)
+	}
+
+	if ledger.invoke(cc, "org1msp/tom", "getCoinsByRange", "coin0", "coin9").Status == shim.OK {
+		t.Errorf("response without options was cut short instead of failing")
+	}
+}
+
+func TestGetCoinsByRangePages(t *testing.T) {
+	ledger, cc := newRangeLedger(t)
+
+	keys := []string{}
+	bookmark := ""
+	for pages := 1; ; pages++ {
+		optionsJSON, err := json.Marshal(&resultOptions{Bookmark: bookmark})
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := struct {
+			Records  []testRecord `json:"records"`
+			Bookmark string       `json:"bookmark"`
+		}{}
+		err = json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "getCoinsByRange", "coin0", "coin9", string(optionsJSON)), &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, record := range page.Records {
+			keys = append(keys, record.Key)
+		}
+		if bookmark = page.Bookmark; len(bookmark) == 0 {
+			break
+		} else if pages == 5 {
+			t.Fatalf("still paging after %d pages", pages)
+		}
+	}
+	if len(keys) != 5 || keys[0] != "coin0" || keys[4] != "coin4" {
+		t.Errorf("pages hold %v", keys)
+	}
+}
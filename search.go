@@ -0,0 +1,202 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Coin search ====
+//
+// searchCoins takes a filter with a fixed set of fields and compiles it into a CouchDB
+// query that is always scoped to docType "coin" and only uses fields that have an
+// index packaged with the chaincode (see searchIndexes). At least one condition is
+// required, so the query never scans every coin. Results are paged with the CouchDB
+// bookmark. Only supported if CouchDB is used as state database.
+//
+//	owner                    coins of this owner
+//	denomination             coins of this denomination
+//	namePrefix               coins whose name starts with this prefix
+//	createdFrom, createdTo   RFC3339 bounds on the creation time, inclusive
+//	sort                     owner, amount, Name or createdAt
+//	order                    asc (the default) or desc
+//	limit                    page size, at most the configured maxPageSize
+//	bookmark                 the bookmark returned with the previous page
+//	skipCorrupt, maxBytes    see results.go
+//
+// peer chaincode query -C myc1 -n coins -c '{"Args":["searchCoins","{\"owner\":\"org1msp/tom\",\"denomination\":\"adollar\"}"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["searchCoins","{\"createdFrom\":\"2024-01-01T00:00:00Z\",\"sort\":\"createdAt\",\"order\":\"desc\",\"limit\":20}"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// searchIndexes maps each coin field searchCoins may query or sort on to the CouchDB
+// index on docType and that field, packaged in META-INF/statedb/couchdb/indexes.
+var searchIndexes = map[string]couchIndex{
+	"owner":     {DesignDoc: "indexOwnerDoc", Name: "indexOwner"},
+	"amount":    {DesignDoc: "indexAmountDoc", Name: "indexAmount"},
+	"Name":      {DesignDoc: "indexNameDoc", Name: "indexName"},
+	"createdAt": {DesignDoc: "indexCreatedAtDoc", Name: "indexCreatedAt"},
+}
+
+type couchIndex struct {
+	DesignDoc string
+	Name      string
+}
+
+type searchFilter struct {
+	Owner        string `json:"owner"`
+	Denomination string `json:"denomination"`
+	NamePrefix   string `json:"namePrefix"`
+	CreatedFrom  string `json:"createdFrom"`
+	CreatedTo    string `json:"createdTo"`
+	Sort         string `json:"sort"`
+	Order        string `json:"order"`
+	Limit        int32  `json:"limit"`
+	resultOptions
+}
+
+// ===================================================================================
+// compileSearch validates a search filter and builds the CouchDB query for it. The
+// query is marshalled, never formatted, so filter values cannot change its structure.
+// ===================================================================================
+func compileSearch(filterJSON string, config *chaincodeConfig) (string, *searchFilter, error) {
+	filter := &searchFilter{}
+	decoder := json.NewDecoder(strings.NewReader(filterJSON))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(filter)
+	if err != nil {
+		return "", nil, fmt.Errorf("filter must be a JSON document with the fields of searchCoins: %s", err)
+	}
+
+	selector := map[string]interface{}{"docType": coinObjectType}
+	fields := []string{} //queried fields, in order of preference for the index
+	if len(filter.Owner) > 0 {
+		selector["owner"] = normalizeIdentity(filter.Owner)
+		fields = append(fields, "owner")
+	}
+	if len(filter.Denomination) > 0 {
+		selector["amount"] = strings.ToLower(filter.Denomination)
+		fields = append(fields, "amount")
+	}
+	if len(filter.NamePrefix) > 0 {
+		selector["Name"] = map[string]string{"$gte": filter.NamePrefix, "$lt": filter.NamePrefix + "\ufff0"}
+		fields = append(fields, "Name")
+	}
+	if len(filter.CreatedFrom) > 0 || len(filter.CreatedTo) > 0 {
+		createdAt := map[string]string{}
+		for operator, arg := range map[string]string{"$gte": filter.CreatedFrom, "$lte": filter.CreatedTo} {
+			if len(arg) <= 0 {
+				continue
+			}
+			bound, err := time.Parse(time.RFC3339, arg)
+			if err != nil {
+				return "", nil, fmt.Errorf("createdFrom and createdTo must be RFC3339 timestamps")
+			}
+			createdAt[operator] = bound.UTC().Format(time.RFC3339)
+		}
+		selector["createdAt"] = createdAt
+		fields = append(fields, "createdAt")
+	}
+	if len(fields) == 0 {
+		return "", nil, fmt.Errorf("filter must have at least one of owner, denomination, namePrefix, createdFrom or createdTo")
+	}
+
+	query := map[string]interface{}{"selector": selector}
+	index := searchIndexes[fields[0]]
+	if len(filter.Sort) > 0 {
+		var ok bool
+		index, ok = searchIndexes[filter.Sort]
+		if !ok {
+			return "", nil, fmt.Errorf("cannot sort on %s, sortable fields are owner, amount, Name and createdAt", filter.Sort)
+		}
+		order := strings.ToLower(filter.Order)
+		if order == "" {
+			order = "asc"
+		} else if order != "asc" && order != "desc" {
+			return "", nil, fmt.Errorf("order must be asc or desc")
+		}
+		// the sort has to match the index, which starts with docType
+		query["sort"] = []map[string]string{{"docType": order}, {filter.Sort: order}}
+		if _, ok := selector[filter.Sort]; !ok {
+			selector[filter.Sort] = map[string]interface{}{"$gt": nil}
+		}
+	} else if len(filter.Order) > 0 {
+		return "", nil, fmt.Errorf("order requires sort")
+	}
+	query["use_index"] = []string{"_design/" + index.DesignDoc, index.Name}
+
+	if filter.Limit == 0 {
+		filter.Limit = config.MaxPageSize
+	}
+	if filter.Limit < 0 || filter.Limit > config.MaxPageSize {
+		return "", nil, fmt.Errorf("limit must be between 1 and %d", config.MaxPageSize)
+	}
+	err = filter.resultOptions.validate(config)
+	if err != nil {
+		return "", nil, err
+	}
+
+	queryJSONasBytes, err := json.Marshal(query)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(queryJSONasBytes), filter, nil
+}
+
+// ============================================================
+// searchCoins - find coins with a filter, see compileSearch
+// ============================================================
+func (t *SimpleChaincode) searchCoins(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "{\"owner\":\"tom\"}"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting filter")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	queryString, filter, err := compileSearch(args[0], config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- searchCoins queryString:\n%s\n", queryString)
+
+	results := newResultWriter("records", &filter.resultOptions)
+	bookmark, err := results.writePages(filter.Limit, 1, func(bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+		return stub.GetQueryResultWithPagination(queryString, filter.Limit, bookmark)
+	}, nil)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pageJSONasBytes, err := results.page(bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- searchCoins returning %d records\n", results.count)
+	return shim.Success(pageJSONasBytes)
+}
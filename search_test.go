@@ -0,0 +1,129 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// compileTestSearch compiles a filter and decodes the query it produces.
+func compileTestSearch(t *testing.T, filterJSON string) (map[string]interface{}, *searchFilter) {
+	t.Helper()
+	queryString, filter, err := compileSearch(filterJSON, defaultConfig())
+	if err != nil {
+		t.Fatalf("filter %s: %s", filterJSON, err)
+	}
+	query := map[string]interface{}{}
+	err = json.Unmarshal([]byte(queryString), &query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query, filter
+}
+
+func TestSearchCompilesScopedQuery(t *testing.T) {
+	query, filter := compileTestSearch(t, `{"owner":"Org1MSP/Tom","denomination":"aDollar","namePrefix":"coin1"}`)
+	selector := query["selector"].(map[string]interface{})
+	if selector["docType"] != coinObjectType || selector["owner"] != "org1msp/tom" || selector["amount"] != "adollar" {
+		t.Errorf("selector is %v", selector)
+	}
+	if name := selector["Name"].(map[string]interface{}); name["$gte"] != "coin1" || name["$lt"] != "coin1\ufff0" {
+		t.Errorf("name prefix selector is %v", name)
+	}
+	if index := query["use_index"]; !reflect.DeepEqual(index, []interface{}{"_design/indexOwnerDoc", "indexOwner"}) {
+		t.Errorf("query uses index %v", index)
+	}
+	if filter.Limit != defaultMaxPageSize {
+		t.Errorf("default page size is %d", filter.Limit)
+	}
+
+	query, _ = compileTestSearch(t, `{"createdFrom":"2024-01-01T01:00:00+01:00","sort":"createdAt","order":"DESC","limit":20}`)
+	selector = query["selector"].(map[string]interface{})
+	if createdAt := selector["createdAt"].(map[string]interface{}); createdAt["$gte"] != "2024-01-01T00:00:00Z" || createdAt["$lte"] != nil {
+		t.Errorf("creation time selector is %v", createdAt)
+	}
+	sort := []interface{}{map[string]interface{}{"docType": "desc"}, map[string]interface{}{"createdAt": "desc"}}
+	if !reflect.DeepEqual(query["sort"], sort) {
+		t.Errorf("sort is %v", query["sort"])
+	}
+
+	// a sort field that is not queried is added to the selector, or CouchDB cannot use the index
+	query, _ = compileTestSearch(t, `{"owner":"org1msp/tom","sort":"Name"}`)
+	if name, ok := query["selector"].(map[string]interface{})["Name"]; !ok || !reflect.DeepEqual(name, map[string]interface{}{"$gt": nil}) {
+		t.Errorf("selector of a sort on Name is %v", query["selector"])
+	}
+}
+
+func TestSearchValuesCannotChangeTheQuery(t *testing.T) {
+	query, _ := compileTestSearch(t, `{"owner":"tom\"},\"docType\":{\"$ne\":\"x"}`)
+	selector := query["selector"].(map[string]interface{})
+	if selector["docType"] != coinObjectType || len(selector) != 2 {
+		t.Errorf("selector is %v", selector)
+	}
+}
+
+func TestSearchRejectsFilters(t *testing.T) {
+	for _, filterJSON := range []string{
+		`{}`,
+		`{"sort":"owner"}`,
+		`{"owner":"tom","selector":{}}`,
+		`{"owner":{"$ne":"tom"}}`,
+		`{"owner":"tom","sort":"value"}`,
+		`{"owner":"tom","order":"asc"}`,
+		`{"owner":"tom","sort":"owner","order":"up"}`,
+		`{"createdFrom":"yesterday"}`,
+		`{"owner":"tom","limit":-1}`,
+		`{"owner":"tom","limit":101}`,
+		`{"owner":"tom","maxBytes":-1}`,
+		`not a filter`,
+	} {
+		if _, _, err := compileSearch(filterJSON, defaultConfig()); err == nil {
+			t.Errorf("filter %s was accepted", filterJSON)
+		}
+	}
+}
+
+func TestSearchIndexesArePackaged(t *testing.T) {
+	for field, index := range searchIndexes {
+		indexJSONasBytes, err := os.ReadFile(filepath.Join("META-INF", "statedb", "couchdb", "indexes", index.Name+".json"))
+		if err != nil {
+			t.Errorf("index of %s: %s", field, err)
+			continue
+		}
+		definition := struct {
+			Index struct {
+				Fields []string `json:"fields"`
+			} `json:"index"`
+			DesignDoc string `json:"ddoc"`
+			Name      string `json:"name"`
+		}{}
+		err = json.Unmarshal(indexJSONasBytes, &definition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if definition.DesignDoc != index.DesignDoc || definition.Name != index.Name || !reflect.DeepEqual(definition.Index.Fields, []string{"docType", field}) {
+			t.Errorf("index of %s is %+v", field, definition)
+		}
+	}
+}
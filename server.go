@@ -0,0 +1,176 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ====CHAINCODE AS A SERVICE ==================
+//
+// Instead of being built and launched by the peer, the chaincode can run as an
+// external service (e.g. a Kubernetes deployment) that the peer connects to.
+// Server mode is selected by setting CHAINCODE_SERVER_ADDRESS.
+//
+//   CHAINCODE_SERVER_ADDRESS  address to listen on, e.g. 0.0.0.0:9999 (required)
+//   CHAINCODE_ID              package ID returned by 'peer lifecycle chaincode install' (required)
+//   CHAINCODE_TLS_KEY         path to the PEM server private key; TLS is enabled when key and cert are set
+//   CHAINCODE_TLS_CERT        path to the PEM server certificate
+//   CHAINCODE_CLIENT_CA_CERT  path to the PEM CA certificate used to verify peers (enables mutual TLS)
+//   CHAINCODE_HEALTH_ADDRESS  address for the HTTP health endpoint, e.g. 0.0.0.0:9998 (optional)
+//
+// The health endpoint answers GET /healthz with 200 while the process is up,
+// which can be used for Kubernetes liveness probes.
+//
+// ==== Packaging ====
+// The ccaas directory holds the assets for the peer's chaincode-as-a-service builder.
+// Set "address" in connection.json to the service address the peer should dial.
+// When TLS is enabled set "tls_required" to true and fill in "root_cert" (and
+// "client_key"/"client_cert" when CHAINCODE_CLIENT_CA_CERT is set).
+//
+//   cd ccaas
+//   tar cfz code.tar.gz connection.json
+//   tar cfz coins-ccaas.tgz metadata.json code.tar.gz
+//   peer lifecycle chaincode install coins-ccaas.tgz
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// serverConfig is the chaincode server configuration read from the environment.
+type serverConfig struct {
+	CCID          string
+	Address       string
+	HealthAddress string
+	TLSProps      shim.TLSProperties
+}
+
+// ===================================================================================
+// startChaincodeServer - run the chaincode as an external service on address
+// ===================================================================================
+func startChaincodeServer(address string) error {
+	config, err := getServerConfig(address)
+	if err != nil {
+		return err
+	}
+
+	server := &shim.ChaincodeServer{
+		CCID:     config.CCID,
+		Address:  config.Address,
+		CC:       new(SimpleChaincode),
+		TLSProps: config.TLSProps,
+	}
+
+	if config.HealthAddress != "" {
+		go serveHealth(config.HealthAddress)
+	}
+
+	fmt.Printf("- starting chaincode server %s on %s (tls: %t)\n", config.CCID, config.Address, !config.TLSProps.Disabled)
+	return server.Start()
+}
+
+// ===================================================================================
+// getServerConfig - read the chaincode server configuration for address from the
+// environment
+// ===================================================================================
+func getServerConfig(address string) (*serverConfig, error) {
+	ccid := os.Getenv("CHAINCODE_ID")
+	if len(ccid) <= 0 {
+		return nil, fmt.Errorf("CHAINCODE_ID must be set when CHAINCODE_SERVER_ADDRESS is set")
+	}
+
+	tlsProps, err := getTLSProperties()
+	if err != nil {
+		return nil, err
+	}
+
+	return &serverConfig{
+		CCID:          ccid,
+		Address:       address,
+		HealthAddress: os.Getenv("CHAINCODE_HEALTH_ADDRESS"),
+		TLSProps:      tlsProps,
+	}, nil
+}
+
+// ===================================================================================
+// getTLSProperties - read the server TLS material named by the environment
+// ===================================================================================
+func getTLSProperties() (shim.TLSProperties, error) {
+	keyPath := os.Getenv("CHAINCODE_TLS_KEY")
+	certPath := os.Getenv("CHAINCODE_TLS_CERT")
+	clientCAPath := os.Getenv("CHAINCODE_CLIENT_CA_CERT")
+
+	if keyPath == "" && certPath == "" {
+		if clientCAPath != "" {
+			return shim.TLSProperties{}, fmt.Errorf("CHAINCODE_CLIENT_CA_CERT requires CHAINCODE_TLS_KEY and CHAINCODE_TLS_CERT")
+		}
+		return shim.TLSProperties{Disabled: true}, nil
+	}
+	if keyPath == "" || certPath == "" {
+		return shim.TLSProperties{}, fmt.Errorf("CHAINCODE_TLS_KEY and CHAINCODE_TLS_CERT must be set together")
+	}
+
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return shim.TLSProperties{}, fmt.Errorf("failed to read TLS key: %s", err)
+	}
+	cert, err := os.ReadFile(certPath)
+	if err != nil {
+		return shim.TLSProperties{}, fmt.Errorf("failed to read TLS certificate: %s", err)
+	}
+
+	tlsProps := shim.TLSProperties{
+		Disabled: false,
+		Key:      key,
+		Cert:     cert,
+	}
+
+	if clientCAPath != "" {
+		clientCACerts, err := os.ReadFile(clientCAPath)
+		if err != nil {
+			return shim.TLSProperties{}, fmt.Errorf("failed to read client CA certificate: %s", err)
+		}
+		tlsProps.ClientCACerts = clientCACerts
+	}
+
+	return tlsProps, nil
+}
+
+// ===================================================================================
+// serveHealth - answer liveness/readiness probes on /healthz
+// ===================================================================================
+func serveHealth(address string) {
+	fmt.Printf("- health endpoint listening on %s\n", address)
+	err := http.ListenAndServe(address, healthHandler())
+	if err != nil {
+		fmt.Printf("Error serving health endpoint: %s\n", err)
+	}
+}
+
+// healthHandler serves /healthz, which answers 200 while the process is up.
+func healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{\"status\":\"OK\"}"))
+	})
+	return mux
+}
@@ -0,0 +1,118 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var serverEnv = []string{"CHAINCODE_ID", "CHAINCODE_TLS_KEY", "CHAINCODE_TLS_CERT", "CHAINCODE_CLIENT_CA_CERT", "CHAINCODE_HEALTH_ADDRESS"}
+
+// setServerEnv sets the server environment to env, unsetting the variables it leaves
+// out.
+func setServerEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, name := range serverEnv {
+		t.Setenv(name, env[name])
+	}
+}
+
+// writeTestPEM writes a stand-in for PEM material and returns its path.
+func writeTestPEM(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(name), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestServerConfigRefused(t *testing.T) {
+	key := writeTestPEM(t, "key.pem")
+	cert := writeTestPEM(t, "cert.pem")
+	ca := writeTestPEM(t, "ca.pem")
+
+	for _, test := range []struct {
+		env   map[string]string
+		error string
+	}{
+		{map[string]string{}, "CHAINCODE_ID"},
+		{map[string]string{"CHAINCODE_TLS_KEY": key, "CHAINCODE_TLS_CERT": cert}, "CHAINCODE_ID"},
+		{map[string]string{"CHAINCODE_ID": "coins:1", "CHAINCODE_TLS_KEY": key}, "must be set together"},
+		{map[string]string{"CHAINCODE_ID": "coins:1", "CHAINCODE_TLS_CERT": cert}, "must be set together"},
+		{map[string]string{"CHAINCODE_ID": "coins:1", "CHAINCODE_CLIENT_CA_CERT": ca}, "requires CHAINCODE_TLS_KEY"},
+		{map[string]string{"CHAINCODE_ID": "coins:1", "CHAINCODE_TLS_KEY": key, "CHAINCODE_TLS_CERT": key + ".missing"}, "failed to read TLS certificate"},
+	} {
+		setServerEnv(t, test.env)
+		_, err := getServerConfig("0.0.0.0:9999")
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("server config for %v returned %v, expected an error about %s", test.env, err, test.error)
+		}
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	setServerEnv(t, map[string]string{"CHAINCODE_ID": "coins:1", "CHAINCODE_HEALTH_ADDRESS": "0.0.0.0:9998"})
+	config, err := getServerConfig("0.0.0.0:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.CCID != "coins:1" || config.Address != "0.0.0.0:9999" || config.HealthAddress != "0.0.0.0:9998" || !config.TLSProps.Disabled {
+		t.Errorf("server config without TLS is %+v", config)
+	}
+
+	setServerEnv(t, map[string]string{
+		"CHAINCODE_ID":             "coins:1",
+		"CHAINCODE_TLS_KEY":        writeTestPEM(t, "key.pem"),
+		"CHAINCODE_TLS_CERT":       writeTestPEM(t, "cert.pem"),
+		"CHAINCODE_CLIENT_CA_CERT": writeTestPEM(t, "ca.pem"),
+	})
+	config, err = getServerConfig("0.0.0.0:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsProps := config.TLSProps
+	if tlsProps.Disabled || string(tlsProps.Key) != "key.pem" || string(tlsProps.Cert) != "cert.pem" || string(tlsProps.ClientCACerts) != "ca.pem" {
+		t.Errorf("TLS properties are %+v", tlsProps)
+	}
+	if config.HealthAddress != "" {
+		t.Errorf("health endpoint at %q without CHAINCODE_HEALTH_ADDRESS", config.HealthAddress)
+	}
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	healthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != `{"status":"OK"}` || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("/healthz answered %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	healthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("/metrics answered %d", recorder.Code)
+	}
+}
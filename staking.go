@@ -0,0 +1,670 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Staking ====
+//
+// With the staking feature enabled, owners can stake coins into a single pool, which
+// mints rewardsPerDay coins of the rewardDenomination per day, shared in proportion
+// to the value of the staked coins in minor units. Only the owner identity can stake a
+// coin, as only the owner can transfer it. A staked coin counts as locked: transfers and
+// deletes fail with COIN_LOCKED. unstake stops the rewards of a coin at once, and keeps
+// it locked for the configured unbondingPeriod. Regulator actions and burn take a
+// staked coin out of the pool.
+//
+// Rewards accrue through a cumulative index, so no transaction iterates over the
+// stakers. The pool keeps the rewards one minor unit of stake has earned since the
+// pool started, and each staker the product of its stake and the index at the time it
+// last changed. What a staker has earned since is its stake times the growth of the
+// index. The index is brought up to date, at the rate in effect since the previous
+// update, by every stake, unstake and claim, which therefore all write the pool record
+// and conflict with each other within a block, like mints of a capped denomination do.
+// updateConfig does the same when it changes the rate or switches staking on or off.
+//
+// claimRewards mints the whole reward coins earned so far to the caller, at most a page
+// of them per call; fractions stay owed.
+//
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["stake","coin1","coin2"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["unstake","coin1"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["claimRewards"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["claimRewards","10"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["poolInfo"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["poolInfo","org1msp/tom"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	stakingPoolObjectType   = "stakingpool"
+	stakeObjectType         = "stake"
+	stakePositionObjectType = "stakeposition"
+
+	secondsPerDay = 24 * 60 * 60
+)
+
+// rewardIndexScale is the fixed point of the reward index and the owed rewards.
+var rewardIndexScale = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+
+type stakingPool struct {
+	ObjectType    string `json:"docType"`
+	RewardIndex   string `json:"rewardIndex"`   //reward coins per staked minor unit since the start, times 10^18
+	TotalWeight   int64  `json:"totalWeight"`   //value of the staked coins in minor units
+	StakedCoins   int64  `json:"stakedCoins"`   //coins earning rewards
+	RewardsPerDay int64  `json:"rewardsPerDay"` //rate of the rewards since updatedAt
+	Claimed       int64  `json:"claimed"`       //reward coins minted
+	UpdatedAt     string `json:"updatedAt"`
+}
+
+// stakeRecord is stored under stake~coin while a coin is staked or unbonding.
+type stakeRecord struct {
+	ObjectType     string `json:"docType"`
+	Coin           string `json:"coin"`
+	Owner          string `json:"owner"`
+	Weight         int64  `json:"weight"` //value of the coin in minor units when it was staked
+	StakedAt       string `json:"stakedAt"`
+	UnbondingUntil string `json:"unbondingUntil,omitempty"` //set by unstake, the coin stays locked until then
+}
+
+// lockedAt reports whether the coin is still staked or unbonding at time now.
+func (s *stakeRecord) lockedAt(now time.Time) bool {
+	if len(s.UnbondingUntil) == 0 {
+		return true
+	}
+	unbondingUntil, err := time.Parse(time.RFC3339, s.UnbondingUntil)
+	return err != nil || now.Before(unbondingUntil)
+}
+
+// stakePosition is stored under stakeposition~owner.
+type stakePosition struct {
+	ObjectType string `json:"docType"`
+	Owner      string `json:"owner"`
+	Weight     int64  `json:"weight"`     //value of the staked coins in minor units
+	Coins      int64  `json:"coins"`      //coins earning rewards
+	RewardDebt string `json:"rewardDebt"` //weight times the reward index when it last changed
+	Owed       string `json:"owed"`       //rewards earned and not claimed, times 10^18
+	Claimed    int64  `json:"claimed"`    //reward coins minted
+}
+
+type stakingInfo struct {
+	Pool     *stakingPool   `json:"pool"`
+	Position *stakePosition `json:"position,omitempty"`
+	Rewards  int64          `json:"rewards"` //whole reward coins the position can claim
+}
+
+// parseScaled decodes a fixed point number of the staking records, empty for zero.
+func parseScaled(value string) (*big.Int, error) {
+	if len(value) == 0 {
+		return new(big.Int), nil
+	}
+	scaled, ok := new(big.Int).SetString(value, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid fixed point number in staking record: %q", value)
+	}
+	return scaled, nil
+}
+
+// ===================================================================================
+// accrue brings the reward index up to time now at the rate in effect since the last
+// update, then switches to rewardsPerDay. Returns the index.
+// ===================================================================================
+func (p *stakingPool) accrue(now time.Time, rewardsPerDay int64) (*big.Int, error) {
+	index, err := parseScaled(p.RewardIndex)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.UpdatedAt) > 0 {
+		updatedAt, err := time.Parse(time.RFC3339, p.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid updatedAt in staking pool: %s", p.UpdatedAt)
+		}
+		elapsed := now.Unix() - updatedAt.Unix()
+		if elapsed < 0 {
+			// transactions are not ordered by timestamp, the earlier one changes nothing
+			elapsed = 0
+			now = updatedAt
+		}
+		if p.TotalWeight > 0 && p.RewardsPerDay > 0 {
+			// rewardsPerDay * elapsed / (secondsPerDay * totalWeight), in fixed point
+			growth := new(big.Int).Mul(big.NewInt(p.RewardsPerDay), big.NewInt(elapsed))
+			growth.Mul(growth, rewardIndexScale)
+			growth.Quo(growth, new(big.Int).Mul(big.NewInt(secondsPerDay), big.NewInt(p.TotalWeight)))
+			index.Add(index, growth)
+		}
+	}
+	p.RewardIndex = index.String()
+	p.RewardsPerDay = rewardsPerDay
+	p.UpdatedAt = now.UTC().Format(time.RFC3339)
+	return index, nil
+}
+
+// settle adds what the position earned up to index to its owed rewards, and starts
+// over from index. Call it before the weight changes.
+func (p *stakePosition) settle(index *big.Int) error {
+	debt, err := parseScaled(p.RewardDebt)
+	if err != nil {
+		return err
+	}
+	owed, err := parseScaled(p.Owed)
+	if err != nil {
+		return err
+	}
+	earned := new(big.Int).Mul(big.NewInt(p.Weight), index)
+	owed.Add(owed, earned.Sub(earned, debt))
+	p.Owed = owed.String()
+	p.rebase(index)
+	return nil
+}
+
+// rebase starts the position over from index, after its weight changed.
+func (p *stakePosition) rebase(index *big.Int) {
+	p.RewardDebt = new(big.Int).Mul(big.NewInt(p.Weight), index).String()
+}
+
+// rewards returns the whole reward coins owed to the position.
+func (p *stakePosition) rewards() (int64, error) {
+	owed, err := parseScaled(p.Owed)
+	if err != nil {
+		return 0, err
+	}
+	coins := new(big.Int).Quo(owed, rewardIndexScale)
+	if !coins.IsInt64() {
+		return 0, fmt.Errorf("rewards of %s overflow", p.Owner)
+	}
+	return coins.Int64(), nil
+}
+
+// stakingRate returns the rate the pool accrues at under config.
+func stakingRate(config *chaincodeConfig) int64 {
+	if !config.featureEnabled(featureStaking) {
+		return 0
+	}
+	return config.RewardsPerDay
+}
+
+// ===================================================================================
+// updateStakingRate brings the reward index up to date at the old rate and switches
+// the pool to rewardsPerDay. Called by updateConfig when the rate or the staking
+// feature changes, so that neither applies to the time before.
+// ===================================================================================
+func updateStakingRate(stub shim.ChaincodeStubInterface, rewardsPerDay int64) error {
+	pool, err := getStakingPool(stub)
+	if err != nil {
+		return err
+	}
+	if len(pool.UpdatedAt) == 0 {
+		return nil //nothing was staked yet
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	_, err = pool.accrue(now, rewardsPerDay)
+	if err != nil {
+		return err
+	}
+	return putStakingRecord(stub, stakingPoolObjectType, "pool", pool)
+}
+
+// ===================================================================================
+// getStakingRecord decodes the record under objectType~key into record, and reports
+// whether there was one
+// ===================================================================================
+func getStakingRecord(stub shim.ChaincodeStubInterface, objectType string, key string, record interface{}) (bool, error) {
+	recordKey, err := stub.CreateCompositeKey(objectType, []string{key})
+	if err != nil {
+		return false, err
+	}
+	recordAsBytes, err := stub.GetState(recordKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to get %s %s: %s", objectType, key, err)
+	}
+	if recordAsBytes == nil {
+		return false, nil
+	}
+	err = json.Unmarshal(recordAsBytes, record)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode %s %s: %s", objectType, key, err)
+	}
+	return true, nil
+}
+
+func putStakingRecord(stub shim.ChaincodeStubInterface, objectType string, key string, record interface{}) error {
+	recordKey, err := stub.CreateCompositeKey(objectType, []string{key})
+	if err != nil {
+		return err
+	}
+	recordJSONasBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(recordKey, recordJSONasBytes)
+}
+
+func getStakingPool(stub shim.ChaincodeStubInterface) (*stakingPool, error) {
+	pool := &stakingPool{ObjectType: stakingPoolObjectType}
+	_, err := getStakingRecord(stub, stakingPoolObjectType, "pool", pool)
+	if err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func getStakePosition(stub shim.ChaincodeStubInterface, owner string) (*stakePosition, error) {
+	position := &stakePosition{ObjectType: stakePositionObjectType, Owner: owner}
+	_, err := getStakingRecord(stub, stakePositionObjectType, owner, position)
+	if err != nil {
+		return nil, err
+	}
+	return position, nil
+}
+
+// getStake returns the stake record of a coin, nil if it was never staked.
+func getStake(stub shim.ChaincodeStubInterface, coinName string) (*stakeRecord, error) {
+	staked := &stakeRecord{}
+	found, err := getStakingRecord(stub, stakeObjectType, coinName, staked)
+	if err != nil || !found {
+		return nil, err
+	}
+	return staked, nil
+}
+
+// ===================================================================================
+// checkStake fails with errCoinLocked if the coin is staked or unbonding at time now.
+// Called by checkLocks.
+// ===================================================================================
+func checkStake(stub shim.ChaincodeStubInterface, c *coin, now time.Time) error {
+	staked, err := getStake(stub, c.Name)
+	if err != nil || staked == nil || !staked.lockedAt(now) {
+		return err
+	}
+	if len(staked.UnbondingUntil) > 0 {
+		return fmt.Errorf("%w: %s is unbonding until %s", errCoinLocked, c.Name, staked.UnbondingUntil)
+	}
+	return fmt.Errorf("%w: %s is staked", errCoinLocked, c.Name)
+}
+
+// ===================================================================================
+// releaseStake takes a coin that leaves its owner out of the pool and removes its stake
+// record. Transfers and deletes of staked coins fail in checkLocks, so this only takes
+// a coin out of the pool for regulator actions and burn, which move one coin each.
+// ===================================================================================
+func releaseStake(stub shim.ChaincodeStubInterface, c *coin) error {
+	staked, err := getStake(stub, c.Name)
+	if err != nil || staked == nil {
+		return err
+	}
+	if len(staked.UnbondingUntil) == 0 {
+		now, err := getTxTime(stub)
+		if err != nil {
+			return err
+		}
+		config, err := getConfig(stub)
+		if err != nil {
+			return err
+		}
+		pool, err := getStakingPool(stub)
+		if err != nil {
+			return err
+		}
+		index, err := pool.accrue(now, stakingRate(config))
+		if err != nil {
+			return err
+		}
+		position, err := getStakePosition(stub, staked.Owner)
+		if err != nil {
+			return err
+		}
+		err = position.settle(index)
+		if err != nil {
+			return err
+		}
+		pool.TotalWeight -= staked.Weight
+		pool.StakedCoins--
+		position.Weight -= staked.Weight
+		position.Coins--
+		position.rebase(index)
+
+		err = putStakingRecord(stub, stakingPoolObjectType, "pool", pool)
+		if err != nil {
+			return err
+		}
+		err = putStakingRecord(stub, stakePositionObjectType, staked.Owner, position)
+		if err != nil {
+			return err
+		}
+	}
+	stakeKey, err := stub.CreateCompositeKey(stakeObjectType, []string{c.Name})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(stakeKey)
+}
+
+// ===================================================================================
+// loadStaking returns the caller, the transaction time, and the pool and position of
+// the caller with the reward index brought up to date
+// ===================================================================================
+func loadStaking(stub shim.ChaincodeStubInterface, config *chaincodeConfig) (string, time.Time, *stakingPool, *stakePosition, *big.Int, error) {
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return "", time.Time{}, nil, nil, nil, err
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return "", time.Time{}, nil, nil, nil, err
+	}
+	pool, err := getStakingPool(stub)
+	if err != nil {
+		return "", time.Time{}, nil, nil, nil, err
+	}
+	index, err := pool.accrue(now, stakingRate(config))
+	if err != nil {
+		return "", time.Time{}, nil, nil, nil, err
+	}
+	position, err := getStakePosition(stub, caller)
+	if err != nil {
+		return "", time.Time{}, nil, nil, nil, err
+	}
+	err = position.settle(index)
+	if err != nil {
+		return "", time.Time{}, nil, nil, nil, err
+	}
+	return caller, now, pool, position, index, nil
+}
+
+// ===================================================================================
+// putStaking stores the pool and a position and returns them as the response
+// ===================================================================================
+func putStaking(stub shim.ChaincodeStubInterface, pool *stakingPool, position *stakePosition) pb.Response {
+	err := putStakingRecord(stub, stakingPoolObjectType, "pool", pool)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putStakingRecord(stub, stakePositionObjectType, position.Owner, position)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rewards, err := position.rewards()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	infoJSONasBytes, err := json.Marshal(&stakingInfo{Pool: pool, Position: position, Rewards: rewards})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(infoJSONasBytes)
+}
+
+// ============================================================
+// stake - put coins of the caller into the staking pool
+// ============================================================
+func (t *SimpleChaincode) stake(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "coin1", "coin2", ...
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) < 1 || len(args) > int(config.MaxPageSize) {
+		return shim.Error(fmt.Sprintf("Incorrect number of arguments. Expecting 1 to %d coin names", config.MaxPageSize))
+	}
+	if !config.featureEnabled(featureStaking) {
+		return shim.Error("Staking is not enabled")
+	}
+
+	caller, now, pool, position, index, err := loadStaking(stub, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- start stake ", caller, args)
+
+	seen := map[string]bool{}
+	for _, coinName := range args {
+		if seen[coinName] {
+			return shim.Error("Coin is listed twice: " + coinName)
+		}
+		seen[coinName] = true
+
+		c, err := getCoin(stub, coinName)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if c.Owner != caller {
+			return shim.Error("Only the owner can stake " + coinName)
+		}
+		err = checkStake(stub, c, now)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = checkNoPendingOffer(stub, coinName)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		denom, err := getDenomination(stub, c.Amount)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if denom == nil || denom.Value <= 0 {
+			return shim.Error(coinName + " has no value and cannot be staked")
+		}
+
+		err = addValue(&pool.TotalWeight, denom.Value)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		pool.StakedCoins++
+		position.Weight += denom.Value
+		position.Coins++
+
+		staked := &stakeRecord{ObjectType: stakeObjectType, Coin: coinName, Owner: caller, Weight: denom.Value, StakedAt: now.UTC().Format(time.RFC3339)}
+		err = putStakingRecord(stub, stakeObjectType, coinName, staked)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	position.rebase(index)
+
+	fmt.Println("- end stake (success)")
+	return putStaking(stub, pool, position)
+}
+
+// ============================================================
+// unstake - take coins of the caller out of the staking pool,
+// they stay locked for the unbonding period
+// ============================================================
+func (t *SimpleChaincode) unstake(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "coin1", "coin2", ...
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) < 1 || len(args) > int(config.MaxPageSize) {
+		return shim.Error(fmt.Sprintf("Incorrect number of arguments. Expecting 1 to %d coin names", config.MaxPageSize))
+	}
+
+	caller, now, pool, position, index, err := loadStaking(stub, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- start unstake ", caller, args)
+
+	unbondingUntil := now.Add(config.unbondingPeriod()).UTC().Format(time.RFC3339)
+	seen := map[string]bool{}
+	for _, coinName := range args {
+		if seen[coinName] {
+			return shim.Error("Coin is listed twice: " + coinName)
+		}
+		seen[coinName] = true
+
+		staked, err := getStake(stub, coinName)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if staked == nil || len(staked.UnbondingUntil) > 0 {
+			return shim.Error("Coin is not staked: " + coinName)
+		}
+		if staked.Owner != caller {
+			return shim.Error("Only the owner can unstake " + coinName)
+		}
+
+		pool.TotalWeight -= staked.Weight
+		pool.StakedCoins--
+		position.Weight -= staked.Weight
+		position.Coins--
+
+		staked.UnbondingUntil = unbondingUntil
+		err = putStakingRecord(stub, stakeObjectType, coinName, staked)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	position.rebase(index)
+
+	fmt.Println("- end unstake (success), unbonding until " + unbondingUntil)
+	return putStaking(stub, pool, position)
+}
+
+// ============================================================
+// claimRewards - mint the whole reward coins the caller has earned,
+// at most the given number or a page of them
+// ============================================================
+func (t *SimpleChaincode) claimRewards(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "10"
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting optional maximum number of coins")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	maxCoins := config.MaxPageSize
+	if len(args) == 1 {
+		maxCoins, err = config.pageSize(args[0])
+		if err != nil {
+			return shim.Error(strings.Replace(err.Error(), "Page size", "Maximum number of coins", 1))
+		}
+	}
+	if len(config.RewardDenomination) <= 0 {
+		return shim.Error("No reward denomination is configured")
+	}
+
+	caller, _, pool, position, _, err := loadStaking(stub, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rewards, err := position.rewards()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if rewards > int64(maxCoins) {
+		rewards = int64(maxCoins)
+	}
+	fmt.Printf("- start claimRewards %s (%d coins)\n", caller, rewards)
+
+	if rewards > 0 {
+		coinNames := make([]string, rewards)
+		for i := range coinNames {
+			coinNames[i] = fmt.Sprintf("reward-%s-%d", stub.GetTxID(), i)
+		}
+		_, err = createCoins(stub, coinNames, config.RewardDenomination, caller)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		owed, err := parseScaled(position.Owed)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		owed.Sub(owed, new(big.Int).Mul(big.NewInt(rewards), rewardIndexScale))
+		position.Owed = owed.String()
+		position.Claimed += rewards
+		pool.Claimed += rewards
+	}
+
+	fmt.Println("- end claimRewards (success)")
+	return putStaking(stub, pool, position)
+}
+
+// ============================================================
+// poolInfo - the staking pool, and optionally the position of
+// an owner, with the rewards accrued up to now
+// ============================================================
+func (t *SimpleChaincode) poolInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//        0
+	// "org1msp/tom"
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting optional owner")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pool, err := getStakingPool(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	index, err := pool.accrue(now, stakingRate(config))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	info := &stakingInfo{Pool: pool}
+	if len(args) == 1 {
+		owner := normalizeIdentity(args[0])
+		if len(owner) <= 0 {
+			return shim.Error("1st argument must be a non-empty string")
+		}
+		info.Position, err = getStakePosition(stub, owner)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = info.Position.settle(index)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		info.Rewards, err = info.Position.rewards()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	infoJSONasBytes, err := json.Marshal(info)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(infoJSONasBytes)
+}
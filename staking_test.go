@@ -0,0 +1,185 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const stakingTestConfig = `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"],"regulator":["org1msp/admin"]},"recoveryAccount":"org1msp/recovery",` +
+	`"rewardDenomination":"acent","rewardsPerDay":10,"unbondingPeriod":"48h","features":{"staking":true}}`
+
+const day = 24 * time.Hour
+
+// newStakingLedger returns a ledger where tom holds coin1 and coin2 and jerry coin3
+// and coin4, all worth a dollar.
+func newStakingLedger(t *testing.T) (*fakeLedger, *SimpleChaincode) {
+	t.Helper()
+	ledger, cc := newFakeChaincode(t, stakingTestConfig)
+	for _, holding := range [][]string{{"coin1", "org1msp/tom"}, {"coin2", "org1msp/tom"}, {"coin3", "org2msp/jerry"}, {"coin4", "org2msp/jerry"}} {
+		ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", holding[0], "adollar", holding[1])
+	}
+	return ledger, cc
+}
+
+func readTestStaking(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, owner string) *stakingInfo {
+	t.Helper()
+	info := &stakingInfo{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, owner, "poolInfo", owner), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestStakingRewardsAccrue(t *testing.T) {
+	ledger, cc := newStakingLedger(t)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "stake", "coin1")
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "stake", "coin3", "coin4")
+
+	// 40 reward coins in 4 days, a third for tom and two thirds for jerry
+	ledger.clock = ledger.clock.Add(4 * day)
+	tom := readTestStaking(t, ledger, cc, "org1msp/tom")
+	if tom.Rewards != 13 || tom.Pool.TotalWeight != 300 || tom.Pool.StakedCoins != 3 {
+		t.Errorf("tom can claim %d of a pool of %+v", tom.Rewards, tom.Pool)
+	}
+	if jerry := readTestStaking(t, ledger, cc, "org2msp/jerry"); jerry.Rewards != 26 {
+		t.Errorf("jerry can claim %d", jerry.Rewards)
+	}
+
+	ledger.mustInvoke(t, cc, "org1msp/tom", "claimRewards", "5")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "claimRewards")
+	tom = readTestStaking(t, ledger, cc, "org1msp/tom")
+	if tom.Rewards != 0 || tom.Position.Claimed != 13 || tom.Pool.Claimed != 13 {
+		t.Errorf("after claiming tom has %d left of %+v", tom.Rewards, tom.Position)
+	}
+	if balance := readTestBalance(t, ledger, cc, "org1msp/tom"); balance.Coins["acent"] != 13 {
+		t.Errorf("tom holds %d reward coins", balance.Coins["acent"])
+	}
+	checkLedgerConsistency(t, ledger)
+}
+
+func TestStakingRateChanges(t *testing.T) {
+	ledger, cc := newStakingLedger(t)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "stake", "coin1")
+
+	ledger.clock = ledger.clock.Add(day)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "updateConfig", `{"rewardsPerDay":0}`)
+	ledger.clock = ledger.clock.Add(5 * day)
+	if tom := readTestStaking(t, ledger, cc, "org1msp/tom"); tom.Rewards != 10 {
+		t.Errorf("tom can claim %d after the rate was cut to 0 for 5 days", tom.Rewards)
+	}
+
+	ledger.mustInvoke(t, cc, "org1msp/admin", "updateConfig", `{"rewardsPerDay":20}`)
+	ledger.clock = ledger.clock.Add(day)
+	if tom := readTestStaking(t, ledger, cc, "org1msp/tom"); tom.Rewards != 30 {
+		t.Errorf("tom can claim %d a day after the rate was raised to 20", tom.Rewards)
+	}
+
+	ledger.mustInvoke(t, cc, "org1msp/admin", "updateConfig", `{"features":{"staking":false}}`)
+	ledger.clock = ledger.clock.Add(5 * day)
+	if tom := readTestStaking(t, ledger, cc, "org1msp/tom"); tom.Rewards != 30 {
+		t.Errorf("tom can claim %d after staking was disabled for 5 days", tom.Rewards)
+	}
+	if ledger.invoke(cc, "org1msp/tom", "stake", "coin2").Status == shim.OK {
+		t.Errorf("coin2 was staked while staking is disabled")
+	}
+}
+
+func TestStakedCoinsAreLocked(t *testing.T) {
+	ledger, cc := newStakingLedger(t)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "stake", "coin1")
+
+	for _, call := range [][]string{{"org1msp/tom", "transferCoin", "coin1", "org2msp/jerry"}, {"org1msp/admin", "delete", "coin1"}} {
+		response := ledger.invoke(cc, call[0], call[1], call[2:]...)
+		if !strings.Contains(response.Message, "COIN_LOCKED") {
+			t.Errorf("%s of a staked coin returned %d %s", call[1], response.Status, response.Message)
+		}
+	}
+	if ledger.invoke(cc, "org1msp/tom", "stake", "coin1").Status == shim.OK {
+		t.Errorf("coin1 was staked twice")
+	}
+	if ledger.invoke(cc, "org2msp/jerry", "unstake", "coin1").Status == shim.OK {
+		t.Errorf("jerry unstaked the coin of tom")
+	}
+
+	ledger.clock = ledger.clock.Add(day)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "unstake", "coin1")
+	response := ledger.invoke(cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	if !strings.Contains(response.Message, "COIN_LOCKED") {
+		t.Errorf("transfer of an unbonding coin returned %d %s", response.Status, response.Message)
+	}
+
+	// no rewards while unbonding, the coin moves after the unbonding period
+	ledger.clock = ledger.clock.Add(2 * day)
+	tom := readTestStaking(t, ledger, cc, "org1msp/tom")
+	if tom.Rewards != 10 || tom.Pool.TotalWeight != 0 || tom.Position.Coins != 0 {
+		t.Errorf("after unstaking tom can claim %d of %+v", tom.Rewards, tom.Position)
+	}
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	ledger.mustInvoke(t, cc, "org2msp/jerry", "stake", "coin1")
+}
+
+func TestStakedCoinsLeaveThePoolOnBurnAndClawback(t *testing.T) {
+	ledger, cc := newStakingLedger(t)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "stake", "coin1", "coin2")
+
+	ledger.clock = ledger.clock.Add(day)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "clawback", "coin1", "COURT_ORDER", testDocumentHash)
+	tom := readTestStaking(t, ledger, cc, "org1msp/tom")
+	if tom.Pool.TotalWeight != 100 || tom.Pool.StakedCoins != 1 || tom.Position.Coins != 1 {
+		t.Errorf("after the clawback the pool is %+v and tom's position %+v", tom.Pool, tom.Position)
+	}
+	ledger.mustInvoke(t, cc, "org1msp/recovery", "transferCoin", "coin1", "org2msp/jerry")
+
+	ledger.clock = ledger.clock.Add(day)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "burn", "coin2")
+	tom = readTestStaking(t, ledger, cc, "org1msp/tom")
+	if tom.Pool.TotalWeight != 0 || tom.Pool.StakedCoins != 0 || tom.Position.Weight != 0 {
+		t.Errorf("after the burn the pool is %+v and tom's position %+v", tom.Pool, tom.Position)
+	}
+	// what the coins earned before they left stays owed
+	ledger.clock = ledger.clock.Add(day)
+	if tom = readTestStaking(t, ledger, cc, "org1msp/tom"); tom.Rewards != 20 {
+		t.Errorf("tom can claim %d", tom.Rewards)
+	}
+	checkLedgerConsistency(t, ledger)
+}
+
+func TestVestingStatusCountsStakedCoins(t *testing.T) {
+	ledger, cc := newStakingLedger(t)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "stake", "coin1")
+
+	status := struct {
+		Balances []*vestingBalance `json:"balances"`
+	}{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "vestingStatus", "org1msp/tom"), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Balances) != 1 || status.Balances[0].Staked != 1 || status.Balances[0].Releasable != 1 {
+		t.Errorf("vesting status of tom with one of two coins staked is %+v", status.Balances)
+	}
+}
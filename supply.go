@@ -0,0 +1,429 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Mint, burn and supply accounting ====
+//
+// Every coin that is created or destroyed, through initCoin/delete or through
+// mint/burn, is counted in the supply of its denomination. Caps on the
+// circulating supply are set in the configuration (supplyCaps). All four leave an
+// audit record. mint and burn are limited to identities holding the minter role;
+// initCoin and delete only once restrictIssuance is switched on.
+//
+// Like account balances (balance.go), the supply is not kept under one key per
+// denomination, which every issuing transaction in a block would read and rewrite.
+// Each of them writes a delta under supply~denomination~txid~coin and getSupply sums
+// them. Only growing a capped denomination reads the deltas, so mints of a capped
+// denomination still conflict with each other. compactSupply folds the deltas of a
+// denomination into one record. A supply record of the earlier single key layout,
+// supply~denomination, is read as such a folded record.
+//
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["mint","coin20","aDollar","org1msp/tom"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["mint","coin21","aDollar","org1msp/tom","2026-01-01T00:00:00Z"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["burn","coin20"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["readSupply","adollar"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["compactSupply","adollar"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["supplyReport"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const supplyObjectType = "supply"
+
+type supply struct {
+	ObjectType   string `json:"docType"`
+	Denomination string `json:"denomination"`
+	Circulating  int64  `json:"circulating"` //coins currently in existence
+	Created      int64  `json:"created"`     //coins ever created
+	Destroyed    int64  `json:"destroyed"`   //coins ever destroyed
+	Deltas       int    `json:"deltas"`      //supply records read, compactSupply folds them into one
+}
+
+// supplyDelta is stored under supply~denomination~txid~coin.
+type supplyDelta struct {
+	Created   int64 `json:"created"`
+	Destroyed int64 `json:"destroyed"`
+}
+
+// ===================================================================================
+// getSupply sums the supply records of a denomination, zero if there are none yet
+// ===================================================================================
+func getSupply(stub shim.ChaincodeStubInterface, amount string) (*supply, []string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(supplyObjectType, []string{amount})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get supply of %s: %s", amount, err)
+	}
+	defer resultsIterator.Close()
+
+	record := &supply{ObjectType: supplyObjectType, Denomination: amount}
+	keys := []string{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		delta := &supplyDelta{}
+		err = json.Unmarshal(responseRange.Value, delta)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode supply record %q: %s", responseRange.Key, err)
+		}
+		record.Created += delta.Created
+		record.Destroyed += delta.Destroyed
+		keys = append(keys, responseRange.Key)
+	}
+	record.Circulating = record.Created - record.Destroyed
+	record.Deltas = len(keys)
+	return record, keys, nil
+}
+
+// ===================================================================================
+// adjustSupply records that count coins like c were created (or with a negative count,
+// destroyed) in this transaction, enforcing the configured cap when the supply grows
+// ===================================================================================
+func adjustSupply(stub shim.ChaincodeStubInterface, config *chaincodeConfig, c *coin, count int64) error {
+	delta := &supplyDelta{}
+	if count > 0 {
+		delta.Created = count
+		if supplyCap, ok := config.SupplyCaps[c.Amount]; ok && supplyCap > 0 {
+			record, _, err := getSupply(stub, c.Amount)
+			if err != nil {
+				return err
+			}
+			if record.Circulating+count > supplyCap {
+				return fmt.Errorf("supply cap of %d %s coins reached", supplyCap, c.Amount)
+			}
+		}
+	} else {
+		delta.Destroyed = -count
+	}
+
+	deltaKey, err := stub.CreateCompositeKey(supplyObjectType, []string{c.Amount, stub.GetTxID(), c.Name})
+	if err != nil {
+		return err
+	}
+	deltaJSONasBytes, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(deltaKey, deltaJSONasBytes)
+}
+
+// ============================================================
+// mint - minters only, create a new coin and audit it
+// ============================================================
+func (t *SimpleChaincode) mint(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1          2             3
+	// "coin20",  "aDollar",  "bob",  "2026-01-01T00:00:00Z"
+	if len(args) < 3 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting name, denomination, owner and optional unlock time")
+	}
+	if len(args[0]) <= 0 || len(args[1]) <= 0 || len(args[2]) <= 0 {
+		return shim.Error("Arguments must be non-empty strings")
+	}
+
+	minter, err := requireRole(stub, roleMinter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	coinName := args[0]
+	amount := strings.ToLower(args[1])
+	owner := normalizeIdentity(args[2])
+	fmt.Println("- start mint ", coinName, amount, owner)
+
+	// createCoin checks the new owner, the minter is checked as the sending side
+	err = checkCompliance(stub, minter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	minted, err := createCoin(stub, coinName, amount, owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) == 4 && len(args[3]) > 0 {
+		err = setCoinLock(stub, minted, args[3])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = writeAudit(stub, "mint", coinName, minter, map[string]string{"amount": amount, "owner": owner, "lockedUntil": minted.LockedUntil})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end mint (success)")
+	return shim.Success(nil)
+}
+
+// ============================================================
+// burn - minters only, destroy a coin and audit it
+// ============================================================
+func (t *SimpleChaincode) burn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "coin20"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	minter, err := requireRole(stub, roleMinter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	coinName := args[0]
+	fmt.Println("- start burn ", coinName)
+
+	// destroyCoin checks the owner, the minter is checked as the receiving side
+	err = checkCompliance(stub, minter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	burned, err := destroyCoin(stub, coinName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = writeAudit(stub, "burn", coinName, minter, map[string]string{"amount": burned.Amount, "owner": burned.Owner})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end burn (success)")
+	return shim.Success(nil)
+}
+
+// ============================================================
+// readSupply - read the supply counters of a denomination
+// ============================================================
+func (t *SimpleChaincode) readSupply(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting denomination")
+	}
+
+	record, _, err := getSupply(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	supplyJSONasBytes, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(supplyJSONasBytes)
+}
+
+// ============================================================
+// compactSupply - admin only, fold the supply records of a denomination into one
+// ============================================================
+func (t *SimpleChaincode) compactSupply(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "adollar"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting denomination")
+	}
+	amount := strings.ToLower(args[0])
+	if len(amount) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	admin, err := requireAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- start compactSupply " + amount)
+
+	record, keys, err := getSupply(stub, amount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if len(keys) > 0 {
+		compactedKey, err := stub.CreateCompositeKey(supplyObjectType, []string{amount, stub.GetTxID(), compactedRef})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		compactedJSONasBytes, err := json.Marshal(&supplyDelta{Created: record.Created, Destroyed: record.Destroyed})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(compactedKey, compactedJSONasBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		record.Deltas = 1
+	}
+
+	err = writeAudit(stub, "compactSupply", amount, admin, map[string]string{"deltas": strconv.Itoa(len(keys))})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	supplyJSONasBytes, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- end compactSupply %s (folded %d records)\n", amount, len(keys))
+	return shim.Success(supplyJSONasBytes)
+}
+
+// sumSupplyRecords adds the supply records of resultsIterator to circulating.
+func sumSupplyRecords(stub shim.ChaincodeStubInterface, resultsIterator shim.StateQueryIteratorInterface, circulating map[string]int64) error {
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, attributes, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(attributes) == 0 {
+			return fmt.Errorf("malformed supply record key: %q", queryResponse.Key)
+		}
+		delta := supplyDelta{}
+		err = json.Unmarshal(queryResponse.Value, &delta)
+		if err != nil {
+			return fmt.Errorf("failed to decode supply record %q: %s", queryResponse.Key, err)
+		}
+		circulating[attributes[0]] += delta.Created - delta.Destroyed
+	}
+	return nil
+}
+
+// countCoinRecords adds the coins of resultsIterator to counted, by amount.
+func countCoinRecords(resultsIterator shim.StateQueryIteratorInterface, counted map[string]int64) error {
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		c, err := decodeCoin(queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return err
+		}
+		counted[c.Amount]++
+	}
+	return nil
+}
+
+type supplyReconciliation struct {
+	Denomination string `json:"denomination"`
+	Circulating  int64  `json:"circulating"` //according to the supply records
+	Counted      int64  `json:"counted"`     //according to the coins
+	Difference   int64  `json:"difference"`
+	Cap          int64  `json:"cap,omitempty"`
+}
+
+// ===========================================================================================
+// supplyReport reconciles the supply records against the coins. It counts the coins
+// themselves, the simple keys of the world state, rather than an index of them, so that a
+// missing or stale index entry does not hide a difference. The coins and the supply records
+// grow with the ledger, so it reads them a page at a time, which keeps every query under
+// the totalQueryLimit of the peer and only works in a query.
+// ===========================================================================================
+func (t *SimpleChaincode) supplyReport(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	counted := map[string]int64{}
+	bookmark := ""
+	for {
+		coinsIterator, metadata, err := stub.GetStateByRangeWithPagination("", "", config.MaxPageSize, bookmark)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = countCoinRecords(coinsIterator, counted)
+		coinsIterator.Close()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if metadata.FetchedRecordsCount < config.MaxPageSize || len(metadata.Bookmark) <= 0 {
+			break
+		}
+		bookmark = metadata.Bookmark
+	}
+
+	circulating := map[string]int64{}
+	bookmark = ""
+	for {
+		supplyIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(supplyObjectType, []string{}, config.MaxPageSize, bookmark)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = sumSupplyRecords(stub, supplyIterator, circulating)
+		supplyIterator.Close()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if metadata.FetchedRecordsCount < config.MaxPageSize || len(metadata.Bookmark) <= 0 {
+			break
+		}
+		bookmark = metadata.Bookmark
+	}
+
+	denominations := []string{}
+	for amount := range counted {
+		denominations = append(denominations, amount)
+	}
+	for amount := range circulating {
+		if _, ok := counted[amount]; !ok {
+			denominations = append(denominations, amount)
+		}
+	}
+	sort.Strings(denominations)
+
+	report := []supplyReconciliation{}
+	for _, amount := range denominations {
+		report = append(report, supplyReconciliation{
+			Denomination: amount,
+			Circulating:  circulating[amount],
+			Counted:      counted[amount],
+			Difference:   circulating[amount] - counted[amount],
+			Cap:          config.SupplyCaps[amount],
+		})
+	}
+
+	reportJSONasBytes, err := json.Marshal(report)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(reportJSONasBytes)
+}
@@ -0,0 +1,163 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const supplyTestConfig = `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"]}}`
+
+func readTestSupply(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, amount string) *supply {
+	t.Helper()
+	record := &supply{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "readSupply", amount), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestIssuanceWithDefaultConfig(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, `{}`)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "initLedger")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "initCoin", "coin11", "adollar", "org1msp/tom")
+	if record := readTestSupply(t, ledger, cc, "adollar"); record.Circulating != 6 {
+		t.Errorf("supply after initLedger and initCoin is %+v", record)
+	}
+	ledger.mustInvoke(t, cc, "org1msp/tom", "delete", "coin11")
+	checkLedgerConsistency(t, ledger)
+}
+
+func TestIssuanceRestricted(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"]},"features":{"restrictIssuance":true}}`)
+
+	if ledger.invoke(cc, "org1msp/tom", "initLedger").Status == shim.OK {
+		t.Errorf("initLedger succeeded for an identity without the minter role")
+	}
+
+	if ledger.invoke(cc, "org1msp/tom", "initCoin", "coin1", "adollar", "org1msp/tom").Status == shim.OK {
+		t.Errorf("initCoin succeeded for an identity without the minter role")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	if ledger.invoke(cc, "org1msp/tom", "delete", "coin1").Status == shim.OK {
+		t.Errorf("delete succeeded for an identity without the minter role")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "delete", "coin1")
+
+	for _, action := range []string{"initCoin", "delete"} {
+		records := []auditRecord{}
+		err := json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/admin", "getAuditTrail", action), &records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0].Subject != "coin1" || records[0].Actor != "org1msp/admin" {
+			t.Errorf("audit trail of %s is %+v", action, records)
+		}
+	}
+	if record := readTestSupply(t, ledger, cc, "adollar"); record.Created != 1 || record.Destroyed != 1 || record.Circulating != 0 {
+		t.Errorf("supply after creating and deleting a coin is %+v", record)
+	}
+}
+
+func TestConcurrentIssuance(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, supplyTestConfig)
+
+	issues := make([]*fakeStub, 10)
+	for i := range issues {
+		issues[i] = ledger.newStub("org1msp/admin", "mint", "coin"+strconv.Itoa(i), "adollar", "org1msp/tom")
+		if response := cc.Invoke(issues[i]); response.Status != shim.OK {
+			t.Fatal(response.Message)
+		}
+	}
+	for i, ok := range ledger.commit(issues...) {
+		if !ok {
+			t.Errorf("mint %d was invalidated", i)
+		}
+	}
+	if record := readTestSupply(t, ledger, cc, "adollar"); record.Circulating != 10 || record.Deltas != 10 {
+		t.Errorf("supply after 10 mints in one block is %+v", record)
+	}
+
+	ledger.mustInvoke(t, cc, "org1msp/admin", "burn", "coin0")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "compactSupply", "adollar")
+	if record := readTestSupply(t, ledger, cc, "adollar"); record.Circulating != 9 || record.Created != 10 || record.Deltas != 1 {
+		t.Errorf("supply after compaction is %+v", record)
+	}
+	checkLedgerConsistency(t, ledger)
+}
+
+func TestSupplyCapSerializesIssuance(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"]},"supplyCaps":{"adollar":2}}`)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "mint", "coin1", "adollar", "org1msp/tom")
+
+	first := ledger.newStub("org1msp/admin", "mint", "coin2", "adollar", "org1msp/tom")
+	second := ledger.newStub("org1msp/admin", "mint", "coin3", "adollar", "org1msp/tom")
+	for _, stub := range []*fakeStub{first, second} {
+		if response := cc.Invoke(stub); response.Status != shim.OK {
+			t.Fatal(response.Message)
+		}
+	}
+	if valid := ledger.commit(first, second); !valid[0] || valid[1] {
+		t.Errorf("validity of two mints up to the cap in one block is %v", valid)
+	}
+	if ledger.invoke(cc, "org1msp/admin", "mint", "coin3", "adollar", "org1msp/tom").Status == shim.OK {
+		t.Errorf("mint above the cap succeeded")
+	}
+}
+
+func TestSupplyReport(t *testing.T) {
+	// two records a page, so the report reads several pages
+	ledger, cc := newFakeChaincode(t, `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"]},"maxPageSize":2}`)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin2", "acent", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin3", "acent", "org1msp/tom")
+
+	// a coin written without going through createCoins is not in the supply, and an
+	// index entry without a coin is not counted
+	stub := ledger.newStub("org1msp/admin", "seed")
+	rogue := &coin{ObjectType: coinObjectType, Name: "coin4", Amount: "acent", Owner: "org1msp/tom"}
+	rogueJSONasBytes, err := json.Marshal(rogue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stub.PutState(rogue.Name, rogueJSONasBytes); err != nil {
+		t.Fatal(err)
+	}
+	stale := &coin{ObjectType: coinObjectType, Name: "coin5", Amount: "adollar", Owner: "org1msp/tom"}
+	if err := putIndexEntries(stub, stale, amountNameIndex); err != nil {
+		t.Fatal(err)
+	}
+	ledger.commit(stub)
+
+	report := []supplyReconciliation{}
+	err = json.Unmarshal(ledger.mustInvoke(t, cc, "org1msp/tom", "supplyReport"), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 2 || report[0].Denomination != "acent" || report[0].Counted != 3 || report[0].Difference != -1 ||
+		report[1].Denomination != "adollar" || report[1].Counted != 1 || report[1].Difference != 0 {
+		t.Errorf("supply report is %+v", report)
+	}
+}
@@ -0,0 +1,467 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Time locks and vesting ====
+//
+// Two kinds of restriction keep coins with their owner, both checked against the
+// transaction timestamp whenever a coin is transferred or deleted:
+//
+//   - A coin can be locked until a given time, by passing an unlock time to mint or
+//     with lockCoin. A lock can be extended but not shortened.
+//   - A vesting grant covers a number of coins of one denomination held by an owner,
+//     without naming the coins. Nothing vests before the cliff, everything at the end,
+//     and in between the grant vests linearly from its start. The owner may move coins
+//     of that denomination as long as the coins left behind cover the unvested part.
+//
+// Locks and grants are set by identities holding the minter role. Regulator actions
+// (forceTransfer, clawback) are not subject to them. vestingStatus also counts the
+// coins that staking locks, see staking.go.
+//
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["lockCoin","coin20","2026-01-01T00:00:00Z"]}'
+// peer chaincode invoke -C myc1 -n coins -c '{"Args":["grantVesting","org1msp/tom","adollar","48","2025-01-01T00:00:00Z","2026-01-01T00:00:00Z","2029-01-01T00:00:00Z"]}'
+// peer chaincode query -C myc1 -n coins -c '{"Args":["vestingStatus","org1msp/tom"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const vestingObjectType = "vesting"
+
+var (
+	errCoinLocked   = errors.New("COIN_LOCKED")
+	errCoinUnvested = errors.New("COIN_UNVESTED")
+)
+
+// vestingGrant is stored under vesting~owner~denomination~id, the ID being the
+// transaction that created it.
+type vestingGrant struct {
+	ObjectType   string `json:"docType"`
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	Denomination string `json:"denomination"`
+	Total        int64  `json:"total"` //number of coins covered
+	Start        string `json:"start"`
+	Cliff        string `json:"cliff"`
+	End          string `json:"end"`
+	GrantedBy    string `json:"grantedBy"`
+}
+
+// vestedAt returns the number of coins of the grant that have vested at time now.
+func (g *vestingGrant) vestedAt(now time.Time) int64 {
+	start, err := time.Parse(time.RFC3339, g.Start)
+	if err != nil {
+		return 0
+	}
+	cliff, err := time.Parse(time.RFC3339, g.Cliff)
+	if err != nil {
+		return 0
+	}
+	end, err := time.Parse(time.RFC3339, g.End)
+	if err != nil {
+		return 0
+	}
+
+	if now.Before(cliff) {
+		return 0
+	}
+	if !now.Before(end) {
+		return g.Total
+	}
+	// Total * elapsed / duration, in big integers as the product can overflow
+	vested := new(big.Int).Mul(big.NewInt(g.Total), big.NewInt(now.Unix()-start.Unix()))
+	vested.Quo(vested, big.NewInt(end.Unix()-start.Unix()))
+	return vested.Int64()
+}
+
+// ===================================================================================
+// getVestingGrants returns the grants of an owner, optionally only those of one
+// denomination
+// ===================================================================================
+func getVestingGrants(stub shim.ChaincodeStubInterface, owner string, amount string) ([]*vestingGrant, error) {
+	keys := []string{owner}
+	if len(amount) > 0 {
+		keys = append(keys, amount)
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(vestingObjectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	grants := []*vestingGrant{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		grant := &vestingGrant{}
+		err = json.Unmarshal(queryResponse.Value, grant)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode vesting grant: %s", queryResponse.Key)
+		}
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
+
+// ===================================================================================
+// countHoldings returns the number of coins of a denomination held by owner
+// ===================================================================================
+func countHoldings(stub shim.ChaincodeStubInterface, owner string, amount string) (int64, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(ownerAmountNameIndex, []string{owner, amount})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	var held int64
+	for resultsIterator.HasNext() {
+		_, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		held++
+	}
+	return held, nil
+}
+
+// ===================================================================================
+// checkLocks fails with errCoinLocked if the coin is locked or staked, or with errCoinUnvested
+// if its owner would no longer hold enough coins of its denomination to cover their
+// unvested grants. alreadyMoved is the number of such coins the owner has given away
+// earlier in the same transaction.
+// ===================================================================================
+func checkLocks(stub shim.ChaincodeStubInterface, c *coin, alreadyMoved int) error {
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	if len(c.LockedUntil) > 0 {
+		lockedUntil, err := time.Parse(time.RFC3339, c.LockedUntil)
+		if err != nil || now.Before(lockedUntil) {
+			return fmt.Errorf("%w: %s is locked until %s", errCoinLocked, c.Name, c.LockedUntil)
+		}
+	}
+	err = checkStake(stub, c, now)
+	if err != nil {
+		return err
+	}
+
+	grants, err := getVestingGrants(stub, c.Owner, c.Amount)
+	if err != nil || len(grants) == 0 {
+		return err
+	}
+	var unvested int64
+	for _, grant := range grants {
+		unvested += grant.Total - grant.vestedAt(now)
+	}
+	if unvested <= 0 {
+		return nil
+	}
+
+	held, err := countHoldings(stub, c.Owner, c.Amount)
+	if err != nil {
+		return err
+	}
+	held -= int64(alreadyMoved)
+	if held-1 < unvested {
+		return fmt.Errorf("%w: %s holds %d %s coins of which %d are unvested", errCoinUnvested, c.Owner, held, c.Amount, unvested)
+	}
+	return nil
+}
+
+// ===================================================================================
+// setCoinLock locks a coin until the given RFC3339 time. A lock can only be extended.
+// ===================================================================================
+func setCoinLock(stub shim.ChaincodeStubInterface, c *coin, unlockTime string) error {
+	lockedUntil, err := time.Parse(time.RFC3339, unlockTime)
+	if err != nil {
+		return fmt.Errorf("unlock time must be an RFC3339 timestamp")
+	}
+	if len(c.LockedUntil) > 0 {
+		current, err := time.Parse(time.RFC3339, c.LockedUntil)
+		if err == nil && !lockedUntil.After(current) {
+			return fmt.Errorf("%s is locked until %s, a lock can only be extended", c.Name, c.LockedUntil)
+		}
+	}
+
+	c.LockedUntil = lockedUntil.UTC().Format(time.RFC3339)
+	coinJSONasBytes, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(c.Name, coinJSONasBytes)
+}
+
+// ============================================================
+// lockCoin - minters only, lock a coin until a given time
+// ============================================================
+func (t *SimpleChaincode) lockCoin(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0                 1
+	// "coin20", "2026-01-01T00:00:00Z"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	minter, err := requireRole(stub, roleMinter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	c, err := getCoin(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = setCoinLock(stub, c, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = writeAudit(stub, "lock", c.Name, minter, map[string]string{"owner": c.Owner, "lockedUntil": c.LockedUntil})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end lockCoin " + c.Name + " until " + c.LockedUntil)
+	return shim.Success(nil)
+}
+
+// ============================================================
+// grantVesting - minters only, put a vesting schedule on a
+// number of coins of one denomination held by an owner
+// ============================================================
+func (t *SimpleChaincode) grantVesting(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//       0            1        2            3                        4                        5
+	// "org1msp/tom", "adollar", "48", "2025-01-01T00:00:00Z", "2026-01-01T00:00:00Z", "2029-01-01T00:00:00Z"
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting owner, denomination, total, start, cliff and end")
+	}
+
+	owner := normalizeIdentity(args[0])
+	if len(owner) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	amount := strings.ToLower(args[1])
+	d, err := getDenomination(stub, amount)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if d == nil {
+		return shim.Error("Unknown denomination: " + amount)
+	}
+	total, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || total <= 0 {
+		return shim.Error("3rd argument must be a positive number")
+	}
+
+	times := make([]time.Time, 3)
+	for i, arg := range args[3:] {
+		times[i], err = time.Parse(time.RFC3339, arg)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Argument %d must be an RFC3339 timestamp", i+4))
+		}
+		times[i] = times[i].UTC()
+	}
+	start, cliff, end := times[0], times[1], times[2]
+	if cliff.Before(start) || end.Before(cliff) || !end.After(start) {
+		return shim.Error("Vesting times must satisfy start <= cliff <= end and start < end")
+	}
+
+	minter, err := requireRole(stub, roleMinter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	grant := &vestingGrant{
+		ObjectType:   vestingObjectType,
+		ID:           stub.GetTxID(),
+		Owner:        owner,
+		Denomination: amount,
+		Total:        total,
+		Start:        start.Format(time.RFC3339),
+		Cliff:        cliff.Format(time.RFC3339),
+		End:          end.Format(time.RFC3339),
+		GrantedBy:    minter,
+	}
+	grantJSONasBytes, err := json.Marshal(grant)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	grantKey, err := stub.CreateCompositeKey(vestingObjectType, []string{owner, amount, grant.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(grantKey, grantJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = writeAudit(stub, "vestingGrant", owner, minter, map[string]string{
+		"denomination": amount,
+		"total":        args[2],
+		"start":        grant.Start,
+		"cliff":        grant.Cliff,
+		"end":          grant.End,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end grantVesting " + grant.ID)
+	return shim.Success([]byte(grant.ID))
+}
+
+type vestingGrantStatus struct {
+	*vestingGrant
+	Vested int64 `json:"vested"`
+}
+
+type vestingBalance struct {
+	Denomination string               `json:"denomination"`
+	Held         int64                `json:"held"`
+	TimeLocked   int64                `json:"timeLocked"` //coins locked until a later time
+	Staked       int64                `json:"staked"`     //coins staked or unbonding
+	Unvested     int64                `json:"unvested"`   //coins that must stay with the owner for their grants
+	Releasable   int64                `json:"releasable"` //coins the owner can move now
+	Grants       []vestingGrantStatus `json:"grants"`
+
+	locked int64 //coins time locked, staked or both
+}
+
+// ============================================================
+// vestingStatus - locked and releasable coins of an owner,
+// per denomination, at the transaction time
+// ============================================================
+func (t *SimpleChaincode) vestingStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting owner")
+	}
+	owner := normalizeIdentity(args[0])
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	balances := map[string]*vestingBalance{}
+	balanceOf := func(amount string) *vestingBalance {
+		if _, ok := balances[amount]; !ok {
+			balances[amount] = &vestingBalance{Denomination: amount, Grants: []vestingGrantStatus{}}
+		}
+		return balances[amount]
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(ownerAmountNameIndex, []string{owner})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		c, err := getCoin(stub, compositeKeyParts[len(compositeKeyParts)-1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		balance := balanceOf(c.Amount)
+		balance.Held++
+		locked := false
+		if len(c.LockedUntil) > 0 {
+			lockedUntil, err := time.Parse(time.RFC3339, c.LockedUntil)
+			if err != nil || now.Before(lockedUntil) {
+				balance.TimeLocked++
+				locked = true
+			}
+		}
+		staked, err := getStake(stub, c.Name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if staked != nil && staked.lockedAt(now) {
+			balance.Staked++
+			locked = true
+		}
+		if locked {
+			balance.locked++
+		}
+	}
+
+	grants, err := getVestingGrants(stub, owner, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, grant := range grants {
+		balance := balanceOf(grant.Denomination)
+		vested := grant.vestedAt(now)
+		balance.Unvested += grant.Total - vested
+		balance.Grants = append(balance.Grants, vestingGrantStatus{vestingGrant: grant, Vested: vested})
+	}
+
+	denominations := []string{}
+	for amount := range balances {
+		denominations = append(denominations, amount)
+	}
+	sort.Strings(denominations)
+
+	result := []*vestingBalance{}
+	for _, amount := range denominations {
+		balance := balances[amount]
+		// a transfer needs an unlocked coin and must leave the unvested coins behind
+		retained := balance.Unvested
+		if balance.locked > retained {
+			retained = balance.locked
+		}
+		if balance.Held > retained {
+			balance.Releasable = balance.Held - retained
+		}
+		result = append(result, balance)
+	}
+
+	statusJSONasBytes, err := json.Marshal(map[string]interface{}{
+		"owner":    owner,
+		"asOf":     now.Format(time.RFC3339),
+		"balances": result,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(statusJSONasBytes)
+}
@@ -0,0 +1,143 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const vestingTestConfig = `{"admins":["org1msp/admin"],"roles":{"minter":["org1msp/admin"]}}`
+
+// testVestingBalance is a vestingBalance without the grants, whose embedded type
+// cannot be decoded.
+type testVestingBalance struct {
+	Held       int64 `json:"held"`
+	TimeLocked int64 `json:"timeLocked"`
+	Unvested   int64 `json:"unvested"`
+	Releasable int64 `json:"releasable"`
+}
+
+func readTestVesting(t *testing.T, ledger *fakeLedger, cc *SimpleChaincode, owner string) *testVestingBalance {
+	t.Helper()
+	status := struct {
+		Balances []*testVestingBalance `json:"balances"`
+	}{}
+	err := json.Unmarshal(ledger.mustInvoke(t, cc, owner, "vestingStatus", owner), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Balances) != 1 {
+		t.Fatalf("vesting status of %s is %+v", owner, status.Balances)
+	}
+	return status.Balances[0]
+}
+
+func TestLockedCoin(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, vestingTestConfig)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin1", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin2", "adollar", "org1msp/tom")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "mint", "coin3", "adollar", "org1msp/tom", "2024-01-03T00:00:00Z")
+
+	if ledger.invoke(cc, "org1msp/tom", "lockCoin", "coin1", "2024-01-02T00:00:00Z").Status == shim.OK {
+		t.Errorf("an identity without the minter role locked a coin")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "lockCoin", "coin1", "2024-01-02T00:00:00Z")
+	if ledger.invoke(cc, "org1msp/admin", "lockCoin", "coin1", "2024-01-01T12:00:00Z").Status == shim.OK {
+		t.Errorf("the lock of coin1 was shortened")
+	}
+	if balance := readTestVesting(t, ledger, cc, "org1msp/tom"); balance.TimeLocked != 2 || balance.Releasable != 1 {
+		t.Errorf("vesting status with two of three coins locked is %+v", balance)
+	}
+
+	for _, name := range []string{"coin1", "coin3"} {
+		expectRefused(t, ledger, cc, errCoinLocked.Error(), "org1msp/tom", "transferCoin", name, "org2msp/jerry")
+		expectRefused(t, ledger, cc, errCoinLocked.Error(), "org1msp/admin", "delete", name)
+	}
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin2", "org2msp/jerry")
+
+	// the lock holds up to the second before the unlock time
+	ledger.clock = time.Date(2024, 1, 1, 23, 59, 59, 0, time.UTC)
+	expectRefused(t, ledger, cc, errCoinLocked.Error(), "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	ledger.clock = time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	expectRefused(t, ledger, cc, errCoinLocked.Error(), "org1msp/admin", "delete", "coin3")
+
+	ledger.clock = time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "delete", "coin3")
+	ledger.mustInvoke(t, cc, "org1msp/admin", "delete", "coin1")
+	checkLedgerConsistency(t, ledger)
+}
+
+func TestVestingGrant(t *testing.T) {
+	ledger, cc := newFakeChaincode(t, vestingTestConfig)
+	for _, name := range []string{"coin1", "coin2", "coin3", "coin4", "coin5"} {
+		ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", name, "adollar", "org1msp/tom")
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "initCoin", "coin6", "acent", "org1msp/tom")
+
+	// 4 of the 5 coins vest over 20 days, none before the 10 day cliff
+	grant := []string{"org1msp/tom", "adollar", "4", "2024-01-01T00:00:00Z", "2024-01-11T00:00:00Z", "2024-01-21T00:00:00Z"}
+	if ledger.invoke(cc, "org1msp/tom", "grantVesting", grant...).Status == shim.OK {
+		t.Errorf("an identity without the minter role granted vesting")
+	}
+	for _, times := range [][]string{
+		{"2024-01-11T00:00:00Z", "2024-01-01T00:00:00Z", "2024-01-21T00:00:00Z"},
+		{"2024-01-01T00:00:00Z", "2024-01-21T00:00:00Z", "2024-01-11T00:00:00Z"},
+		{"2024-01-01T00:00:00Z", "2024-01-01T00:00:00Z", "2024-01-01T00:00:00Z"},
+		{"2024-01-01", "2024-01-11T00:00:00Z", "2024-01-21T00:00:00Z"},
+	} {
+		if ledger.invoke(cc, "org1msp/admin", "grantVesting", append(grant[:3:3], times...)...).Status == shim.OK {
+			t.Errorf("grant with start, cliff and end %v succeeded", times)
+		}
+	}
+	ledger.mustInvoke(t, cc, "org1msp/admin", "grantVesting", grant...)
+
+	// before the cliff one coin is free, whichever it is, and other denominations are not covered
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin5", "org2msp/jerry")
+	ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", "coin6", "org2msp/jerry")
+	expectRefused(t, ledger, cc, errCoinUnvested.Error(), "org1msp/tom", "transferCoin", "coin1", "org2msp/jerry")
+	expectRefused(t, ledger, cc, errCoinUnvested.Error(), "org1msp/admin", "delete", "coin1")
+	if balance := readTestVesting(t, ledger, cc, "org1msp/tom"); balance.Held != 4 || balance.Unvested != 4 || balance.Releasable != 0 {
+		t.Errorf("vesting status before the cliff is %+v", balance)
+	}
+
+	// 15 days in, 3 of the 4 coins have vested
+	ledger.clock = time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC)
+	if balance := readTestVesting(t, ledger, cc, "org1msp/tom"); balance.Unvested != 1 || balance.Releasable != 3 {
+		t.Errorf("vesting status after 15 days is %+v", balance)
+	}
+	expectRefused(t, ledger, cc, errCoinUnvested.Error(), "org1msp/tom", "transferCoinsBasedOnAmount", "adollar", "org2msp/jerry")
+	for _, name := range []string{"coin1", "coin2", "coin3"} {
+		ledger.mustInvoke(t, cc, "org1msp/tom", "transferCoin", name, "org2msp/jerry")
+	}
+	if balance := readTestVesting(t, ledger, cc, "org1msp/tom"); balance.Held != 1 || balance.Releasable != 0 {
+		t.Errorf("vesting status after moving the releasable coins is %+v", balance)
+	}
+	expectRefused(t, ledger, cc, errCoinUnvested.Error(), "org1msp/tom", "transferCoin", "coin4", "org2msp/jerry")
+	expectRefused(t, ledger, cc, errCoinUnvested.Error(), "org1msp/admin", "delete", "coin4")
+
+	ledger.clock = time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)
+	ledger.mustInvoke(t, cc, "org1msp/admin", "delete", "coin4")
+	checkLedgerConsistency(t, ledger)
+}